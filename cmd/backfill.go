@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go-alpaca-streaming/pkg/backfill"
+	"go-alpaca-streaming/pkg/sink"
+	"go-alpaca-streaming/pkg/telegraf"
+	"go-alpaca-streaming/pkg/websocket_conn"
+)
+
+// runBackfill fetches the trades for a window from the historical trades
+// API, after finishing any window an earlier run left unfinished.
+func runBackfill(args []string) {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	start := fs.String("start", "", "start of the window, RFC 3339; only resumes unfinished windows when empty")
+	end := fs.String("end", "", "end of the window, RFC 3339; now when empty")
+	symbolList := fs.String("symbols", "", "comma-separated symbols; the subscribed symbols when empty")
+	sinkName := fs.String("sink", "telegraf", "where to write points: telegraf, stdout or discard")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: backfill [flags]")
+		fmt.Fprintln(fs.Output(), "Rate limit, feed and state file come from the shared configuration.")
+		fs.PrintDefaults()
+	}
+	cfg := loadConfig(fs, args)
+
+	if err := cfg.RequireCredentials(); err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := sink.New(*sinkName, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := out.(sink.Telegraf); ok {
+		telegraf.SetupTelegrafConnection()
+		defer telegraf.CloseTelegrafConnection()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	opts := clientOptions(cfg)
+	b := backfill.New(backfillConfig(cfg, opts))
+	if err := b.Resume(ctx, out); err != nil {
+		log.Fatalf("Resuming backfill failed: %v", err)
+	}
+	if *start == "" {
+		return
+	}
+
+	from, err := time.Parse(time.RFC3339, *start)
+	if err != nil {
+		log.Fatalf("Invalid -start: %v", err)
+	}
+	to := time.Now()
+	if *end != "" {
+		if to, err = time.Parse(time.RFC3339, *end); err != nil {
+			log.Fatalf("Invalid -end: %v", err)
+		}
+	}
+	if !to.After(from) {
+		log.Fatal("-end must be after -start")
+	}
+
+	var symbols []string
+	for _, s := range strings.Split(*symbolList, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			symbols = append(symbols, strings.ToUpper(s))
+		}
+	}
+	if len(symbols) == 0 {
+		var source string
+		if symbols, source, err = websocket_conn.ResolveSymbols(ctx, opts); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Using %d symbols from %s.", len(symbols), source)
+	}
+
+	if err := b.Fill(ctx, from, to, symbols, out); err != nil {
+		log.Fatalf("Backfill failed: %v", err)
+	}
+}
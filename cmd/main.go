@@ -1,17 +1,102 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
+	"fmt"
+	"go-alpaca-streaming/pkg/assets"
+	"go-alpaca-streaming/pkg/backfill"
+	"go-alpaca-streaming/pkg/backpressure"
+	"go-alpaca-streaming/pkg/bars"
+	"go-alpaca-streaming/pkg/batcher"
+	"go-alpaca-streaming/pkg/calendar"
+	"go-alpaca-streaming/pkg/checkpoint"
+	"go-alpaca-streaming/pkg/config"
+	"go-alpaca-streaming/pkg/dedup"
+	"go-alpaca-streaming/pkg/filter"
+	"go-alpaca-streaming/pkg/health"
+	"go-alpaca-streaming/pkg/metrics"
+	"go-alpaca-streaming/pkg/outlier"
+	"go-alpaca-streaming/pkg/stats"
+	author_symbols "go-alpaca-streaming/pkg/symbols"
+	"go-alpaca-streaming/pkg/telegraf"
 	"go-alpaca-streaming/pkg/websocket_conn"
+	"go-alpaca-streaming/pkg/workerpool"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 )
 
+// command is a subcommand of the CLI.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"stream", "stream trades into Telegraf (the default)", runStream},
+		{"symbols", "symbols list: show the symbols that would be subscribed and their source", runSymbols},
+		{"probe", "connect, subscribe to a few symbols and print the first frames", runProbe},
+		{"replay", "feed capture files through the pipeline", runReplay},
+		{"backfill", "fetch trades for a past window from the historical API", runBackfill},
+		{"validate-lp", "validate line protocol read from stdin", runValidateLP},
+		{"config", "config print: show the effective configuration", runConfig},
+		{"help", "show this help", runHelp},
+	}
+}
+
 func main() {
+	args := os.Args[1:]
+
+	// With no command, or only flags, stream as before.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		runStream(args)
+		return
+	}
+
+	for _, c := range commands {
+		if c.name == args[0] {
+			c.run(args[1:])
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	printUsage(os.Stderr)
+	os.Exit(2)
+}
+
+func runHelp(args []string) {
+	printUsage(os.Stdout)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: go-alpaca-streaming <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run \"<command> -h\" for the flags of a command.")
+}
+
+func runStream(args []string) {
+	fs := flag.NewFlagSet("stream", flag.ExitOnError)
+	cfg := loadConfig(fs, args)
+
 	/*
 		err := godotenv.Load("./cmd/.env")
 		if err != nil {
@@ -21,7 +106,7 @@ func main() {
 	*/
 	// SENTRY DSN - ATTACHES TO GLITCHTIP
 	err := sentry.Init(sentry.ClientOptions{
-		Dsn: os.Getenv("GO_ALPACA_STREAMING_SENTRY_DSN"),
+		Dsn: cfg.Sentry.DSN,
 	})
 	if err != nil {
 		log.Fatalf("sentry.Init: %s", err)
@@ -31,11 +116,8 @@ func main() {
 	// they are sent before we shut down
 	sentry.Flush(time.Second * 5)
 
-	if os.Getenv("APCA_API_KEY_ID") == "" {
-		log.Fatal("APCA_API_KEY_ID is not set")
-	}
-	if os.Getenv("APCA_API_SECRET_KEY") == "" {
-		log.Fatal("APCA_API_SECRET_KEY is not set")
+	if err := cfg.RequireCredentials(); err != nil {
+		log.Fatal(err)
 	}
 
 	var wg sync.WaitGroup
@@ -44,11 +126,203 @@ func main() {
 
 	log.Println("Starting the WebSocket client.")
 
-	go websocket_conn.RunWebSocketClient(&wg)
+	if cfg.Metrics.Addr != "" {
+		go func() {
+			if err := metrics.Serve(cfg.Metrics.Addr); err != nil {
+				log.Printf("Metrics server stopped: %v", err)
+			}
+		}()
+	}
+
+	opts := clientOptions(cfg)
+	if cfg.Checkpoint.File != "" {
+		store, err := checkpoint.Open(cfg.Checkpoint.File, cfg.Checkpoint.FlushInterval)
+		if err != nil {
+			log.Fatalf("Failed to read checkpoints: %v", err)
+		}
+		opts.Checkpoint = store
+	}
+	// The backfiller is built once the checkpoints are open, so the trades
+	// it writes move them too.
+	if cfg.Backfill.Enabled {
+		opts.Backfill = backfill.New(backfillConfig(cfg, opts))
+	}
+
+	// Stopping on a signal lets the pipeline drain and the checkpoints
+	// flush.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go websocket_conn.RunWebSocketClient(ctx, &wg, opts)
 
 	// Wait until all goroutines call Done
 	wg.Wait()
 
 	log.Println("WebSocket client has stopped.")
+}
+
+// runConfig implements "config print".
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "Usage: config print [flags]")
+		os.Exit(2)
+	}
 
+	fs := flag.NewFlagSet("config print", flag.ExitOnError)
+	cfg := loadConfig(fs, args[1:])
+
+	out, err := cfg.Redacted().YAML()
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(out)
+}
+
+// loadConfig registers the config flags on fs, parses args and returns the
+// effective configuration. Package-level settings are applied as well.
+func loadConfig(fs *flag.FlagSet, args []string) *config.Config {
+	loader := config.NewLoader(fs)
+	fs.Parse(args)
+
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	telegraf.Configure(cfg.Telegraf.Host, cfg.Telegraf.Port, cfg.Telegraf.MaxRetries, cfg.Telegraf.InitialBackoff)
+
+	return cfg
+}
+
+// clientOptions maps the configuration onto the client and pipeline settings.
+func clientOptions(cfg *config.Config) websocket_conn.ClientOptions {
+	// Validate has already checked the policy, intervals, route, identity,
+	// calendar file and symbol sources.
+	policy, _ := backpressure.ParsePolicy(cfg.Backpressure.Policy)
+	intervals, _ := cfg.Bars.Durations()
+	windows, _ := cfg.Stats.Durations()
+
+	var outliers *outlier.Config
+	if cfg.Outliers.Enabled {
+		route, _ := outlier.ParseRoute(cfg.Outliers.Route)
+		outliers = &outlier.Config{
+			Window:       cfg.Outliers.Window,
+			MinHistory:   cfg.Outliers.MinHistory,
+			Threshold:    cfg.Outliers.Threshold,
+			MinDeviation: cfg.Outliers.MinDeviation,
+			Route:        route,
+		}
+	}
+
+	sources, _ := author_symbols.NewChain(cfg.Symbols.Sources, cfg.Symbols.SymbolSources())
+
+	cal := calendar.NYSE()
+	if cfg.Calendar.File != "" {
+		cal, _ = calendar.Load(cfg.Calendar.File)
+	}
+
+	var schedule *websocket_conn.ScheduleConfig
+	if cfg.Schedule.Enabled {
+		schedule = &websocket_conn.ScheduleConfig{
+			Lead:   cfg.Schedule.Lead,
+			Linger: cfg.Schedule.Linger,
+		}
+	}
+
+	var monitor *health.Config
+	if cfg.Health.Enabled {
+		monitor = &health.Config{
+			SymbolThreshold:    cfg.Health.SymbolThreshold,
+			FeedThreshold:      cfg.Health.FeedThreshold,
+			MinTradesPerMinute: cfg.Health.MinTradesPerMinute,
+			CheckInterval:      cfg.Health.CheckInterval,
+		}
+	}
+
+	opts := websocket_conn.ClientOptions{
+		Batch: batcher.Config{
+			MaxSize:       cfg.Batch.MaxSize,
+			MaxLinger:     cfg.Batch.MaxLinger,
+			Adaptive:      cfg.Batch.Adaptive,
+			MinSize:       cfg.Batch.MinSize,
+			TargetLatency: cfg.Batch.TargetLatency,
+		},
+		Workers: workerpool.Config{
+			Workers:   cfg.Workers.Count,
+			QueueSize: cfg.Workers.QueueSize,
+			Backpressure: backpressure.Config{
+				Policy:   policy,
+				SpillDir: cfg.Backpressure.SpillDir,
+			},
+		},
+		CaptureDir:      cfg.Capture.Dir,
+		URL:             cfg.Alpaca.StreamURL,
+		KeyID:           cfg.Alpaca.KeyID,
+		SecretKey:       cfg.Alpaca.SecretKey,
+		SymbolSources:   sources,
+		EnrichExchanges: cfg.Enrich.Exchanges,
+		Bars: bars.Config{
+			Intervals:       intervals,
+			AllowedLateness: cfg.Bars.AllowedLateness,
+		},
+		Stats: stats.Config{
+			Windows:      windows,
+			EmitInterval: cfg.Stats.EmitInterval,
+		},
+		Filter: filter.Config{
+			MinSize:           cfg.Filter.MinSize,
+			ExcludeConditions: cfg.Filter.ExcludeConditions,
+			ExcludeExchanges:  cfg.Filter.ExcludeExchanges,
+			MinPrice:          cfg.Filter.MinPrice,
+			MaxPrice:          cfg.Filter.MaxPrice,
+			AllowSymbols:      cfg.Filter.AllowSymbols,
+			DenySymbols:       cfg.Filter.DenySymbols,
+		},
+		Outliers: outliers,
+		Health:   monitor,
+		Calendar: cal,
+		Schedule: schedule,
+		Reconnect: websocket_conn.ReconnectConfig{
+			MaxAttempts:    cfg.Reconnect.MaxAttempts,
+			InitialBackoff: cfg.Reconnect.InitialBackoff,
+			MaxBackoff:     cfg.Reconnect.MaxBackoff,
+		},
+	}
+	identity, _ := websocket_conn.ParsePointIdentity(cfg.Points.Identity)
+	opts.Identity = websocket_conn.NewPointIdentifier(identity)
+	if cfg.Dedup.Enabled {
+		opts.Dedup = dedup.New(dedup.Config{Window: cfg.Dedup.Window, MaxEntries: cfg.Dedup.MaxEntries})
+	}
+	if cfg.Assets.Enabled {
+		opts.Assets = assets.New(assets.Config{
+			URL:       cfg.Assets.URL,
+			KeyID:     cfg.Alpaca.KeyID,
+			SecretKey: cfg.Alpaca.SecretKey,
+			CacheFile: cfg.Assets.CacheFile,
+			MaxAge:    cfg.Assets.MaxAge,
+			Exchanges: cfg.Assets.Exchanges,
+		})
+	}
+	return opts
+}
+
+// backfillConfig maps the configuration onto the backfiller, which writes
+// trades the way opts has the stream write them.
+func backfillConfig(cfg *config.Config, opts websocket_conn.ClientOptions) backfill.Config {
+	return backfill.Config{
+		URL:               cfg.Backfill.URL,
+		KeyID:             cfg.Alpaca.KeyID,
+		SecretKey:         cfg.Alpaca.SecretKey,
+		Feed:              cfg.Backfill.Feed,
+		PageLimit:         cfg.Backfill.PageLimit,
+		RequestsPerMinute: cfg.Backfill.RequestsPerMinute,
+		StateFile:         cfg.Backfill.StateFile,
+		MaxWindow:         cfg.Backfill.MaxWindow,
+		EnrichExchanges:   opts.EnrichExchanges,
+		Calendar:          opts.Calendar,
+		Filter:            opts.Filter,
+		Dedup:             opts.Dedup,
+		Identity:          opts.Identity,
+		Checkpoint:        opts.Checkpoint,
+	}
 }
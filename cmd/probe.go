@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"go-alpaca-streaming/pkg/websocket_conn"
+)
+
+// runProbe connects, subscribes to a few symbols and prints the first frames.
+func runProbe(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	symbolList := fs.String("symbols", "AAPL,MSFT,SPY", "comma-separated symbols to subscribe to")
+	n := fs.Int("n", 10, "number of frames to print before disconnecting")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: probe [flags]")
+		fmt.Fprintln(fs.Output(), "Prints raw frames from the stream; nothing is written to a sink.")
+		fs.PrintDefaults()
+	}
+	cfg := loadConfig(fs, args)
+
+	if err := cfg.RequireCredentials(); err != nil {
+		log.Fatal(err)
+	}
+
+	var symbols []string
+	for _, s := range strings.Split(*symbolList, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			symbols = append(symbols, strings.ToUpper(s))
+		}
+	}
+	if len(symbols) == 0 {
+		log.Fatal("probe needs at least one symbol")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := websocket_conn.Probe(ctx, clientOptions(cfg), symbols, *n, os.Stdout); err != nil {
+		log.Fatalf("Probe failed: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go-alpaca-streaming/pkg/capture"
+	"go-alpaca-streaming/pkg/replay"
+	"go-alpaca-streaming/pkg/sink"
+	"go-alpaca-streaming/pkg/telegraf"
+	"go-alpaca-streaming/pkg/websocket_conn"
+)
+
+// runReplay feeds capture files through the same pipeline as live data.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "pace multiplier: 1 is the original pace, 0 is as fast as possible")
+	sinkName := fs.String("sink", "telegraf", "where to write points: telegraf, stdout or discard")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: replay [flags] <capture file or directory>...")
+		fmt.Fprintln(fs.Output(), "Batching, worker and backpressure settings come from the shared configuration.")
+		fs.PrintDefaults()
+	}
+	cfg := loadConfig(fs, args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	files, err := capture.Files(fs.Args())
+	if err != nil {
+		log.Fatalf("Failed to list capture files: %v", err)
+	}
+	if len(files) == 0 {
+		log.Fatal("No capture files found")
+	}
+
+	out, err := sink.New(*sinkName, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := out.(sink.Telegraf); ok {
+		telegraf.SetupTelegrafConnection()
+		defer telegraf.CloseTelegrafConnection()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	pipeline, err := websocket_conn.NewPipeline(clientOptions(cfg), out)
+	if err != nil {
+		log.Fatalf("Failed to start pipeline: %v", err)
+	}
+	pipeline.Start(ctx)
+
+	log.Printf("Replaying %d capture files at speed %g", len(files), *speed)
+	stats, err := replay.Run(ctx, files, replay.Options{Speed: *speed}, pipeline.ProcessFrame)
+
+	// Wait for everything queued to reach the sink before reporting.
+	pipeline.Close()
+
+	if err != nil && err != context.Canceled {
+		log.Fatalf("Replay failed after %v: %v", stats, err)
+	}
+	log.Printf("Replay finished: %v", stats)
+}
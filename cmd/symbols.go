@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	author_symbols "go-alpaca-streaming/pkg/symbols"
+	"go-alpaca-streaming/pkg/websocket_conn"
+)
+
+// runSymbols implements "symbols list".
+func runSymbols(args []string) {
+	if len(args) == 0 || args[0] != "list" {
+		fmt.Fprintln(os.Stderr, "Usage: symbols list [flags]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("symbols list", flag.ExitOnError)
+	cfg := loadConfig(fs, args[1:])
+
+	// Listing only looks at the symbols, so it leaves the cache the stream
+	// falls back on as it is.
+	opts := clientOptions(cfg)
+	src := cfg.Symbols.SymbolSources()
+	src.CacheReadOnly = true
+	opts.SymbolSources, _ = author_symbols.NewChain(cfg.Symbols.Sources, src)
+
+	symbols, source, err := websocket_conn.ResolveSymbols(context.Background(), opts)
+	if err != nil {
+		log.Fatalf("Failed to resolve symbols: %v", err)
+	}
+
+	fmt.Printf("# %d symbols from %s\n", len(symbols), source)
+	for _, symbol := range symbols {
+		fmt.Println(symbol)
+	}
+}
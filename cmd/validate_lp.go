@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"go-alpaca-streaming/pkg/telegraf"
+)
+
+// runValidateLP checks line protocol read from stdin and reports every
+// invalid line. It exits with status 1 if any line is invalid.
+func runValidateLP(args []string) {
+	fs := flag.NewFlagSet("validate-lp", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: validate-lp < points.lp")
+		fmt.Fprintln(fs.Output(), "Blank lines and lines starting with # are skipped.")
+	}
+	fs.Parse(args)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	lines, invalid := 0, 0
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		lines++
+		if err := telegraf.ValidateLineProtocol(line); err != nil {
+			invalid++
+			fmt.Printf("line %d: %v\n", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Error reading input: %v", err)
+	}
+
+	fmt.Printf("%d lines checked, %d invalid\n", lines, invalid)
+	if invalid > 0 {
+		os.Exit(1)
+	}
+}
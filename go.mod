@@ -3,13 +3,14 @@ module go-alpaca-streaming
 go 1.21
 
 require (
+	github.com/getsentry/sentry-go v0.25.0
 	github.com/gorilla/websocket v1.5.0
 	github.com/joho/godotenv v1.5.1
 	github.com/xitongsys/parquet-go-source v0.0.0-20230919034749-0b16411e6349
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/getsentry/sentry-go v0.25.0 // indirect
 	golang.org/x/exp v0.0.0-20220722155223-a9213eeb770e // indirect
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
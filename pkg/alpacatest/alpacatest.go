@@ -0,0 +1,504 @@
+// Package alpacatest provides an in-process stand-in for Alpaca's market data
+// stream, in the spirit of net/http/httptest. It speaks the same
+// connect/auth/subscribe handshake, answers with Alpaca's error codes, and
+// lets a test script trade, quote and bar messages and force disconnects.
+package alpacatest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Error codes sent by the stream, as documented by Alpaca.
+const (
+	CodeInvalidSyntax        = 400
+	CodeNotAuthenticated     = 401
+	CodeAuthFailed           = 402
+	CodeAlreadyAuthenticated = 403
+	CodeAuthTimeout          = 404
+	CodeSymbolLimitExceeded  = 405
+	CodeConnectionLimit      = 406
+	CodeSlowClient           = 407
+	CodeInsufficientSub      = 409
+	CodeInternalError        = 500
+)
+
+var errorMessages = map[int]string{
+	CodeInvalidSyntax:        "invalid syntax",
+	CodeNotAuthenticated:     "not authenticated",
+	CodeAuthFailed:           "auth failed",
+	CodeAlreadyAuthenticated: "already authenticated",
+	CodeAuthTimeout:          "auth timeout",
+	CodeSymbolLimitExceeded:  "symbol limit exceeded",
+	CodeConnectionLimit:      "connection limit exceeded",
+	CodeSlowClient:           "slow client",
+	CodeInsufficientSub:      "insufficient subscription",
+	CodeInternalError:        "internal error",
+}
+
+// Trade is a trade message ("T":"t").
+type Trade struct {
+	ID         int64    `json:"i"`
+	Symbol     string   `json:"S"`
+	Exchange   string   `json:"x"`
+	Price      float64  `json:"p"`
+	Size       int      `json:"s"`
+	Timestamp  string   `json:"t"`
+	Conditions []string `json:"c"`
+	Tape       string   `json:"z"`
+}
+
+// Quote is a quote message ("T":"q").
+type Quote struct {
+	Symbol      string   `json:"S"`
+	AskExchange string   `json:"ax"`
+	AskPrice    float64  `json:"ap"`
+	AskSize     int      `json:"as"`
+	BidExchange string   `json:"bx"`
+	BidPrice    float64  `json:"bp"`
+	BidSize     int      `json:"bs"`
+	Timestamp   string   `json:"t"`
+	Conditions  []string `json:"c"`
+	Tape        string   `json:"z"`
+}
+
+// Bar is a minute bar message ("T":"b").
+type Bar struct {
+	Symbol     string  `json:"S"`
+	Open       float64 `json:"o"`
+	High       float64 `json:"h"`
+	Low        float64 `json:"l"`
+	Close      float64 `json:"c"`
+	Volume     int     `json:"v"`
+	Timestamp  string  `json:"t"`
+	TradeCount int     `json:"n"`
+	VWAP       float64 `json:"vw"`
+}
+
+// channel names as they appear in subscribe messages.
+const (
+	channelTrades = "trades"
+	channelQuotes = "quotes"
+	channelBars   = "bars"
+)
+
+// Server is a fake stream server. Create it with NewServer and Close it when done.
+type Server struct {
+	// URL is the ws:// address to dial.
+	URL string
+
+	keyID     string
+	secretKey string
+
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu          sync.Mutex
+	conns       map[*serverConn]bool
+	connections int
+	symbolLimit int
+	rejectAuth  bool
+	authTimeout time.Duration
+	subscribed  chan map[string][]string
+	closed      bool
+}
+
+// NewServer starts a fake stream that accepts the given credentials.
+func NewServer(keyID, secretKey string) *Server {
+	s := &Server{
+		keyID:       keyID,
+		secretKey:   secretKey,
+		conns:       make(map[*serverConn]bool),
+		authTimeout: 10 * time.Second,
+		subscribed:  make(chan map[string][]string, 64),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = "ws" + strings.TrimPrefix(s.srv.URL, "http") + "/v2/sip"
+	return s
+}
+
+// Close disconnects every client and shuts the server down.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	s.Disconnect()
+	s.srv.Close()
+}
+
+// SetSymbolLimit makes subscriptions of more than n symbols per channel fail
+// with CodeSymbolLimitExceeded. Zero means no limit.
+func (s *Server) SetSymbolLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.symbolLimit = n
+}
+
+// RejectAuth makes every authentication attempt fail with CodeAuthFailed,
+// whatever credentials are presented.
+func (s *Server) RejectAuth(reject bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejectAuth = reject
+}
+
+// SetAuthTimeout sets how long a connection may stay unauthenticated before
+// it gets CodeAuthTimeout and is closed.
+func (s *Server) SetAuthTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authTimeout = d
+}
+
+// Connections returns how many connections have been accepted so far.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// WaitForSubscription blocks until a client's subscription is acknowledged
+// and returns the resulting subscription by channel. It returns an error if
+// none arrives within timeout.
+func (s *Server) WaitForSubscription(timeout time.Duration) (map[string][]string, error) {
+	select {
+	case sub := <-s.subscribed:
+		return sub, nil
+	case <-time.After(timeout):
+		return nil, errors.New("alpacatest: timed out waiting for a subscription")
+	}
+}
+
+// SendTrades sends trades to every client subscribed to their symbols.
+func (s *Server) SendTrades(trades ...Trade) {
+	for _, t := range trades {
+		s.broadcast(channelTrades, t.Symbol, "t", t)
+	}
+}
+
+// SendQuotes sends quotes to every client subscribed to their symbols.
+func (s *Server) SendQuotes(quotes ...Quote) {
+	for _, q := range quotes {
+		s.broadcast(channelQuotes, q.Symbol, "q", q)
+	}
+}
+
+// SendBars sends bars to every client subscribed to their symbols.
+func (s *Server) SendBars(bars ...Bar) {
+	for _, b := range bars {
+		s.broadcast(channelBars, b.Symbol, "b", b)
+	}
+}
+
+// SendError sends an error message with the given code to every
+// authenticated client.
+func (s *Server) SendError(code int) {
+	frame := errorFrame(code)
+	for _, c := range s.snapshot() {
+		if c.isAuthenticated() {
+			c.write(frame)
+		}
+	}
+}
+
+// SendRaw sends frame unchanged to every authenticated client.
+func (s *Server) SendRaw(frame []byte) {
+	for _, c := range s.snapshot() {
+		if c.isAuthenticated() {
+			c.write(frame)
+		}
+	}
+}
+
+// Disconnect drops every client connection without a close handshake, as a
+// network failure would.
+func (s *Server) Disconnect() {
+	for _, c := range s.snapshot() {
+		c.ws.UnderlyingConn().Close()
+	}
+}
+
+func (s *Server) snapshot() []*serverConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*serverConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (s *Server) broadcast(channel, symbol, msgType string, payload interface{}) {
+	frame, err := marshalMessage(msgType, payload)
+	if err != nil {
+		panic(err)
+	}
+	for _, c := range s.snapshot() {
+		if c.isSubscribed(channel, symbol) {
+			c.write(frame)
+		}
+	}
+}
+
+// marshalMessage encodes payload as a one-element frame with "T" set.
+func marshalMessage(msgType string, payload interface{}) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	// Go through RawMessage so large trade ids keep their exact value.
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	fields["T"], _ = json.Marshal(msgType)
+	return json.Marshal([]interface{}{fields})
+}
+
+func controlFrame(msgType, msg string) []byte {
+	frame, _ := json.Marshal([]map[string]interface{}{{"T": msgType, "msg": msg}})
+	return frame
+}
+
+func errorFrame(code int) []byte {
+	frame, _ := json.Marshal([]map[string]interface{}{{"T": "error", "code": code, "msg": errorMessages[code]}})
+	return frame
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		http.Error(w, "server closed", http.StatusServiceUnavailable)
+		return
+	}
+	s.mu.Unlock()
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := &serverConn{
+		ws:   ws,
+		subs: map[string]map[string]bool{channelTrades: {}, channelQuotes: {}, channelBars: {}},
+	}
+
+	s.mu.Lock()
+	s.conns[c] = true
+	s.connections++
+	authTimeout := s.authTimeout
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		ws.Close()
+	}()
+
+	c.write(controlFrame("success", "connected"))
+
+	// Credentials in the headers authenticate straight away.
+	if key := r.Header.Get("APCA-API-KEY-ID"); key != "" {
+		if !s.checkCredentials(key, r.Header.Get("APCA-API-SECRET-KEY")) {
+			c.write(errorFrame(CodeAuthFailed))
+			return
+		}
+		c.setAuthenticated()
+		c.write(controlFrame("success", "authenticated"))
+	} else {
+		timer := time.AfterFunc(authTimeout, func() {
+			if !c.isAuthenticated() {
+				c.write(errorFrame(CodeAuthTimeout))
+				ws.Close()
+			}
+		})
+		defer timer.Stop()
+	}
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if !s.handleAction(c, data) {
+			return
+		}
+	}
+}
+
+// action is a client request.
+type action struct {
+	Action string   `json:"action"`
+	Key    string   `json:"key"`
+	Secret string   `json:"secret"`
+	Trades []string `json:"trades"`
+	Quotes []string `json:"quotes"`
+	Bars   []string `json:"bars"`
+}
+
+// handleAction processes one client message. It returns false when the
+// connection should be closed.
+func (s *Server) handleAction(c *serverConn, data []byte) bool {
+	var a action
+	if err := json.Unmarshal(data, &a); err != nil {
+		c.write(errorFrame(CodeInvalidSyntax))
+		return true
+	}
+
+	switch a.Action {
+	case "auth":
+		if c.isAuthenticated() {
+			c.write(errorFrame(CodeAlreadyAuthenticated))
+			return true
+		}
+		if !s.checkCredentials(a.Key, a.Secret) {
+			c.write(errorFrame(CodeAuthFailed))
+			return false
+		}
+		c.setAuthenticated()
+		c.write(controlFrame("success", "authenticated"))
+
+	case "subscribe", "unsubscribe":
+		if !c.isAuthenticated() {
+			c.write(errorFrame(CodeNotAuthenticated))
+			return true
+		}
+
+		requested := map[string][]string{channelTrades: a.Trades, channelQuotes: a.Quotes, channelBars: a.Bars}
+		if a.Action == "subscribe" && s.exceedsLimit(c, requested) {
+			c.write(errorFrame(CodeSymbolLimitExceeded))
+			return true
+		}
+
+		sub := c.update(a.Action == "subscribe", requested)
+		frame, _ := json.Marshal([]map[string]interface{}{{
+			"T":      "subscription",
+			"trades": sub[channelTrades],
+			"quotes": sub[channelQuotes],
+			"bars":   sub[channelBars],
+		}})
+		c.write(frame)
+
+		select {
+		case s.subscribed <- sub:
+		default:
+		}
+
+	default:
+		c.write(errorFrame(CodeInvalidSyntax))
+	}
+
+	return true
+}
+
+func (s *Server) checkCredentials(key, secret string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.rejectAuth && key == s.keyID && secret == s.secretKey
+}
+
+func (s *Server) exceedsLimit(c *serverConn, requested map[string][]string) bool {
+	s.mu.Lock()
+	limit := s.symbolLimit
+	s.mu.Unlock()
+
+	if limit <= 0 {
+		return false
+	}
+	for _, symbols := range c.preview(requested) {
+		if len(symbols) > limit {
+			return true
+		}
+	}
+	return false
+}
+
+// serverConn is one client connection.
+type serverConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	mu            sync.Mutex
+	authenticated bool
+	subs          map[string]map[string]bool
+}
+
+func (c *serverConn) write(frame []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.WriteMessage(websocket.TextMessage, frame)
+}
+
+func (c *serverConn) isAuthenticated() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.authenticated
+}
+
+func (c *serverConn) setAuthenticated() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.authenticated = true
+}
+
+func (c *serverConn) isSubscribed(channel, symbol string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subs[channel][symbol] || c.subs[channel]["*"]
+}
+
+// preview returns what the subscription would be after adding requested.
+func (c *serverConn) preview(requested map[string][]string) map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[string][]string)
+	for channel, current := range c.subs {
+		seen := make(map[string]bool)
+		for symbol := range current {
+			seen[symbol] = true
+		}
+		for _, symbol := range requested[channel] {
+			seen[symbol] = true
+		}
+		for symbol := range seen {
+			out[channel] = append(out[channel], symbol)
+		}
+	}
+	return out
+}
+
+// update applies a subscribe or unsubscribe and returns the new subscription.
+func (c *serverConn) update(add bool, requested map[string][]string) map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[string][]string)
+	for channel, symbols := range requested {
+		for _, symbol := range symbols {
+			if add {
+				c.subs[channel][symbol] = true
+			} else {
+				delete(c.subs[channel], symbol)
+			}
+		}
+		out[channel] = []string{}
+		for symbol := range c.subs[channel] {
+			out[channel] = append(out[channel], symbol)
+		}
+		sort.Strings(out[channel])
+	}
+	return out
+}
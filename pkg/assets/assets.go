@@ -0,0 +1,218 @@
+package assets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go-alpaca-streaming/pkg/metrics"
+)
+
+// Asset is the part of an Alpaca asset the checks use.
+type Asset struct {
+	Symbol   string `json:"symbol"`
+	Exchange string `json:"exchange"`
+	Status   string `json:"status"`
+	Tradable bool   `json:"tradable"`
+}
+
+// Config says where the assets list comes from and what counts as valid.
+type Config struct {
+	// URL is the trading API base URL; https://api.alpaca.markets when
+	// empty.
+	URL       string
+	KeyID     string
+	SecretKey string
+	// CacheFile keeps the last list fetched; none when empty.
+	CacheFile string
+	// MaxAge is how long a cached list is used before it is fetched again;
+	// 24h when not positive. An older one is still used if fetching fails.
+	MaxAge time.Duration
+	// Exchanges, when set, are the only exchanges accepted, such as NYSE
+	// or NASDAQ.
+	Exchanges []string
+	// Client is the HTTP client; one with a 30s timeout when nil.
+	Client *http.Client
+}
+
+// DefaultConfig returns the settings used when nothing is configured.
+func DefaultConfig() Config {
+	return Config{URL: "https://api.alpaca.markets", MaxAge: 24 * time.Hour}
+}
+
+func (cfg Config) normalize() Config {
+	def := DefaultConfig()
+	if cfg.URL == "" {
+		cfg.URL = def.URL
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = def.MaxAge
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return cfg
+}
+
+var rejectedSymbols = metrics.Counter("assets_rejected_symbols")
+
+// cacheFile is the content of the cache file.
+type cacheFile struct {
+	Fetched time.Time `json:"fetched"`
+	Assets  []Asset   `json:"assets"`
+}
+
+// Checker checks symbols against Alpaca's list of US equities.
+type Checker struct {
+	cfg Config
+}
+
+// New creates a checker.
+func New(cfg Config) *Checker {
+	return &Checker{cfg: cfg.normalize()}
+}
+
+// Check returns the symbols that are active, tradable and, if Exchanges is
+// set, listed on one of them, in their original order, and the reason each
+// other symbol was left out. If no assets list can be had, every symbol is
+// kept and the error says why.
+func (c *Checker) Check(ctx context.Context, symbols []string) (valid []string, rejected map[string]string, err error) {
+	list, err := c.assets(ctx)
+	if err != nil {
+		return symbols, nil, err
+	}
+
+	bySymbol := make(map[string]Asset, len(list))
+	for _, a := range list {
+		bySymbol[a.Symbol] = a
+	}
+	rejected = make(map[string]string)
+	for _, symbol := range symbols {
+		if reason := c.reject(bySymbol, symbol); reason != "" {
+			rejected[symbol] = reason
+			continue
+		}
+		valid = append(valid, symbol)
+	}
+	rejectedSymbols.Set(int64(len(rejected)))
+	return valid, rejected, nil
+}
+
+func (c *Checker) reject(bySymbol map[string]Asset, symbol string) string {
+	a, ok := bySymbol[symbol]
+	switch {
+	case !ok:
+		return "unknown symbol"
+	case a.Status != "active":
+		return "status " + a.Status
+	case !a.Tradable:
+		return "not tradable"
+	case len(c.cfg.Exchanges) > 0 && !contains(c.cfg.Exchanges, a.Exchange):
+		return "listed on " + a.Exchange
+	}
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// assets returns the cached list while it is fresh, and otherwise fetches
+// it, falling back on a stale cache.
+func (c *Checker) assets(ctx context.Context) ([]Asset, error) {
+	cached, cacheErr := c.load()
+	if cacheErr == nil && time.Since(cached.Fetched) < c.cfg.MaxAge {
+		return cached.Assets, nil
+	}
+
+	list, err := c.fetch(ctx)
+	if err == nil {
+		if err := c.save(list); err != nil {
+			log.Printf("Failed to cache the assets list: %v", err)
+		}
+		return list, nil
+	}
+	if cacheErr == nil {
+		log.Printf("Fetching the assets list failed (%v); using the one from %s.", err, cached.Fetched.Format(time.RFC3339))
+		return cached.Assets, nil
+	}
+	return nil, err
+}
+
+func (c *Checker) fetch(ctx context.Context) ([]Asset, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.URL+"/v2/assets?status=active&asset_class=us_equity", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("APCA-API-KEY-ID", c.cfg.KeyID)
+	req.Header.Set("APCA-API-SECRET-KEY", c.cfg.SecretKey)
+
+	resp, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("GET /v2/assets: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var list []Asset
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("decoding assets: %v", err)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("GET /v2/assets returned no assets")
+	}
+	return list, nil
+}
+
+func (c *Checker) load() (cacheFile, error) {
+	var f cacheFile
+	if c.cfg.CacheFile == "" {
+		return f, os.ErrNotExist
+	}
+	data, err := os.ReadFile(c.cfg.CacheFile)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("%s: %v", c.cfg.CacheFile, err)
+	}
+	if len(f.Assets) == 0 {
+		return f, fmt.Errorf("%s has no assets", c.cfg.CacheFile)
+	}
+	return f, nil
+}
+
+// save writes the cache atomically, so a crash leaves the previous one.
+func (c *Checker) save(list []Asset) error {
+	if c.cfg.CacheFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(cacheFile{Fetched: time.Now().UTC(), Assets: list})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.cfg.CacheFile), 0o755); err != nil {
+		return err
+	}
+	tmp := c.cfg.CacheFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.cfg.CacheFile)
+}
@@ -0,0 +1,78 @@
+package assets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const list = `[
+	{"symbol":"AAPL","exchange":"NASDAQ","status":"active","tradable":true},
+	{"symbol":"BRK.B","exchange":"NYSE","status":"active","tradable":true},
+	{"symbol":"OLD","exchange":"NYSE","status":"inactive","tradable":false},
+	{"symbol":"HALT","exchange":"NYSE","status":"active","tradable":false},
+	{"symbol":"OTCX","exchange":"OTC","status":"active","tradable":true}
+]`
+
+func TestCheck(t *testing.T) {
+	var requests atomic.Int32
+	var up atomic.Bool
+	up.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/v2/assets" || r.Header.Get("APCA-API-KEY-ID") != "key" {
+			t.Errorf("Unexpected request %s %v", r.URL, r.Header)
+		}
+		if !up.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(list))
+	}))
+	defer srv.Close()
+
+	cfg := Config{
+		URL:       srv.URL,
+		KeyID:     "key",
+		CacheFile: filepath.Join(t.TempDir(), "assets.json"),
+		Exchanges: []string{"NYSE", "NASDAQ"},
+	}
+	valid, rejected, err := New(cfg).Check(context.Background(), []string{"AAPL", "NOPE", "OLD", "HALT", "OTCX", "BRK.B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(valid, ",") != "AAPL,BRK.B" {
+		t.Errorf("Unexpected valid symbols %v", valid)
+	}
+	want := map[string]string{"NOPE": "unknown symbol", "OLD": "status inactive", "HALT": "not tradable", "OTCX": "listed on OTC"}
+	for symbol, reason := range want {
+		if rejected[symbol] != reason {
+			t.Errorf("%s: got reason %q, want %q", symbol, rejected[symbol], reason)
+		}
+	}
+
+	// A fresh cache is used without asking again.
+	if _, _, err := New(cfg).Check(context.Background(), []string{"AAPL"}); err != nil || requests.Load() != 1 {
+		t.Errorf("Expected the cached list, got %v after %d requests", err, requests.Load())
+	}
+
+	// A stale cache is still better than nothing when the API is down.
+	up.Store(false)
+	cfg.MaxAge = time.Nanosecond
+	valid, _, err = New(cfg).Check(context.Background(), []string{"AAPL", "NOPE"})
+	if err != nil || strings.Join(valid, ",") != "AAPL" || requests.Load() != 2 {
+		t.Errorf("Expected the stale list, got %v, %v after %d requests", valid, err, requests.Load())
+	}
+
+	// Without any list every symbol is kept.
+	cfg.CacheFile = ""
+	valid, _, err = New(cfg).Check(context.Background(), []string{"AAPL", "NOPE"})
+	if err == nil || len(valid) != 2 {
+		t.Errorf("Expected every symbol and an error, got %v, %v", valid, err)
+	}
+}
@@ -0,0 +1,593 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-alpaca-streaming/pkg/calendar"
+	"go-alpaca-streaming/pkg/checkpoint"
+	"go-alpaca-streaming/pkg/dedup"
+	"go-alpaca-streaming/pkg/filter"
+	"go-alpaca-streaming/pkg/metrics"
+	"go-alpaca-streaming/pkg/sink"
+	"go-alpaca-streaming/pkg/telegraf"
+	"go-alpaca-streaming/pkg/utils"
+	"go-alpaca-streaming/pkg/websocket_conn"
+)
+
+// DefaultURL is Alpaca's market data REST API.
+const DefaultURL = "https://data.alpaca.markets"
+
+// Config controls where trades are fetched from and how they are written.
+type Config struct {
+	// URL is the REST API base; DefaultURL when empty.
+	URL       string
+	KeyID     string
+	SecretKey string
+	// Feed is the data feed, "sip" when empty.
+	Feed string
+	// PageLimit is the number of trades requested per page, at most 10000.
+	PageLimit int
+	// SymbolsPerRequest caps how many symbols share one request, which keeps
+	// URLs a reasonable length.
+	SymbolsPerRequest int
+	// RequestsPerMinute paces requests to stay under the account's limit.
+	RequestsPerMinute int
+	// StateFile records pending windows and how far each has got, so an
+	// interrupted backfill resumes where it stopped. Progress is kept only
+	// in memory when empty.
+	StateFile string
+
+	// EnrichExchanges, Calendar and Filter are applied as on the live
+	// stream, so backfilled points match the ones they stand in for.
+	EnrichExchanges bool
+	Calendar        *calendar.Calendar
+	Filter          filter.Config
+	// Dedup, shared with the stream, drops trades that already arrived
+	// live; nil disables it.
+	Dedup *dedup.Cache
+	// Identity, shared with the stream, keeps trades sharing a timestamp
+	// apart; nil writes them as they are.
+	Identity *websocket_conn.PointIdentifier
+	// Checkpoint, shared with the stream, records the last trade written
+	// per symbol; nil leaves it alone.
+	Checkpoint *checkpoint.Store
+
+	// MaxWindow is the longest window filled; an earlier start is moved
+	// forward, since a very old gap is better filled on purpose with the
+	// backfill command. 24h when not positive.
+	MaxWindow time.Duration
+
+	// Client is the HTTP client; one with a 30s timeout when nil.
+	Client *http.Client
+}
+
+// DefaultConfig returns the settings used when nothing is configured.
+func DefaultConfig() Config {
+	return Config{
+		URL:               DefaultURL,
+		Feed:              "sip",
+		PageLimit:         10000,
+		SymbolsPerRequest: 100,
+		RequestsPerMinute: 200,
+		MaxWindow:         24 * time.Hour,
+	}
+}
+
+func (cfg Config) normalize() Config {
+	def := DefaultConfig()
+	if cfg.URL == "" {
+		cfg.URL = def.URL
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	if cfg.Feed == "" {
+		cfg.Feed = def.Feed
+	}
+	if cfg.PageLimit <= 0 || cfg.PageLimit > 10000 {
+		cfg.PageLimit = def.PageLimit
+	}
+	if cfg.SymbolsPerRequest <= 0 {
+		cfg.SymbolsPerRequest = def.SymbolsPerRequest
+	}
+	if cfg.RequestsPerMinute <= 0 {
+		cfg.RequestsPerMinute = def.RequestsPerMinute
+	}
+	if cfg.MaxWindow <= 0 {
+		cfg.MaxWindow = def.MaxWindow
+	}
+	if cfg.Calendar == nil {
+		cfg.Calendar = calendar.NYSE()
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return cfg
+}
+
+var (
+	tradesWritten = metrics.Counter("backfill_trades_written")
+	requestsTotal = metrics.Counter("backfill_requests_total")
+	retriesTotal  = metrics.Counter("backfill_retries_total")
+	invalidLines  = metrics.Counter("invalid_lines_total")
+)
+
+// maxAttempts is how many times a request is tried when it is rate limited
+// or fails on the server side.
+const maxAttempts = 5
+
+// job is one window being backfilled, with its progress.
+type job struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Symbols []string  `json:"symbols"`
+	// Chunk is the index of the symbol chunk in progress.
+	Chunk int `json:"chunk"`
+	// After holds, per symbol, the time up to which trades were already
+	// written; older trades are skipped.
+	After map[string]time.Time `json:"after,omitempty"`
+	// PageToken continues the chunk; empty for its first page.
+	PageToken string `json:"page_token,omitempty"`
+	Trades    int    `json:"trades"`
+}
+
+// state is the content of the state file.
+type state struct {
+	Jobs []*job `json:"jobs"`
+}
+
+// Backfiller fetches trades for gaps in the stream from the historical
+// trades endpoint and writes them as the live pipeline would. It is safe
+// for concurrent use; windows are filled one at a time, in the order they
+// were added.
+type Backfiller struct {
+	cfg     Config
+	filter  *filter.Filter
+	limiter *limiter
+
+	// run is held while jobs are processed.
+	run sync.Mutex
+
+	mu   sync.Mutex
+	jobs []*job
+	// resumed is how many jobs were loaded from the state file, and
+	// loadErr why it couldn't be read.
+	resumed int
+	loadErr error
+}
+
+// New creates a backfiller. Windows left in the state file by an earlier
+// run are loaded here, ahead of any new window, so a Fill can't overwrite
+// them; Resume, or the first Fill, finishes them.
+func New(cfg Config) *Backfiller {
+	cfg = cfg.normalize()
+	b := &Backfiller{
+		cfg:     cfg,
+		filter:  filter.New(cfg.Filter),
+		limiter: newLimiter(time.Minute / time.Duration(cfg.RequestsPerMinute)),
+	}
+	b.jobs, b.loadErr = b.load()
+	b.resumed = len(b.jobs)
+	if b.loadErr != nil {
+		log.Printf("Failed to read the backfill state: %v", b.loadErr)
+	}
+	return b
+}
+
+// load reads the jobs saved in the state file.
+func (b *Backfiller) load() ([]*job, error) {
+	if b.cfg.StateFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(b.cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("%s: %v", b.cfg.StateFile, err)
+	}
+	return st.Jobs, nil
+}
+
+// Fill backfills trades for symbols made in [start, end) and writes them
+// to out. It returns once the window, and any added before it, is done,
+// or with an error if ctx ends or a request or write fails; the window
+// then stays in the state file for Resume.
+func (b *Backfiller) Fill(ctx context.Context, start, end time.Time, symbols []string, out sink.Sink) error {
+	return b.add(ctx, &job{Start: start, End: end, Symbols: symbols}, out)
+}
+
+// FillSince is Fill with a start per symbol, such as each symbol's
+// checkpoint. One window from the earliest start covers them all, and each
+// symbol's older trades are skipped.
+func (b *Backfiller) FillSince(ctx context.Context, since map[string]time.Time, end time.Time, out sink.Sink) error {
+	j := &job{End: end, After: make(map[string]time.Time, len(since))}
+	for symbol, t := range since {
+		if j.Start.IsZero() || t.Before(j.Start) {
+			j.Start = t
+		}
+		j.Symbols = append(j.Symbols, symbol)
+		j.After[symbol] = t.UTC()
+	}
+	sort.Strings(j.Symbols)
+	return b.add(ctx, j, out)
+}
+
+func (b *Backfiller) add(ctx context.Context, j *job, out sink.Sink) error {
+	if earliest := j.End.Add(-b.cfg.MaxWindow); j.Start.Before(earliest) {
+		log.Printf("Backfill window from %s is longer than %v; starting at %s instead",
+			j.Start.Format(time.RFC3339), b.cfg.MaxWindow, earliest.Format(time.RFC3339))
+		j.Start = earliest
+	}
+	if !j.End.After(j.Start) || len(j.Symbols) == 0 {
+		return nil
+	}
+	j.Start, j.End = j.Start.UTC(), j.End.UTC()
+
+	b.mu.Lock()
+	b.jobs = append(b.jobs, j)
+	err := b.saveLocked()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return b.drain(ctx, out)
+}
+
+// Resume finishes the windows an earlier run left in the state file, as
+// loaded by New.
+func (b *Backfiller) Resume(ctx context.Context, out sink.Sink) error {
+	if b.loadErr != nil || b.resumed == 0 {
+		return b.loadErr
+	}
+	log.Printf("Resuming %d backfill windows from %s", b.resumed, b.cfg.StateFile)
+	return b.drain(ctx, out)
+}
+
+// drain processes jobs until none are left.
+func (b *Backfiller) drain(ctx context.Context, out sink.Sink) error {
+	b.run.Lock()
+	defer b.run.Unlock()
+
+	for {
+		b.mu.Lock()
+		if len(b.jobs) == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		j := b.jobs[0]
+		b.mu.Unlock()
+
+		err := b.process(ctx, j, out)
+		var rejected *rejectedError
+		if err != nil && !errors.As(err, &rejected) {
+			return err
+		}
+
+		// A window the API rejects would be rejected again on every
+		// retry, so it is dropped rather than left to block later ones.
+		b.mu.Lock()
+		b.removeLocked(j)
+		saveErr := b.saveLocked()
+		b.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("dropped backfill window %s to %s: %w",
+				j.Start.Format(time.RFC3339), j.End.Format(time.RFC3339), err)
+		}
+		if saveErr != nil {
+			return saveErr
+		}
+		log.Printf("Backfilled %d trades for %d symbols from %s to %s",
+			j.Trades, len(j.Symbols), j.Start.Format(time.RFC3339), j.End.Format(time.RFC3339))
+	}
+}
+
+// removeLocked drops j from the queue. It is found by identity rather than
+// position, so the queue may change while j is processed.
+func (b *Backfiller) removeLocked(j *job) {
+	for i, queued := range b.jobs {
+		if queued == j {
+			b.jobs = append(b.jobs[:i:i], b.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// process pages through every symbol chunk of j, saving progress after
+// each page is written. A page written again, after a failed write or a
+// crash, overwrites its earlier points with the nudge point identity; the
+// sequence identity may tag them as new points instead.
+func (b *Backfiller) process(ctx context.Context, j *job, out sink.Sink) error {
+	// Only this goroutine changes j, always under mu, since Fill may be
+	// saving the state concurrently.
+	for j.Chunk*b.cfg.SymbolsPerRequest < len(j.Symbols) {
+		lo := j.Chunk * b.cfg.SymbolsPerRequest
+		hi := min(lo+b.cfg.SymbolsPerRequest, len(j.Symbols))
+
+		p, err := b.fetch(ctx, j, j.Symbols[lo:hi])
+		if err != nil {
+			return err
+		}
+		n, err := b.write(j, p, out)
+		if err != nil {
+			return fmt.Errorf("writing backfilled trades: %v", err)
+		}
+
+		b.mu.Lock()
+		j.Trades += n
+		j.PageToken = p.NextPageToken
+		if j.PageToken == "" {
+			j.Chunk++
+		}
+		err = b.saveLocked()
+		b.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// page is one response from the historical trades endpoint.
+type page struct {
+	Trades        map[string][]utils.RawTrade `json:"trades"`
+	NextPageToken string                      `json:"next_page_token"`
+}
+
+// fetch requests the next page of j for symbols, waiting for the rate
+// limiter and retrying rate-limited and server errors.
+func (b *Backfiller) fetch(ctx context.Context, j *job, symbols []string) (*page, error) {
+	q := url.Values{}
+	q.Set("symbols", strings.Join(symbols, ","))
+	q.Set("start", j.Start.Format(time.RFC3339Nano))
+	q.Set("end", j.End.Format(time.RFC3339Nano))
+	q.Set("limit", strconv.Itoa(b.cfg.PageLimit))
+	q.Set("feed", b.cfg.Feed)
+	q.Set("sort", "asc")
+	if j.PageToken != "" {
+		q.Set("page_token", j.PageToken)
+	}
+	u := b.cfg.URL + "/v2/stocks/trades?" + q.Encode()
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		if err := b.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		p, retryAfter, err := b.get(ctx, u)
+		if err == nil {
+			return p, nil
+		}
+		if retryAfter < 0 || attempt == maxAttempts {
+			return nil, err
+		}
+
+		if retryAfter == 0 {
+			retryAfter = backoff
+			backoff *= 2
+		}
+		retriesTotal.Add(1)
+		log.Printf("Backfill request failed: %v. Retrying in %v.", err, retryAfter)
+		select {
+		case <-time.After(retryAfter):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// get performs one request. retryAfter is negative when retrying cannot
+// help, zero when the default backoff applies, and otherwise what the
+// server asked for.
+func (b *Backfiller) get(ctx context.Context, u string) (p *page, retryAfter time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	req.Header.Set("APCA-API-KEY-ID", b.cfg.KeyID)
+	req.Header.Set("APCA-API-SECRET-KEY", b.cfg.SecretKey)
+
+	requestsTotal.Add(1)
+	resp, err := b.cfg.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, -1, ctx.Err()
+		}
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("GET %s: %s: %s", resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			if secs, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil && secs > 0 {
+				return nil, time.Duration(secs) * time.Second, err
+			}
+			return nil, 0, err
+		case resp.StatusCode >= 500:
+			return nil, 0, err
+		default:
+			return nil, -1, &rejectedError{err}
+		}
+	}
+
+	p = &page{}
+	if err := json.NewDecoder(resp.Body).Decode(p); err != nil {
+		return nil, 0, fmt.Errorf("decoding trades: %v", err)
+	}
+	return p, 0, nil
+}
+
+// write converts a page to line protocol and writes it, returning the
+// number of trades written.
+func (b *Backfiller) write(j *job, p *page, out sink.Sink) (int, error) {
+	symbols := make([]string, 0, len(p.Trades))
+	for symbol := range p.Trades {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	var lines []string
+	var written []utils.RawTrade
+	for _, symbol := range symbols {
+		for _, raw := range p.Trades[symbol] {
+			// Historical trades are keyed by symbol instead of carrying it.
+			raw.Type = "t"
+			raw.Symbol = symbol
+
+			if after, ok := j.After[symbol]; ok && tradeTime(raw).Before(after) {
+				continue
+			}
+			if b.cfg.Dedup != nil && b.cfg.Dedup.Seen(raw, tradeTime(raw)) {
+				continue
+			}
+			if b.filter != nil && b.filter.Check(raw) != "" {
+				continue
+			}
+
+			data := websocket_conn.ConvertToTradeData(raw)
+			data.Enriched = b.cfg.EnrichExchanges
+			if data.Time != 0 {
+				data.Session = b.cfg.Calendar.Session(time.Unix(0, data.Time))
+			}
+
+			if b.cfg.Identity != nil {
+				b.cfg.Identity.Apply(data)
+			}
+
+			line := data.FormatTradeLineProtocol()
+			if err := telegraf.ValidateLineProtocol(line); err != nil {
+				invalidLines.Add(1)
+				log.Println("Invalid line protocol:", line, err)
+				continue
+			}
+			lines = append(lines, line)
+			written = append(written, raw)
+		}
+	}
+
+	if len(lines) == 0 {
+		return 0, nil
+	}
+	if err := out.Write(lines); err != nil {
+		// The trades were remembered as seen; forget them, so a page
+		// retried after a failed write is written in full.
+		if b.cfg.Dedup != nil {
+			for _, raw := range written {
+				b.cfg.Dedup.Forget(raw)
+			}
+		}
+		return 0, err
+	}
+	// The checkpoint only moves forward, so an older filled gap leaves a
+	// newer live trade's checkpoint alone.
+	if b.cfg.Checkpoint != nil {
+		for _, raw := range written {
+			b.cfg.Checkpoint.Record(raw.Symbol, checkpoint.Entry{Time: tradeTime(raw), ID: raw.I, Exchange: raw.X, Tape: raw.Z})
+		}
+	}
+	tradesWritten.Add(int64(len(lines)))
+	return len(lines), nil
+}
+
+// tradeTime parses a trade's timestamp, returning the zero time if it is
+// missing or invalid.
+func tradeTime(raw utils.RawTrade) time.Time {
+	if ns := utils.ParseStrConvertToEpochNs(raw.Time); ns != 0 {
+		return time.Unix(0, ns).UTC()
+	}
+	return time.Time{}
+}
+
+// saveLocked writes the pending jobs to the state file, or removes it when
+// none are left. The file is replaced atomically so a crash never leaves
+// it half written.
+func (b *Backfiller) saveLocked() error {
+	if b.cfg.StateFile == "" {
+		return nil
+	}
+	if len(b.jobs) == 0 {
+		if err := os.Remove(b.cfg.StateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(state{Jobs: b.jobs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.cfg.StateFile), 0o755); err != nil {
+		return fmt.Errorf("saving backfill state: %v", err)
+	}
+	tmp := b.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("saving backfill state: %v", err)
+	}
+	if err := os.Rename(tmp, b.cfg.StateFile); err != nil {
+		return fmt.Errorf("saving backfill state: %v", err)
+	}
+	return nil
+}
+
+// rejectedError is a request the API refused for good, such as one for
+// data the account may not access.
+type rejectedError struct{ err error }
+
+func (e *rejectedError) Error() string { return e.err.Error() }
+func (e *rejectedError) Unwrap() error { return e.err }
+
+// limiter spaces requests at least interval apart.
+type limiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newLimiter(interval time.Duration) *limiter {
+	return &limiter{interval: interval}
+}
+
+// wait blocks until the next request may be sent.
+func (l *limiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,244 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-alpaca-streaming/pkg/checkpoint"
+)
+
+var (
+	start = time.Date(2024, 3, 1, 15, 0, 0, 0, time.UTC)
+	end   = start.Add(10 * time.Minute)
+)
+
+// pages serves the historical trades endpoint from canned pages, keyed by
+// page token.
+func pages(t *testing.T, requests *[]string) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*requests = append(*requests, r.URL.RawQuery)
+		mu.Unlock()
+
+		if r.URL.Path != "/v2/stocks/trades" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("APCA-API-KEY-ID") != "key" || r.Header.Get("APCA-API-SECRET-KEY") != "secret" {
+			t.Errorf("Missing credentials: %v", r.Header)
+		}
+		q := r.URL.Query()
+		if q.Get("symbols") != "AAPL,MSFT" || q.Get("start") != start.Format(time.RFC3339Nano) || q.Get("feed") != "sip" {
+			t.Errorf("Unexpected query %s", r.URL.RawQuery)
+		}
+
+		switch q.Get("page_token") {
+		case "":
+			w.Write([]byte(`{"trades":{
+				"AAPL":[{"t":"2024-03-01T15:00:01Z","x":"Q","p":170.5,"s":100,"c":["@"],"i":1,"z":"C"}],
+				"MSFT":[{"t":"2024-03-01T15:00:02Z","x":"D","p":410.1,"s":5,"c":["@","I"],"i":2,"z":"C"}]},
+				"next_page_token":"p2"}`))
+		case "p2":
+			w.Write([]byte(`{"trades":{
+				"AAPL":[{"t":"2024-03-01T15:05:00Z","x":"Q","p":171,"s":200,"c":["@"],"i":3,"z":"C"}]},
+				"next_page_token":null}`))
+		default:
+			t.Errorf("Unexpected page token %q", q.Get("page_token"))
+		}
+	}))
+}
+
+type recordingSink struct {
+	lines []string
+	// failAfter makes writes fail once this many lines are written.
+	failAfter int
+}
+
+func (s *recordingSink) Write(lines []string) error {
+	if s.failAfter > 0 && len(s.lines) >= s.failAfter {
+		return errors.New("sink down")
+	}
+	s.lines = append(s.lines, lines...)
+	return nil
+}
+
+func testConfig(url, stateFile string) Config {
+	return Config{URL: url, KeyID: "key", SecretKey: "secret", RequestsPerMinute: 60000, StateFile: stateFile}
+}
+
+func TestFillPagesAndWrites(t *testing.T) {
+	var requests []string
+	srv := pages(t, &requests)
+	defer srv.Close()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	out := &recordingSink{}
+	b := New(testConfig(srv.URL, stateFile))
+	if err := b.Fill(context.Background(), start, end, []string{"AAPL", "MSFT"}, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 2 {
+		t.Errorf("Expected 2 requests, got %d", len(requests))
+	}
+	if len(out.lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %v", out.lines)
+	}
+	want := `alpaca_equities_streaming_trades,symbol=AAPL,conditions_str="@",exchange=Q,session=regular price=170.500000,size=100,trade_id=1`
+	if !strings.HasPrefix(out.lines[0], want) {
+		t.Errorf("Got %s, want prefix %s", out.lines[0], want)
+	}
+	if !strings.Contains(out.lines[1], "symbol=MSFT") || !strings.Contains(out.lines[1], "odd_lot=true") {
+		t.Errorf("Unexpected MSFT line %s", out.lines[1])
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the state file to be removed, got %v", err)
+	}
+}
+
+func TestResumeAfterFailedWrite(t *testing.T) {
+	var requests []string
+	srv := pages(t, &requests)
+	defer srv.Close()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	out := &recordingSink{failAfter: 2}
+	if err := New(testConfig(srv.URL, stateFile)).Fill(context.Background(), start, end, []string{"AAPL", "MSFT"}, out); err == nil {
+		t.Fatal("Expected the failed write to stop the backfill")
+	}
+
+	var st state
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Jobs) != 1 || st.Jobs[0].PageToken != "p2" || st.Jobs[0].Trades != 2 {
+		t.Fatalf("Unexpected saved progress %s", data)
+	}
+
+	// A new run picks up from the second page.
+	out.failAfter = 0
+	requests = nil
+	if err := New(testConfig(srv.URL, stateFile)).Resume(context.Background(), out); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || !strings.Contains(requests[0], "page_token=p2") {
+		t.Errorf("Expected one request for the second page, got %v", requests)
+	}
+	if len(out.lines) != 3 {
+		t.Errorf("Expected 3 lines in total, got %d", len(out.lines))
+	}
+}
+
+func TestFillKeepsSavedWindows(t *testing.T) {
+	var requests []string
+	srv := pages(t, &requests)
+	defer srv.Close()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	saved, _ := json.Marshal(state{Jobs: []*job{{Start: start, End: end, Symbols: []string{"AAPL", "MSFT"}, PageToken: "p2", Trades: 2}}})
+	if err := os.WriteFile(stateFile, saved, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A live gap filled before Resume runs finishes the saved window first
+	// instead of overwriting it.
+	out := &recordingSink{}
+	b := New(testConfig(srv.URL, stateFile))
+	if err := b.Fill(context.Background(), start, end, []string{"AAPL", "MSFT"}, out); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 || !strings.Contains(requests[0], "page_token=p2") {
+		t.Errorf("Expected the saved page, then the new window, got %v", requests)
+	}
+	if len(out.lines) != 4 {
+		t.Errorf("Expected 4 lines, got %d", len(out.lines))
+	}
+	if err := b.Resume(context.Background(), out); err != nil || len(requests) != 3 {
+		t.Errorf("Expected Resume to find nothing left, got %v after %d requests", err, len(requests))
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the state file to be removed, got %v", err)
+	}
+}
+
+func TestRejectedWindowIsDropped(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"subscription does not permit querying recent SIP data"}`, http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	err := New(testConfig(srv.URL, stateFile)).Fill(context.Background(), start, end, []string{"AAPL"}, &recordingSink{})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Expected a 403 error, got %v", err)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the rejected window to be dropped, got %v", err)
+	}
+}
+
+func TestFillSinceSkipsCheckpointedTrades(t *testing.T) {
+	var requests []string
+	srv := pages(t, &requests)
+	defer srv.Close()
+
+	out := &recordingSink{}
+	since := map[string]time.Time{"AAPL": start, "MSFT": start.Add(3 * time.Second)}
+	b := New(testConfig(srv.URL, filepath.Join(t.TempDir(), "state.json")))
+	if err := b.FillSince(context.Background(), since, end, out); err != nil {
+		t.Fatal(err)
+	}
+
+	// One window from the earliest start; MSFT's trade is before its
+	// checkpoint.
+	if len(out.lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %v", out.lines)
+	}
+	for _, line := range out.lines {
+		if !strings.Contains(line, "symbol=AAPL") {
+			t.Errorf("Unexpected line %s", line)
+		}
+	}
+}
+
+func TestFillRecordsCheckpoints(t *testing.T) {
+	var requests []string
+	srv := pages(t, &requests)
+	defer srv.Close()
+
+	store, err := checkpoint.Open(filepath.Join(t.TempDir(), "checkpoint.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A newer live trade keeps MSFT's checkpoint.
+	live := checkpoint.Entry{Time: end, ID: 9, Exchange: "V", Tape: "C"}
+	store.Record("MSFT", live)
+
+	cfg := testConfig(srv.URL, filepath.Join(t.TempDir(), "state.json"))
+	cfg.Checkpoint = store
+	if err := New(cfg).Fill(context.Background(), start, end, []string{"AAPL", "MSFT"}, &recordingSink{}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := store.Entries()
+	want := checkpoint.Entry{Time: start.Add(5 * time.Minute), ID: 3, Exchange: "Q", Tape: "C"}
+	if entries["AAPL"] != want {
+		t.Errorf("Got AAPL checkpoint %+v, want %+v", entries["AAPL"], want)
+	}
+	if entries["MSFT"] != live {
+		t.Errorf("Got MSFT checkpoint %+v, want %+v", entries["MSFT"], live)
+	}
+}
@@ -0,0 +1,506 @@
+package backpressure
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go-alpaca-streaming/pkg/metrics"
+	"go-alpaca-streaming/pkg/utils"
+)
+
+// Policy decides what happens when a queue is full.
+type Policy string
+
+const (
+	// Block makes the producer wait for room. Nothing is lost, but a slow
+	// sink eventually stalls the websocket reader.
+	Block Policy = "block"
+	// DropOldest discards the oldest queued trade to make room.
+	DropOldest Policy = "drop-oldest"
+	// DropNewest discards the incoming trade.
+	DropNewest Policy = "drop-newest"
+	// SpillToDisk appends overflow to a file and reads it back, in order,
+	// as the queue drains.
+	SpillToDisk Policy = "spill-to-disk"
+)
+
+// ParsePolicy converts a configuration string into a Policy.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(strings.TrimSpace(s))); p {
+	case Block, DropOldest, DropNewest, SpillToDisk:
+		return p, nil
+	case "":
+		return Block, nil
+	default:
+		return "", fmt.Errorf("unknown backpressure policy %q", s)
+	}
+}
+
+// Config selects the policy for every queue.
+type Config struct {
+	Policy Policy
+	// SpillDir holds the overflow files used by SpillToDisk.
+	SpillDir string
+	// OnDrop, when set, is called with each trade a drop policy discards,
+	// with the queue locked.
+	OnDrop func(utils.RawTrade)
+}
+
+// DefaultConfig returns the policy used when nothing is configured.
+func DefaultConfig() Config {
+	return Config{
+		Policy: Block,
+		// Spilled trades are delivered after a restart, so they live
+		// with the rest of the state rather than in a temp dir.
+		SpillDir: "/data/alpaca-spill",
+	}
+}
+
+var (
+	droppedBySymbol = metrics.CounterMap("backpressure_dropped_by_symbol")
+	droppedTotal    = metrics.Counter("backpressure_dropped_total")
+	spilledTotal    = metrics.Counter("backpressure_spilled_total")
+	engagedTotal    = metrics.Counter("backpressure_engaged_total")
+)
+
+// Queue is a bounded FIFO of trades that applies a Policy when full.
+type Queue struct {
+	name     string
+	capacity int
+	policy   Policy
+	onDrop   func(utils.RawTrade)
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []utils.RawTrade
+	spill  *spillFile
+	closed bool
+
+	// engaged is true from the moment the policy kicks in until the queue
+	// has drained back below half capacity.
+	engaged  bool
+	affected int
+}
+
+// NewQueue creates a queue holding up to capacity trades in memory. name
+// identifies the queue in logs and in the spill file name.
+func NewQueue(name string, capacity int, cfg Config) (*Queue, error) {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	if cfg.Policy == "" {
+		cfg.Policy = Block
+	}
+
+	q := &Queue{
+		name:     name,
+		capacity: capacity,
+		policy:   cfg.Policy,
+		onDrop:   cfg.OnDrop,
+		items:    make([]utils.RawTrade, 0, capacity),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	if cfg.Policy == SpillToDisk {
+		spill, err := openSpillFile(spillPath(cfg.SpillDir, name))
+		if err != nil {
+			return nil, err
+		}
+		q.spill = spill
+		if spill.pending > 0 {
+			log.Printf("Queue %s: %d spilled trades left from a previous run will be delivered first", name, spill.pending)
+		}
+	}
+
+	return q, nil
+}
+
+// Push adds a trade, applying the policy if the queue is full. It returns
+// false only if ctx ended or the queue was closed; a trade discarded by a
+// drop policy still counts as accepted.
+func (q *Queue) Push(ctx context.Context, trade utils.RawTrade) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+
+	// Once anything is on disk, newer trades must follow it there to keep order.
+	if q.spill != nil && q.spill.pending > 0 {
+		return q.spillLocked(trade)
+	}
+
+	if len(q.items) >= q.capacity {
+		q.engageLocked()
+
+		switch q.policy {
+		case DropOldest:
+			q.dropLocked(q.items[0])
+			q.items = q.items[1:]
+		case DropNewest:
+			q.dropLocked(trade)
+			return true
+		case SpillToDisk:
+			return q.spillLocked(trade)
+		default:
+			if !q.waitForRoomLocked(ctx) {
+				return false
+			}
+		}
+	}
+
+	q.items = append(q.items, trade)
+	q.cond.Broadcast()
+	return true
+}
+
+// Start moves trades from the queue to the returned channel until the queue
+// is closed and drained, or ctx is done.
+func (q *Queue) Start(ctx context.Context) <-chan utils.RawTrade {
+	out := make(chan utils.RawTrade)
+
+	go func() {
+		defer close(out)
+		for {
+			trade, ok := q.pop(ctx)
+			if !ok {
+				return
+			}
+			select {
+			case out <- trade:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// Close stops accepting trades. Queued trades are still delivered.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Len returns the number of trades waiting, including any on disk.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := len(q.items)
+	if q.spill != nil {
+		n += q.spill.pending
+	}
+	return n
+}
+
+// pop blocks until a trade is available. It returns false once the queue is
+// closed and empty, or ctx is done.
+func (q *Queue) pop(ctx context.Context) (utils.RawTrade, bool) {
+	stop := context.AfterFunc(ctx, q.wake)
+	defer stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.spillPendingLocked() {
+		if q.closed || ctx.Err() != nil {
+			if q.spill != nil {
+				q.spill.close()
+			}
+			return utils.RawTrade{}, false
+		}
+		q.cond.Wait()
+	}
+
+	q.refillLocked()
+
+	trade := q.items[0]
+	q.items = q.items[1:]
+
+	if q.engaged && len(q.items)+q.spillPending() < q.capacity/2 {
+		q.releaseLocked()
+	}
+
+	q.cond.Broadcast()
+	return trade, true
+}
+
+func (q *Queue) wake() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *Queue) waitForRoomLocked(ctx context.Context) bool {
+	stop := context.AfterFunc(ctx, q.wake)
+	defer stop()
+
+	for len(q.items) >= q.capacity {
+		if q.closed || ctx.Err() != nil {
+			return false
+		}
+		q.cond.Wait()
+	}
+	return true
+}
+
+func (q *Queue) spillPendingLocked() bool {
+	return q.spill != nil && q.spill.pending > 0
+}
+
+func (q *Queue) spillPending() int {
+	if q.spill == nil {
+		return 0
+	}
+	return q.spill.pending
+}
+
+// refillLocked pulls spilled trades back into memory while there is room.
+// Everything on disk is newer than everything in memory, so appending keeps order.
+func (q *Queue) refillLocked() {
+	for q.spillPendingLocked() && len(q.items) < q.capacity {
+		trade, err := q.spill.read()
+		if err != nil {
+			log.Printf("Queue %s: error reading spill file, discarding %d spilled trades: %v",
+				q.name, q.spill.pending, err)
+			droppedTotal.Add(int64(q.spill.pending))
+			q.spill.reset()
+			return
+		}
+		q.items = append(q.items, trade)
+	}
+}
+
+func (q *Queue) spillLocked(trade utils.RawTrade) bool {
+	if err := q.spill.write(trade); err != nil {
+		log.Printf("Queue %s: error spilling trade to disk: %v", q.name, err)
+		q.dropLocked(trade)
+		return true
+	}
+	spilledTotal.Add(1)
+	q.affected++
+	q.cond.Broadcast()
+	return true
+}
+
+func (q *Queue) dropLocked(trade utils.RawTrade) {
+	droppedBySymbol.Add(trade.Symbol, 1)
+	droppedTotal.Add(1)
+	q.affected++
+	if q.onDrop != nil {
+		q.onDrop(trade)
+	}
+}
+
+func (q *Queue) engageLocked() {
+	if q.engaged {
+		return
+	}
+	q.engaged = true
+	q.affected = 0
+	engagedTotal.Add(1)
+	log.Printf("Queue %s is full (%d trades); applying %s backpressure policy", q.name, q.capacity, q.policy)
+}
+
+func (q *Queue) releaseLocked() {
+	q.engaged = false
+	switch q.policy {
+	case DropOldest, DropNewest:
+		log.Printf("Queue %s recovered; %d trades were dropped", q.name, q.affected)
+	case SpillToDisk:
+		log.Printf("Queue %s recovered; %d trades went through the spill file", q.name, q.affected)
+	default:
+		log.Printf("Queue %s recovered", q.name)
+	}
+}
+
+// spillPath returns the spill file of the queue called name.
+func spillPath(dir, name string) string {
+	return filepath.Join(dir, fmt.Sprintf("queue-%s.jsonl", name))
+}
+
+// Repartition moves the trades left in the spill files of the queues named
+// prefix followed by an index into the file of the queue owner now assigns
+// their symbol to, for queues 0 to n-1. Run it before the queues are
+// opened: with a different number of queues than the run that spilled
+// them, trades would otherwise be replayed into another partition, out of
+// order with their symbol's newer trades. Each symbol's trades keep their
+// order.
+func Repartition(dir, prefix string, n int, owner func(symbol string) int) error {
+	paths, err := filepath.Glob(spillPath(dir, prefix+"*"))
+	if err != nil {
+		return err
+	}
+	// Old files in index order, so the result doesn't depend on the
+	// directory listing.
+	old := make(map[int]string)
+	var indexes []int
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "queue-"+prefix), ".jsonl")
+		i, err := strconv.Atoi(name)
+		if err != nil || i < 0 {
+			continue
+		}
+		old[i] = path
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	buckets := make([][]byte, n)
+	moved := 0
+	for _, i := range indexes {
+		data, err := os.ReadFile(old[i])
+		if err != nil {
+			return fmt.Errorf("reading spill file: %w", err)
+		}
+		for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var trade utils.RawTrade
+			if err := json.Unmarshal(line, &trade); err != nil {
+				return fmt.Errorf("reading spill file %s: %w", old[i], err)
+			}
+			to := owner(trade.Symbol)
+			if to != i {
+				moved++
+			}
+			buckets[to] = append(buckets[to], line...)
+		}
+	}
+	if moved == 0 {
+		return nil
+	}
+
+	// Write every new file before removing any old one, so a crash leaves
+	// trades duplicated rather than lost.
+	for i, data := range buckets {
+		if len(data) == 0 {
+			continue
+		}
+		path := spillPath(dir, fmt.Sprintf("%s%d", prefix, i))
+		if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+			return fmt.Errorf("repartitioning spill files: %w", err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return fmt.Errorf("repartitioning spill files: %w", err)
+		}
+	}
+	for i, path := range old {
+		if i >= n || len(buckets[i]) == 0 {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("repartitioning spill files: %w", err)
+			}
+		}
+	}
+	log.Printf("Moved %d spilled trades to the queues that now own their symbols", moved)
+	return nil
+}
+
+// spillFile is an append-only JSON-lines file that is read back from the
+// front. It is truncated whenever it has been fully read.
+type spillFile struct {
+	path    string
+	w       *os.File
+	r       *os.File
+	rb      *bufio.Reader
+	pending int
+}
+
+func openSpillFile(path string) (*spillFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("creating spill directory: %w", err)
+	}
+
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening spill file: %w", err)
+	}
+	r, err := os.Open(path)
+	if err != nil {
+		w.Close()
+		return nil, fmt.Errorf("opening spill file for reading: %w", err)
+	}
+
+	s := &spillFile{path: path, w: w, r: r, rb: bufio.NewReader(r)}
+
+	// Count whatever a previous run left behind.
+	data, err := io.ReadAll(r)
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("reading spill file: %w", err)
+	}
+	s.pending = bytes.Count(data, []byte("\n"))
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		s.close()
+		return nil, err
+	}
+	s.rb.Reset(r)
+
+	return s, nil
+}
+
+func (s *spillFile) write(trade utils.RawTrade) error {
+	line, err := json.Marshal(trade)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.pending++
+	return nil
+}
+
+func (s *spillFile) read() (utils.RawTrade, error) {
+	var trade utils.RawTrade
+
+	line, err := s.rb.ReadBytes('\n')
+	if err != nil {
+		return trade, err
+	}
+	if err := json.Unmarshal(line, &trade); err != nil {
+		return trade, err
+	}
+
+	s.pending--
+	if s.pending == 0 {
+		s.reset()
+	}
+	return trade, nil
+}
+
+// reset empties the file once everything has been read back.
+func (s *spillFile) reset() {
+	s.pending = 0
+	if err := s.w.Truncate(0); err != nil {
+		log.Printf("Error truncating spill file %s: %v", s.path, err)
+	}
+	if _, err := s.r.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Error rewinding spill file %s: %v", s.path, err)
+	}
+	s.rb.Reset(s.r)
+}
+
+func (s *spillFile) close() {
+	s.w.Close()
+	s.r.Close()
+}
@@ -0,0 +1,197 @@
+package backpressure
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go-alpaca-streaming/pkg/utils"
+)
+
+func fill(t *testing.T, q *Queue, symbol string, ids ...int) {
+	t.Helper()
+	for _, id := range ids {
+		if !q.Push(context.Background(), utils.RawTrade{Symbol: symbol, I: id}) {
+			t.Fatalf("Push of trade %d was rejected", id)
+		}
+	}
+}
+
+func drain(q *Queue) []int {
+	q.Close()
+	var ids []int
+	for trade := range q.Start(context.Background()) {
+		ids = append(ids, trade.I)
+	}
+	return ids
+}
+
+func equalIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParsePolicy(t *testing.T) {
+	for input, expected := range map[string]Policy{
+		"":              Block,
+		"block":         Block,
+		"Drop-Oldest":   DropOldest,
+		" drop-newest ": DropNewest,
+		"spill-to-disk": SpillToDisk,
+	} {
+		got, err := ParsePolicy(input)
+		if err != nil || got != expected {
+			t.Errorf("ParsePolicy(%q) = %q, %v; expected %q", input, got, err, expected)
+		}
+	}
+
+	if _, err := ParsePolicy("yolo"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	q, err := NewQueue("test-drop-oldest", 3, Config{Policy: DropOldest})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fill(t, q, "OLD", 1, 2, 3, 4, 5)
+
+	if got := drain(q); !equalIDs(got, []int{3, 4, 5}) {
+		t.Fatalf("Expected the newest trades to survive, got %v", got)
+	}
+	if dropped, ok := droppedBySymbol.Get("OLD").(*expvar.Int); !ok || dropped.Value() != 2 {
+		t.Fatalf("Expected 2 drops counted for OLD, got %v", droppedBySymbol.Get("OLD"))
+	}
+}
+
+func TestDropNewest(t *testing.T) {
+	var dropped []int
+	q, err := NewQueue("test-drop-newest", 3, Config{Policy: DropNewest, OnDrop: func(trade utils.RawTrade) {
+		dropped = append(dropped, trade.I)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fill(t, q, "NEW", 1, 2, 3, 4, 5)
+
+	if got := drain(q); !equalIDs(got, []int{1, 2, 3}) {
+		t.Fatalf("Expected the oldest trades to survive, got %v", got)
+	}
+	if !equalIDs(dropped, []int{4, 5}) {
+		t.Fatalf("Expected OnDrop for the discarded trades, got %v", dropped)
+	}
+}
+
+func TestBlockWaitsForRoom(t *testing.T) {
+	q, err := NewQueue("test-block", 1, Config{Policy: Block})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, q, "BLK", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if q.Push(ctx, utils.RawTrade{Symbol: "BLK", I: 2}) {
+		t.Fatal("Expected Push to block until the context expired")
+	}
+
+	out := q.Start(context.Background())
+	if trade := <-out; trade.I != 1 {
+		t.Fatalf("Expected trade 1, got %d", trade.I)
+	}
+	fill(t, q, "BLK", 3)
+	if trade := <-out; trade.I != 3 {
+		t.Fatalf("Expected trade 3, got %d", trade.I)
+	}
+}
+
+func TestSpillToDiskPreservesOrder(t *testing.T) {
+	cfg := Config{Policy: SpillToDisk, SpillDir: t.TempDir()}
+	q, err := NewQueue("test-spill", 2, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fill(t, q, "SPL", 1, 2, 3, 4, 5, 6)
+	if q.Len() != 6 {
+		t.Fatalf("Expected 6 queued trades, got %d", q.Len())
+	}
+
+	if got := drain(q); !equalIDs(got, []int{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("Expected spilled trades in order, got %v", got)
+	}
+}
+
+func TestSpillFileSurvivesRestart(t *testing.T) {
+	cfg := Config{Policy: SpillToDisk, SpillDir: t.TempDir()}
+	q, err := NewQueue("test-restart", 1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, q, "RST", 1, 2, 3)
+
+	// Abandon the queue without draining it, as a crash would.
+	q.spill.close()
+
+	q, err = NewQueue("test-restart", 1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := drain(q); !equalIDs(got, []int{2, 3}) {
+		t.Fatalf("Expected the spilled trades from the previous run, got %v", got)
+	}
+}
+
+func TestRepartitionMovesSpilledTrades(t *testing.T) {
+	cfg := Config{Policy: SpillToDisk, SpillDir: t.TempDir()}
+
+	// A run with three queues spills, then crashes. The first trade of
+	// each queue was in memory and is lost.
+	var queues []*Queue
+	for _, name := range []string{"w-0", "w-1", "w-2"} {
+		q, err := NewQueue(name, 1, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queues = append(queues, q)
+	}
+	fill(t, queues[0], "AAPL", 0, 1)
+	fill(t, queues[0], "MSFT", 2)
+	fill(t, queues[0], "AAPL", 3)
+	fill(t, queues[1], "SPY", 10, 4)
+	fill(t, queues[2], "QQQ", 11, 5)
+	for _, q := range queues {
+		q.spill.close()
+	}
+
+	// The next run has two.
+	owner := map[string]int{"MSFT": 0, "SPY": 0, "AAPL": 1, "QQQ": 1}
+	if err := Repartition(cfg.SpillDir, "w-", 2, func(symbol string) int { return owner[symbol] }); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range [][]int{{2, 4}, {1, 3, 5}} {
+		q, err := NewQueue(fmt.Sprintf("w-%d", i), 1, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := drain(q); !equalIDs(got, want) {
+			t.Errorf("Queue %d: expected %v, got %v", i, want, got)
+		}
+	}
+	if _, err := os.Stat(spillPath(cfg.SpillDir, "w-2")); !os.IsNotExist(err) {
+		t.Errorf("Expected the third queue's file to be removed, got %v", err)
+	}
+}
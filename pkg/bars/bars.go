@@ -0,0 +1,418 @@
+package bars
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go-alpaca-streaming/pkg/eventclock"
+	"go-alpaca-streaming/pkg/metrics"
+	"go-alpaca-streaming/pkg/utils"
+)
+
+// Measurement is the line protocol measurement bars are written to.
+const Measurement = "alpaca_equities_streaming_bars"
+
+// Trade is the part of a decoded trade the aggregator needs.
+type Trade struct {
+	// ID is the trade id. Ids are only unique per symbol, exchange and
+	// tape, so corrections and cancels are matched on all four.
+	ID       int
+	Symbol   string
+	Exchange string
+	Tape     string
+	Price    float64
+	Size     int
+	Time     time.Time
+
+	// Eligibility derived from the trade's condition codes.
+	UpdatesLast    bool
+	UpdatesHighLow bool
+	UpdatesVolume  bool
+}
+
+// Bar is one OHLCV interval for a symbol.
+type Bar struct {
+	Symbol   string
+	Interval time.Duration
+	// Start is the beginning of the interval, aligned to a multiple of
+	// Interval since the Unix epoch (and so to wall-clock boundaries).
+	Start time.Time
+
+	// Open and Close come from trades that may update the last price and
+	// are only meaningful when HasPrice is true. High and Low come from
+	// trades that may update the high/low and need HasRange.
+	Open, High, Low, Close float64
+	HasPrice, HasRange     bool
+
+	// Volume, VWAP and Trades cover the trades that count toward volume.
+	Volume int64
+	VWAP   float64
+	Trades int
+
+	// Revision is 0 the first time a bar is emitted and goes up by one each
+	// time a late trade, correction or cancel amends it.
+	Revision int
+}
+
+// End returns the end of the bar's interval.
+func (b Bar) End() time.Time {
+	return b.Start.Add(b.Interval)
+}
+
+// LineProtocol formats the bar as a point in Measurement, timestamped with
+// the start of the interval.
+func (b Bar) LineProtocol() string {
+	fields := fmt.Sprintf("volume=%d,trade_count=%d", b.Volume, b.Trades)
+	if b.HasPrice {
+		fields += fmt.Sprintf(",open=%f,close=%f", b.Open, b.Close)
+	}
+	if b.HasRange {
+		fields += fmt.Sprintf(",high=%f,low=%f", b.High, b.Low)
+	}
+	if b.Volume > 0 {
+		fields += fmt.Sprintf(",vwap=%f", b.VWAP)
+	}
+	fields += fmt.Sprintf(",revision=%d", b.Revision)
+	return fmt.Sprintf("%s,symbol=%s,interval=%s %s %d",
+		Measurement, b.Symbol, utils.ShortDuration(b.Interval), fields, b.Start.UnixNano())
+}
+
+// EmitFunc receives completed and amended bars.
+type EmitFunc func(bars []Bar)
+
+// Config lists the bar intervals to build. Each interval should divide a
+// day evenly so that bars line up with clock boundaries.
+type Config struct {
+	Intervals []time.Duration
+	// AllowedLateness is how long after a bar's end, in trade time, late
+	// trades, corrections and cancels still amend it.
+	AllowedLateness time.Duration
+}
+
+var (
+	barsEmitted        = metrics.Counter("bars_emitted_total")
+	barsAmended        = metrics.Counter("bars_amended_total")
+	lateTrades         = metrics.Counter("bars_late_trades_total")
+	unmatchedAmendment = metrics.Counter("bars_unmatched_amendments_total")
+)
+
+// state accumulates one bar. The trades are kept until the bar is final so
+// that a correction or cancel can rebuild it.
+type state struct {
+	bar                Bar
+	trades             []Trade
+	openedAt, closedAt time.Time
+	notional           float64
+
+	emitted bool
+	dirty   bool
+}
+
+type key struct {
+	symbol   string
+	interval time.Duration
+	start    int64
+}
+
+// Aggregator builds bars from trades.
+//
+// Bars are closed by a watermark kept in trade time: the latest trade
+// timestamp seen, moved forward at wall-clock pace while no newer trade
+// arrives, so bars still close when the feed goes quiet. A bar is emitted
+// once the watermark passes its end, and kept for AllowedLateness after
+// that. Late trades, corrections and cancels in that window amend the bar,
+// which is emitted again with the same timestamp and a higher Revision.
+// Once the window has passed the bar is final; later trades are counted in
+// bars_late_trades_total and otherwise ignored.
+type Aggregator struct {
+	intervals []time.Duration
+	lateness  time.Duration
+	emit      EmitFunc
+	clock     eventclock.Clock
+
+	mu        sync.Mutex
+	open      map[key]*state
+	watermark time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates an aggregator that hands completed bars to emit.
+func New(cfg Config, emit EmitFunc) *Aggregator {
+	var intervals []time.Duration
+	for _, d := range cfg.Intervals {
+		if d > 0 {
+			intervals = append(intervals, d)
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+
+	return &Aggregator{
+		intervals: intervals,
+		lateness:  cfg.AllowedLateness,
+		emit:      emit,
+		open:      make(map[key]*state),
+	}
+}
+
+// Add folds a trade into the bars it belongs to. It is safe to call from
+// any goroutine.
+func (a *Aggregator) Add(t Trade) {
+	if t.Time.IsZero() || !t.eligible() {
+		return
+	}
+
+	a.clock.Observe(t.Time)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, interval := range a.intervals {
+		start := t.Time.Truncate(interval)
+		if !start.Add(interval + a.lateness).After(a.watermark) {
+			lateTrades.Add(1)
+			continue
+		}
+
+		k := key{t.Symbol, interval, start.UnixNano()}
+		s := a.open[k]
+		if s == nil {
+			s = &state{bar: Bar{Symbol: t.Symbol, Interval: interval, Start: start}}
+			a.open[k] = s
+		}
+		s.add(t)
+		s.dirty = s.emitted
+	}
+}
+
+// eligible reports whether the trade counts toward any bar field.
+func (t Trade) eligible() bool {
+	return t.UpdatesLast || t.UpdatesHighLow || t.UpdatesVolume
+}
+
+// Correct replaces the trade origID of symbol on exchange and tape with
+// corrected in every bar still open to amendment. corrected keeps the
+// original trade's timestamp. It reports whether any bar held the original
+// trade.
+//
+// If no bar held it, the original may not have been eligible for bars, so
+// an eligible corrected trade is added at its own Time like a late trade.
+func (a *Aggregator) Correct(symbol, exchange, tape string, origID int, corrected Trade) bool {
+	corrected.Symbol, corrected.Exchange, corrected.Tape = symbol, exchange, tape
+	if a.amend(symbol, exchange, tape, origID, func(orig Trade) (Trade, bool) {
+		corrected.Time = orig.Time
+		return corrected, true
+	}) {
+		return true
+	}
+
+	if corrected.Time.IsZero() || !corrected.eligible() {
+		unmatchedAmendment.Add(1)
+		return false
+	}
+	a.Add(corrected)
+	return false
+}
+
+// Cancel removes the trade id of symbol on exchange and tape from every bar
+// still open to amendment. It reports whether any bar held the trade.
+func (a *Aggregator) Cancel(symbol, exchange, tape string, id int) bool {
+	found := a.amend(symbol, exchange, tape, id, func(Trade) (Trade, bool) {
+		return Trade{}, false
+	})
+	if !found {
+		unmatchedAmendment.Add(1)
+	}
+	return found
+}
+
+// amend rebuilds every bar holding trade id of symbol on exchange and tape,
+// replacing the trade with the result of replace, or dropping it if replace
+// returns false. It reports whether any bar held the trade.
+func (a *Aggregator) amend(symbol, exchange, tape string, id int, replace func(Trade) (Trade, bool)) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	found := false
+	for k, s := range a.open {
+		if k.symbol != symbol {
+			continue
+		}
+		for i, t := range s.trades {
+			if t.ID != id || t.Exchange != exchange || t.Tape != tape {
+				continue
+			}
+			trades := append([]Trade(nil), s.trades[:i]...)
+			if r, ok := replace(t); ok {
+				trades = append(trades, r)
+			}
+			trades = append(trades, s.trades[i+1:]...)
+			s.rebuild(trades)
+			s.dirty = s.emitted
+			found = true
+			break
+		}
+	}
+	return found
+}
+
+// rebuild recomputes the bar from trades.
+func (s *state) rebuild(trades []Trade) {
+	b := s.bar
+	s.bar = Bar{Symbol: b.Symbol, Interval: b.Interval, Start: b.Start, Revision: b.Revision}
+	s.trades = nil
+	s.notional = 0
+	for _, t := range trades {
+		s.add(t)
+	}
+}
+
+func (s *state) add(t Trade) {
+	s.trades = append(s.trades, t)
+	b := &s.bar
+
+	if t.UpdatesLast {
+		if !b.HasPrice {
+			b.Open, b.Close = t.Price, t.Price
+			s.openedAt, s.closedAt = t.Time, t.Time
+			b.HasPrice = true
+		} else {
+			// Trades can arrive slightly out of order; keep open and close
+			// tied to the earliest and latest timestamps.
+			if t.Time.Before(s.openedAt) {
+				b.Open, s.openedAt = t.Price, t.Time
+			}
+			if !t.Time.Before(s.closedAt) {
+				b.Close, s.closedAt = t.Price, t.Time
+			}
+		}
+	}
+
+	if t.UpdatesHighLow {
+		if !b.HasRange {
+			b.High, b.Low = t.Price, t.Price
+			b.HasRange = true
+		}
+		if t.Price > b.High {
+			b.High = t.Price
+		}
+		if t.Price < b.Low {
+			b.Low = t.Price
+		}
+	}
+
+	if t.UpdatesVolume {
+		b.Volume += int64(t.Size)
+		b.Trades++
+		s.notional += t.Price * float64(t.Size)
+		if b.Volume > 0 {
+			b.VWAP = s.notional / float64(b.Volume)
+		}
+	}
+}
+
+// Advance moves the watermark to now, emits every bar that ended at or
+// before it or was amended since it was emitted, and drops bars whose
+// lateness window has passed.
+func (a *Aggregator) Advance(now time.Time) {
+	a.mu.Lock()
+	if wm := a.clock.Now(now); wm.After(a.watermark) {
+		a.watermark = wm
+	}
+	ready := a.collectLocked(func(b Bar) (emit, final bool) {
+		return !b.End().After(a.watermark), !b.End().Add(a.lateness).After(a.watermark)
+	})
+	a.mu.Unlock()
+
+	a.emitBars(ready)
+}
+
+// Start advances the watermark periodically until Close is called or ctx is done.
+func (a *Aggregator) Start(ctx context.Context) {
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+
+	tick := time.Second
+	if len(a.intervals) > 0 && a.intervals[0] < 4*tick {
+		tick = a.intervals[0] / 4
+	}
+
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-a.stop:
+				return
+			case now := <-ticker.C:
+				a.Advance(now)
+			}
+		}
+	}()
+}
+
+// Close stops the background ticker and emits every bar still open, so
+// nothing is lost at shutdown or at the end of a replay.
+func (a *Aggregator) Close() {
+	if a.stop != nil {
+		close(a.stop)
+		<-a.done
+		a.stop = nil
+	}
+
+	a.mu.Lock()
+	ready := a.collectLocked(func(Bar) (emit, final bool) { return true, true })
+	a.mu.Unlock()
+
+	a.emitBars(ready)
+}
+
+// collectLocked returns the bars to emit, oldest first: bars that are due
+// and not yet emitted, and emitted bars that have been amended since. Final
+// bars are dropped.
+func (a *Aggregator) collectLocked(due func(Bar) (emit, final bool)) []Bar {
+	var out []Bar
+	for k, s := range a.open {
+		emit, final := due(s.bar)
+		switch {
+		case emit && !s.emitted && len(s.trades) == 0:
+			// Every trade was canceled before the bar went out.
+		case emit && !s.emitted:
+			s.emitted = true
+			out = append(out, s.bar)
+		case s.dirty:
+			s.bar.Revision++
+			s.dirty = false
+			barsAmended.Add(1)
+			out = append(out, s.bar)
+		}
+		if final {
+			delete(a.open, k)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Start.Equal(out[j].Start) {
+			return out[i].Start.Before(out[j].Start)
+		}
+		if out[i].Symbol != out[j].Symbol {
+			return out[i].Symbol < out[j].Symbol
+		}
+		return out[i].Interval < out[j].Interval
+	})
+	return out
+}
+
+func (a *Aggregator) emitBars(bars []Bar) {
+	if len(bars) == 0 {
+		return
+	}
+	barsEmitted.Add(int64(len(bars)))
+	a.emit(bars)
+}
@@ -0,0 +1,200 @@
+package bars
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var base = time.Date(2024, 3, 1, 14, 30, 0, 0, time.UTC)
+
+// recorder collects emitted bars.
+type recorder struct {
+	mu   sync.Mutex
+	bars []Bar
+}
+
+func (r *recorder) emit(bars []Bar) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bars = append(r.bars, bars...)
+}
+
+func eligible(symbol string, price float64, size int, at time.Duration) Trade {
+	return Trade{
+		Symbol: symbol, Exchange: "V", Tape: "C", Price: price, Size: size, Time: base.Add(at),
+		UpdatesLast: true, UpdatesHighLow: true, UpdatesVolume: true,
+	}
+}
+
+// newTestAggregator returns an aggregator whose wall clock is *clock.
+func newTestAggregator(intervals []time.Duration, clock *time.Time) (*Aggregator, *recorder) {
+	r := &recorder{}
+	a := New(Config{Intervals: intervals}, r.emit)
+	a.clock.Wall = func() time.Time { return *clock }
+	return a, r
+}
+
+func TestAggregatorBuildsAlignedBars(t *testing.T) {
+	clock := time.Now()
+	a, r := newTestAggregator([]time.Duration{time.Second, 5 * time.Second}, &clock)
+
+	a.Add(eligible("AAPL", 10, 100, 1200*time.Millisecond))
+	a.Add(eligible("AAPL", 12, 100, 1500*time.Millisecond))
+	a.Add(eligible("AAPL", 9, 200, 1100*time.Millisecond)) // out of order: the new open
+	a.Add(eligible("AAPL", 11, 100, 3*time.Second))
+
+	// An odd lot counts toward volume but not the price.
+	oddLot := eligible("AAPL", 50, 5, 1300*time.Millisecond)
+	oddLot.UpdatesLast, oddLot.UpdatesHighLow = false, false
+	a.Add(oddLot)
+
+	// The watermark is now 3.5s into the minute: 1s bars up to 3s are done.
+	clock = clock.Add(500 * time.Millisecond)
+	a.Advance(clock)
+
+	if len(r.bars) != 1 {
+		t.Fatalf("Expected one closed bar, got %+v", r.bars)
+	}
+	b := r.bars[0]
+	if b.Interval != time.Second || !b.Start.Equal(base.Add(time.Second)) {
+		t.Fatalf("Unexpected bar %+v", b)
+	}
+	if b.Open != 9 || b.High != 12 || b.Low != 9 || b.Close != 12 {
+		t.Errorf("OHLC = %v/%v/%v/%v, want 9/12/9/12", b.Open, b.High, b.Low, b.Close)
+	}
+	if b.Volume != 405 || b.Trades != 4 {
+		t.Errorf("volume/trades = %d/%d, want 405/4", b.Volume, b.Trades)
+	}
+	wantVWAP := (10*100 + 12*100 + 9*200 + 50*5) / 405.0
+	if b.VWAP != wantVWAP {
+		t.Errorf("VWAP = %v, want %v", b.VWAP, wantVWAP)
+	}
+
+	a.Close()
+	if len(r.bars) != 3 {
+		t.Fatalf("Expected Close to emit the 3s and 5s bars, got %d bars", len(r.bars))
+	}
+	// Bars are emitted oldest first: the 5s bar starts before the 3s one.
+	five := r.bars[1]
+	if five.Interval != 5*time.Second || five.Open != 9 || five.Close != 11 || five.Volume != 505 {
+		t.Errorf("Unexpected 5s bar %+v", five)
+	}
+}
+
+func TestAggregatorIgnoresLateTrades(t *testing.T) {
+	clock := time.Now()
+	a, r := newTestAggregator([]time.Duration{time.Second}, &clock)
+
+	a.Add(eligible("MSFT", 10, 1, 0))
+	a.Add(eligible("MSFT", 10, 1, 2*time.Second))
+	a.Advance(clock)
+
+	before := lateTrades.Value()
+	a.Add(eligible("MSFT", 99, 1, 500*time.Millisecond))
+	if lateTrades.Value() != before+1 {
+		t.Fatalf("Expected the late trade to be counted")
+	}
+
+	a.Close()
+	for _, b := range r.bars {
+		if b.High == 99 {
+			t.Fatalf("Late trade changed an emitted bar: %+v", b)
+		}
+	}
+}
+
+func TestBarLineProtocol(t *testing.T) {
+	b := Bar{Symbol: "AAPL", Interval: 5 * time.Second, Start: base, Volume: 5, Trades: 1, VWAP: 50}
+	line := b.LineProtocol()
+	if strings.Contains(line, "open=") || strings.Contains(line, "high=") {
+		t.Errorf("A bar without eligible prices must not have OHLC: %s", line)
+	}
+	want := "alpaca_equities_streaming_bars,symbol=AAPL,interval=5s volume=5,trade_count=1,vwap=50.000000,revision=0 1709303400000000000"
+	if line != want {
+		t.Errorf("LineProtocol() = %q, want %q", line, want)
+	}
+}
+
+func TestAggregatorAmendsBarsWithinLateness(t *testing.T) {
+	clock := time.Now()
+	r := &recorder{}
+	a := New(Config{Intervals: []time.Duration{time.Second}, AllowedLateness: 2 * time.Second}, r.emit)
+	a.clock.Wall = func() time.Time { return clock }
+
+	first := eligible("AAPL", 10, 100, 100*time.Millisecond)
+	first.ID = 1
+	second := eligible("AAPL", 11, 100, 200*time.Millisecond)
+	second.ID = 2
+	a.Add(first)
+	a.Add(second)
+	a.Add(eligible("AAPL", 10, 1, 1500*time.Millisecond))
+	a.Advance(clock)
+
+	if len(r.bars) != 1 || r.bars[0].Revision != 0 || r.bars[0].Volume != 200 {
+		t.Fatalf("Expected the first bar at revision 0, got %+v", r.bars)
+	}
+
+	// A late trade inside the window amends the emitted bar.
+	a.Add(eligible("AAPL", 15, 50, 900*time.Millisecond))
+	a.Advance(clock)
+	if len(r.bars) != 2 || r.bars[1].Revision != 1 || r.bars[1].High != 15 || r.bars[1].Volume != 250 {
+		t.Fatalf("Expected an amended bar at revision 1, got %+v", r.bars[len(r.bars)-1])
+	}
+	if !r.bars[1].Start.Equal(r.bars[0].Start) {
+		t.Fatalf("An amended bar must keep its timestamp")
+	}
+
+	// A correction replaces the trade's price and size.
+	corrected := eligible("AAPL", 9, 300, 0)
+	corrected.ID = 3
+	if !a.Correct("AAPL", "V", "C", 2, corrected) {
+		t.Fatal("Expected the correction to match trade 2")
+	}
+	a.Advance(clock)
+	last := r.bars[len(r.bars)-1]
+	if last.Revision != 2 || last.Low != 9 || last.Close != 15 || last.Volume != 450 {
+		t.Fatalf("Unexpected corrected bar %+v", last)
+	}
+
+	// A correction whose original was never added, e.g. because its
+	// conditions kept it out of bars, adds the corrected trade instead.
+	added := eligible("AAPL", 8, 10, 400*time.Millisecond)
+	added.ID = 5
+	if a.Correct("AAPL", "V", "C", 4, added) {
+		t.Fatal("Expected no bar to hold trade 4")
+	}
+	a.Advance(clock)
+	last = r.bars[len(r.bars)-1]
+	if last.Revision != 3 || last.Low != 8 || last.Volume != 460 {
+		t.Fatalf("Unexpected bar after correcting an ineligible trade %+v", last)
+	}
+
+	// A cancel removes the trade, but only the one on its own exchange and
+	// tape: ids repeat across them.
+	if a.Cancel("AAPL", "Q", "C", 3) || a.Cancel("AAPL", "V", "A", 3) {
+		t.Fatal("A cancel must not match a trade on another exchange or tape")
+	}
+	if !a.Cancel("AAPL", "V", "C", 3) {
+		t.Fatal("Expected the cancel to match trade 3")
+	}
+	a.Advance(clock)
+	last = r.bars[len(r.bars)-1]
+	if last.Revision != 4 || last.Low != 8 || last.Volume != 160 {
+		t.Fatalf("Unexpected bar after cancel %+v", last)
+	}
+
+	// Past the lateness window the bar is final.
+	clock = clock.Add(3 * time.Second)
+	a.Advance(clock)
+	emitted := len(r.bars)
+	if a.Cancel("AAPL", "V", "C", 1) {
+		t.Fatal("A final bar must not be amended")
+	}
+	a.Add(eligible("AAPL", 20, 1, 500*time.Millisecond))
+	a.Advance(clock)
+	if len(r.bars) != emitted {
+		t.Fatalf("Expected no more emissions for a final bar, got %+v", r.bars[emitted:])
+	}
+}
@@ -0,0 +1,213 @@
+package batcher
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go-alpaca-streaming/pkg/utils"
+)
+
+// Config controls when a Batcher flushes.
+type Config struct {
+	// MaxSize is the largest batch that will be handed to the flush function.
+	MaxSize int
+	// MaxLinger is the longest a trade may wait in a partial batch before it is flushed.
+	MaxLinger time.Duration
+
+	// Adaptive enables sizing the batch from observed throughput and sink latency.
+	Adaptive bool
+	// MinSize is the smallest target size the adaptive mode will pick.
+	MinSize int
+	// TargetLatency is the sink latency above which adaptive mode grows batches
+	// to amortise the per-write cost.
+	TargetLatency time.Duration
+}
+
+// DefaultConfig returns the batching behaviour used when nothing is configured.
+func DefaultConfig() Config {
+	return Config{
+		MaxSize:       100,
+		MaxLinger:     time.Second,
+		Adaptive:      false,
+		MinSize:       10,
+		TargetLatency: 50 * time.Millisecond,
+	}
+}
+
+// normalize fills in zero values and keeps MinSize <= MaxSize.
+func (cfg Config) normalize() Config {
+	def := DefaultConfig()
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = def.MaxSize
+	}
+	if cfg.MaxLinger <= 0 {
+		cfg.MaxLinger = def.MaxLinger
+	}
+	if cfg.MinSize <= 0 {
+		cfg.MinSize = def.MinSize
+	}
+	if cfg.MinSize > cfg.MaxSize {
+		cfg.MinSize = cfg.MaxSize
+	}
+	if cfg.TargetLatency <= 0 {
+		cfg.TargetLatency = def.TargetLatency
+	}
+	return cfg
+}
+
+// FlushFunc receives a completed batch. The batcher does not reuse the slice.
+type FlushFunc func(batch []utils.RawTrade)
+
+// ewmaWeight is the weight given to the newest sample in the moving averages.
+const ewmaWeight = 0.2
+
+// Batcher groups trades into batches that are flushed when they reach the
+// current target size or when the oldest trade has lingered for MaxLinger.
+type Batcher struct {
+	cfg   Config
+	flush FlushFunc
+
+	batch    []utils.RawTrade
+	oldestAt time.Time
+
+	mu         sync.Mutex
+	targetSize int
+	rate       float64       // trades per second, EWMA
+	latency    time.Duration // sink latency, EWMA
+	counted    int
+	windowAt   time.Time
+}
+
+// New creates a Batcher that hands batches to flush.
+func New(cfg Config, flush FlushFunc) *Batcher {
+	cfg = cfg.normalize()
+	return &Batcher{
+		cfg:        cfg,
+		flush:      flush,
+		targetSize: cfg.MaxSize,
+		windowAt:   time.Now(),
+	}
+}
+
+// Run consumes trades from in until it is closed or ctx is cancelled,
+// flushing whatever is pending before it returns.
+func (b *Batcher) Run(ctx context.Context, in <-chan utils.RawTrade) {
+	// Tick at a fraction of the linger so a partial batch never waits much
+	// longer than MaxLinger.
+	tick := b.cfg.MaxLinger / 4
+	if tick <= 0 {
+		tick = b.cfg.MaxLinger
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	defer b.Flush()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case trade, ok := <-in:
+			if !ok {
+				return
+			}
+			b.Add(trade)
+		case now := <-ticker.C:
+			b.adapt(now)
+			if len(b.batch) > 0 && now.Sub(b.oldestAt) >= b.cfg.MaxLinger {
+				b.Flush()
+			}
+		}
+	}
+}
+
+// Add appends a trade and flushes if the batch reached its target size.
+// Add and Flush must be called from a single goroutine; Run does this.
+func (b *Batcher) Add(trade utils.RawTrade) {
+	if len(b.batch) == 0 {
+		b.oldestAt = time.Now()
+	}
+	b.batch = append(b.batch, trade)
+
+	b.mu.Lock()
+	b.counted++
+	target := b.targetSize
+	b.mu.Unlock()
+
+	if len(b.batch) >= target {
+		b.Flush()
+	}
+}
+
+// Flush hands the pending batch, if any, to the flush function.
+func (b *Batcher) Flush() {
+	if len(b.batch) == 0 {
+		return
+	}
+	batch := b.batch
+	b.batch = nil
+	b.flush(batch)
+}
+
+// ObserveLatency records how long the sink took to accept a batch. It is safe
+// to call from any goroutine, which lets asynchronous sinks report back.
+func (b *Batcher) ObserveLatency(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.latency == 0 {
+		b.latency = d
+		return
+	}
+	b.latency = time.Duration(ewmaWeight*float64(d) + (1-ewmaWeight)*float64(b.latency))
+}
+
+// TargetSize returns the size at which the next batch will be flushed.
+func (b *Batcher) TargetSize() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.targetSize
+}
+
+// adapt recomputes the target size from the trade rate seen since the last
+// call and the sink latency. Quiet symbols shrink towards MinSize so batches
+// go out promptly; a slow sink grows batches so fewer writes are made.
+func (b *Batcher) adapt(now time.Time) {
+	if !b.cfg.Adaptive {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	elapsed := now.Sub(b.windowAt).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	sample := float64(b.counted) / elapsed
+	b.rate = ewmaWeight*sample + (1-ewmaWeight)*b.rate
+	b.counted = 0
+	b.windowAt = now
+
+	// Enough trades to fill one linger interval.
+	target := b.rate * b.cfg.MaxLinger.Seconds()
+
+	// Scale up when the sink is slower than we would like.
+	if b.latency > b.cfg.TargetLatency {
+		target *= float64(b.latency) / float64(b.cfg.TargetLatency)
+	}
+
+	size := int(target)
+	if size < b.cfg.MinSize {
+		size = b.cfg.MinSize
+	}
+	if size > b.cfg.MaxSize {
+		size = b.cfg.MaxSize
+	}
+	if size != b.targetSize {
+		log.Printf("Adaptive batching: target size %d -> %d (rate %.1f/s, sink latency %v)",
+			b.targetSize, size, b.rate, b.latency)
+		b.targetSize = size
+	}
+}
@@ -0,0 +1,127 @@
+package batcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go-alpaca-streaming/pkg/utils"
+)
+
+// collector records flushed batches for assertions.
+type collector struct {
+	mu      sync.Mutex
+	batches [][]utils.RawTrade
+}
+
+func (c *collector) flush(batch []utils.RawTrade) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batches = append(c.batches, batch)
+}
+
+func (c *collector) snapshot() [][]utils.RawTrade {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]utils.RawTrade(nil), c.batches...)
+}
+
+func TestFlushOnMaxSize(t *testing.T) {
+	c := &collector{}
+	b := New(Config{MaxSize: 3, MaxLinger: time.Hour}, c.flush)
+
+	for i := 0; i < 7; i++ {
+		b.Add(utils.RawTrade{Symbol: "AAPL", I: i})
+	}
+
+	batches := c.snapshot()
+	if len(batches) != 2 {
+		t.Fatalf("Expected 2 full batches, got %d", len(batches))
+	}
+	for i, batch := range batches {
+		if len(batch) != 3 {
+			t.Errorf("Expected batch %d to have 3 trades, got %d", i, len(batch))
+		}
+	}
+
+	b.Flush()
+	batches = c.snapshot()
+	if len(batches) != 3 || len(batches[2]) != 1 {
+		t.Fatalf("Expected the remaining trade to be flushed on its own, got %v", batches)
+	}
+}
+
+func TestFlushOnMaxLinger(t *testing.T) {
+	c := &collector{}
+	b := New(Config{MaxSize: 100, MaxLinger: 40 * time.Millisecond}, c.flush)
+
+	in := make(chan utils.RawTrade)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx, in)
+
+	in <- utils.RawTrade{Symbol: "QUIET"}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if len(c.snapshot()) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	batches := c.snapshot()
+	if len(batches) != 1 || len(batches[0]) != 1 {
+		t.Fatalf("Expected a single lingering trade to be flushed, got %v", batches)
+	}
+}
+
+func TestRunFlushesOnClose(t *testing.T) {
+	c := &collector{}
+	b := New(Config{MaxSize: 100, MaxLinger: time.Hour}, c.flush)
+
+	in := make(chan utils.RawTrade, 2)
+	in <- utils.RawTrade{Symbol: "AAPL"}
+	in <- utils.RawTrade{Symbol: "MSFT"}
+	close(in)
+
+	b.Run(context.Background(), in)
+
+	batches := c.snapshot()
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("Expected pending trades to be flushed on close, got %v", batches)
+	}
+}
+
+func TestAdaptiveSizing(t *testing.T) {
+	c := &collector{}
+	b := New(Config{
+		MaxSize:       1000,
+		MinSize:       5,
+		MaxLinger:     time.Second,
+		Adaptive:      true,
+		TargetLatency: 10 * time.Millisecond,
+	}, c.flush)
+
+	// No trades at all: the target shrinks to the minimum.
+	b.adapt(b.windowAt.Add(time.Second))
+	if got := b.TargetSize(); got != 5 {
+		t.Fatalf("Expected idle target size 5, got %d", got)
+	}
+
+	// A slow sink pushes the target up.
+	b.counted = 100
+	b.ObserveLatency(100 * time.Millisecond)
+	b.adapt(b.windowAt.Add(time.Second))
+	if got := b.TargetSize(); got <= 5 {
+		t.Fatalf("Expected target size to grow with a slow sink, got %d", got)
+	}
+
+	// Never above MaxSize.
+	b.counted = 1000000
+	b.adapt(b.windowAt.Add(time.Second))
+	if got := b.TargetSize(); got != 1000 {
+		t.Fatalf("Expected target size capped at 1000, got %d", got)
+	}
+}
@@ -0,0 +1,311 @@
+package calendar
+
+import (
+	"fmt"
+	"os"
+	"time"
+	_ "time/tzdata" // market hours are in New York time wherever we run
+
+	"gopkg.in/yaml.v3"
+)
+
+// Session is the part of the trading day a moment falls in.
+type Session string
+
+const (
+	Pre       Session = "pre"
+	Regular   Session = "regular"
+	Post      Session = "post"
+	Overnight Session = "overnight"
+)
+
+// NewYork is the exchange time zone.
+var NewYork = mustLoadLocation("America/New_York")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// Session boundaries, in minutes after midnight New York time.
+const (
+	preOpen      = 4 * 60
+	regularOpen  = 9*60 + 30
+	regularClose = 16 * 60
+	earlyClose   = 13 * 60
+	// The post-market session runs four hours past the close.
+	postLength = 4 * 60
+)
+
+// Day holds one trading day's session boundaries.
+type Day struct {
+	PreOpen   time.Time
+	Open      time.Time
+	Close     time.Time
+	PostClose time.Time
+}
+
+// Calendar knows which days the exchange trades and when it closes early.
+// The zero value is not usable; use NYSE or Load.
+type Calendar struct {
+	holidays    map[date]bool
+	earlyCloses map[date]int // minutes after midnight
+	// rules applies the NYSE holiday and early-close rules to days the
+	// maps don't mention.
+	rules bool
+}
+
+type date struct {
+	year  int
+	month time.Month
+	day   int
+}
+
+func dateOf(t time.Time) date {
+	y, m, d := t.Date()
+	return date{y, m, d}
+}
+
+// NYSE returns the NYSE calendar: its regular holidays and early closes,
+// computed from the exchange's rules for any year. Unscheduled closures
+// are not known; add them with a calendar file.
+func NYSE() *Calendar {
+	return &Calendar{
+		holidays:    make(map[date]bool),
+		earlyCloses: make(map[date]int),
+		rules:       true,
+	}
+}
+
+// File is the format of a calendar file. Dates are YYYY-MM-DD and early
+// close times HH:MM, both New York time.
+type File struct {
+	// Holidays are days the exchange is closed, in addition to the NYSE
+	// rules unless Replace is set.
+	Holidays []string `yaml:"holidays"`
+	// EarlyCloses maps a date to its regular-session close.
+	EarlyCloses map[string]string `yaml:"early_closes"`
+	// Replace drops the built-in NYSE rules, so the file lists every
+	// holiday and early close.
+	Replace bool `yaml:"replace"`
+}
+
+// Load reads a calendar file.
+func Load(path string) (*Calendar, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cal, err := f.Calendar()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cal, nil
+}
+
+// Calendar builds the calendar the file describes.
+func (f File) Calendar() (*Calendar, error) {
+	cal := NYSE()
+	cal.rules = !f.Replace
+
+	for _, s := range f.Holidays {
+		d, err := time.Parse(time.DateOnly, s)
+		if err != nil {
+			return nil, fmt.Errorf("holiday %q: %v", s, err)
+		}
+		cal.holidays[dateOf(d)] = true
+	}
+	for s, close := range f.EarlyCloses {
+		d, err := time.Parse(time.DateOnly, s)
+		if err != nil {
+			return nil, fmt.Errorf("early close %q: %v", s, err)
+		}
+		c, err := time.Parse("15:04", close)
+		if err != nil {
+			return nil, fmt.Errorf("early close time %q: %v", close, err)
+		}
+		minutes := c.Hour()*60 + c.Minute()
+		if minutes <= regularOpen || minutes >= regularClose {
+			return nil, fmt.Errorf("early close %s %s is outside regular hours", s, close)
+		}
+		cal.earlyCloses[dateOf(d)] = minutes
+	}
+	return cal, nil
+}
+
+// IsTradingDay reports whether the exchange trades on t's New York date.
+func (c *Calendar) IsTradingDay(t time.Time) bool {
+	t = t.In(NewYork)
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return false
+	}
+	d := dateOf(t)
+	if c.holidays[d] {
+		return false
+	}
+	return !c.rules || !nyseHoliday(d)
+}
+
+// closeMinutes returns the regular close of a trading day.
+func (c *Calendar) closeMinutes(d date) int {
+	if m, ok := c.earlyCloses[d]; ok {
+		return m
+	}
+	if c.rules && nyseEarlyClose(d) {
+		return earlyClose
+	}
+	return regularClose
+}
+
+// Day returns the session boundaries of t's New York date, and false if
+// the exchange doesn't trade that day.
+func (c *Calendar) Day(t time.Time) (Day, bool) {
+	if !c.IsTradingDay(t) {
+		return Day{}, false
+	}
+	t = t.In(NewYork)
+	y, m, d := t.Date()
+	at := func(minutes int) time.Time {
+		return time.Date(y, m, d, minutes/60, minutes%60, 0, 0, NewYork)
+	}
+	closeAt := c.closeMinutes(date{y, m, d})
+	return Day{
+		PreOpen:   at(preOpen),
+		Open:      at(regularOpen),
+		Close:     at(closeAt),
+		PostClose: at(closeAt + postLength),
+	}, true
+}
+
+// Session returns the session t falls in. Everything outside the pre,
+// regular and post sessions of a trading day, including weekends and
+// holidays, is overnight.
+func (c *Calendar) Session(t time.Time) Session {
+	day, ok := c.Day(t)
+	switch {
+	case !ok, t.Before(day.PreOpen), !t.Before(day.PostClose):
+		return Overnight
+	case t.Before(day.Open):
+		return Pre
+	case t.Before(day.Close):
+		return Regular
+	default:
+		return Post
+	}
+}
+
+// NextDay returns the first trading day whose post-market session ends
+// after t: today's if it is still open, otherwise the next one. It returns
+// false if there is none within a year, which only a calendar file that
+// replaces the rules can cause.
+func (c *Calendar) NextDay(t time.Time) (Day, bool) {
+	for i := 0; i <= 366; i++ {
+		day, ok := c.Day(t.In(NewYork).AddDate(0, 0, i))
+		if ok && day.PostClose.After(t) {
+			return day, true
+		}
+	}
+	return Day{}, false
+}
+
+// nyseHoliday applies the NYSE holiday rules. A holiday on a Saturday is
+// observed the Friday before, except New Year's Day, and one on a Sunday
+// the Monday after.
+func nyseHoliday(d date) bool {
+	for _, h := range nyseHolidays(d.year) {
+		if h == d {
+			return true
+		}
+	}
+	return false
+}
+
+func nyseHolidays(year int) []date {
+	days := []date{
+		observed(date{year, time.January, 1}, false),
+		nthWeekday(year, time.January, time.Monday, 3),  // Martin Luther King Jr. Day
+		nthWeekday(year, time.February, time.Monday, 3), // Washington's Birthday
+		goodFriday(year),
+		lastWeekday(year, time.May, time.Monday), // Memorial Day
+		observed(date{year, time.July, 4}, true),
+		nthWeekday(year, time.September, time.Monday, 1),  // Labor Day
+		nthWeekday(year, time.November, time.Thursday, 4), // Thanksgiving
+		observed(date{year, time.December, 25}, true),
+	}
+	if year >= 2022 {
+		days = append(days, observed(date{year, time.June, 19}, true))
+	}
+	return days
+}
+
+// nyseEarlyClose applies the NYSE early-close rules: 13:00 on the day
+// before Independence Day and on Christmas Eve when they fall Monday to
+// Thursday, and on the day after Thanksgiving.
+func nyseEarlyClose(d date) bool {
+	wd := d.time().Weekday()
+	switch {
+	case d.month == time.July && d.day == 3, d.month == time.December && d.day == 24:
+		return wd >= time.Monday && wd <= time.Thursday
+	case d.month == time.November:
+		return d == dateOf(nthWeekday(d.year, time.November, time.Thursday, 4).time().AddDate(0, 0, 1))
+	}
+	return false
+}
+
+func (d date) time() time.Time {
+	return time.Date(d.year, d.month, d.day, 0, 0, 0, 0, time.UTC)
+}
+
+// observed moves a weekend holiday to the nearest weekday. New Year's Day
+// is not moved back into the previous year, so saturdayToFriday is false
+// for it.
+func observed(d date, saturdayToFriday bool) date {
+	switch d.time().Weekday() {
+	case time.Saturday:
+		if saturdayToFriday {
+			return dateOf(d.time().AddDate(0, 0, -1))
+		}
+		// Not observed at all.
+		return date{}
+	case time.Sunday:
+		return dateOf(d.time().AddDate(0, 0, 1))
+	}
+	return d
+}
+
+func nthWeekday(year int, month time.Month, wd time.Weekday, n int) date {
+	t := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	offset := (int(wd) - int(t.Weekday()) + 7) % 7
+	return dateOf(t.AddDate(0, 0, offset+7*(n-1)))
+}
+
+func lastWeekday(year int, month time.Month, wd time.Weekday) date {
+	t := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+	offset := (int(t.Weekday()) - int(wd) + 7) % 7
+	return dateOf(t.AddDate(0, 0, -offset))
+}
+
+// goodFriday returns the Friday before Easter, using the anonymous
+// Gregorian algorithm for Easter.
+func goodFriday(year int) date {
+	a := year % 19
+	b, c := year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	easter := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	return dateOf(easter.AddDate(0, 0, -2))
+}
@@ -0,0 +1,112 @@
+package calendar
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func ny(year int, month time.Month, day, hour, min int) time.Time {
+	return time.Date(year, month, day, hour, min, 0, 0, NewYork)
+}
+
+func TestNYSEHolidays(t *testing.T) {
+	cal := NYSE()
+	closed := []time.Time{
+		ny(2024, time.January, 1, 12, 0),
+		ny(2024, time.January, 15, 12, 0),  // Martin Luther King Jr. Day
+		ny(2024, time.March, 29, 12, 0),    // Good Friday
+		ny(2024, time.May, 27, 12, 0),      // Memorial Day
+		ny(2024, time.June, 19, 12, 0),     // Juneteenth
+		ny(2024, time.November, 28, 12, 0), // Thanksgiving
+		ny(2025, time.April, 18, 12, 0),    // Good Friday
+		ny(2026, time.July, 3, 12, 0),      // Independence Day, observed
+		ny(2027, time.December, 24, 12, 0), // Christmas, observed
+	}
+	for _, at := range closed {
+		if cal.IsTradingDay(at) {
+			t.Errorf("Expected %s to be a holiday", at.Format(time.DateOnly))
+		}
+	}
+
+	open := []time.Time{
+		ny(2024, time.March, 28, 12, 0),
+		ny(2021, time.June, 18, 12, 0),     // before Juneteenth was a holiday
+		ny(2021, time.December, 31, 12, 0), // New Year's Day on a Saturday is not observed
+	}
+	for _, at := range open {
+		if !cal.IsTradingDay(at) {
+			t.Errorf("Expected %s to be a trading day", at.Format(time.DateOnly))
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	cal := NYSE()
+	cases := []struct {
+		at   time.Time
+		want Session
+	}{
+		{ny(2024, time.March, 1, 3, 59), Overnight},
+		{ny(2024, time.March, 1, 4, 0), Pre},
+		{ny(2024, time.March, 1, 9, 30), Regular},
+		{ny(2024, time.March, 1, 15, 59), Regular},
+		{ny(2024, time.March, 1, 16, 0), Post},
+		{ny(2024, time.March, 1, 20, 0), Overnight},
+		{ny(2024, time.March, 2, 12, 0), Overnight}, // Saturday
+		// Early close the day after Thanksgiving.
+		{ny(2024, time.November, 29, 12, 59), Regular},
+		{ny(2024, time.November, 29, 13, 0), Post},
+		{ny(2024, time.November, 29, 17, 0), Overnight},
+		{ny(2024, time.December, 24, 13, 30), Post},
+		{ny(2024, time.July, 3, 14, 0), Post},
+	}
+	for _, c := range cases {
+		if got := cal.Session(c.at); got != c.want {
+			t.Errorf("Session(%v) = %s, want %s", c.at, got, c.want)
+		}
+	}
+}
+
+func TestLoadAddsToRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calendar.yaml")
+	data := "holidays:\n  - 2025-01-09\nearly_closes:\n  2025-03-03: \"12:00\"\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cal, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cal.IsTradingDay(ny(2025, time.January, 9, 12, 0)) {
+		t.Error("Expected the file's holiday to be closed")
+	}
+	if cal.IsTradingDay(ny(2025, time.December, 25, 12, 0)) {
+		t.Error("Expected the built-in holidays to still apply")
+	}
+	if got := cal.Session(ny(2025, time.March, 3, 12, 30)); got != Post {
+		t.Errorf("Session after the file's early close = %s, want post", got)
+	}
+
+	if _, err := (File{EarlyCloses: map[string]string{"2025-03-03": "17:00"}}).Calendar(); err == nil {
+		t.Error("Expected an early close after the regular close to be rejected")
+	}
+}
+
+func TestNextDay(t *testing.T) {
+	cal := NYSE()
+
+	// Friday evening after post-market: next is Monday.
+	day, ok := cal.NextDay(ny(2024, time.March, 1, 20, 30))
+	if !ok || !day.PreOpen.Equal(ny(2024, time.March, 4, 4, 0)) {
+		t.Errorf("NextDay = %+v, want Monday's", day)
+	}
+
+	// During the day it is today's.
+	day, _ = cal.NextDay(ny(2024, time.March, 4, 10, 0))
+	if !day.PostClose.Equal(ny(2024, time.March, 4, 20, 0)) {
+		t.Errorf("NextDay = %+v, want today's", day)
+	}
+}
@@ -0,0 +1,234 @@
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A capture file is a gzip stream of records, each laid out as
+//
+//	int64  receive time, unix nanoseconds, big endian
+//	uint32 frame length, big endian
+//	[]byte frame, exactly as read from the websocket
+//
+// Files are named frames-YYYYMMDDTHH.cap.gz after the UTC hour they cover.
+
+const (
+	filePrefix = "frames-"
+	fileSuffix = ".cap.gz"
+	hourLayout = "20060102T15"
+
+	// maxFrameSize guards the reader against corrupt length prefixes.
+	maxFrameSize = 64 << 20
+)
+
+// Frame is one websocket message and the time it was received.
+type Frame struct {
+	ReceivedAt time.Time
+	Data       []byte
+}
+
+// Writer appends frames to hourly capture files in a directory.
+type Writer struct {
+	dir string
+
+	mu   sync.Mutex
+	hour time.Time
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+}
+
+// NewWriter creates a Writer that puts capture files in dir.
+func NewWriter(dir string) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating capture directory: %w", err)
+	}
+	return &Writer{dir: dir}, nil
+}
+
+// FileName returns the capture file name for the hour containing t.
+func FileName(t time.Time) string {
+	return filePrefix + t.UTC().Format(hourLayout) + fileSuffix
+}
+
+// Write records a frame received at receivedAt, rotating to a new file when
+// the hour changes. The frame is copied, so the caller may reuse data.
+func (w *Writer) Write(receivedAt time.Time, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	hour := receivedAt.UTC().Truncate(time.Hour)
+	if w.file == nil || !hour.Equal(w.hour) {
+		if err := w.rotateLocked(hour); err != nil {
+			return err
+		}
+	}
+
+	var header [12]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(receivedAt.UnixNano()))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(data)))
+
+	if _, err := w.buf.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.buf.Write(data)
+	return err
+}
+
+// Flush pushes buffered frames into the current file.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.gz.Flush()
+}
+
+// Close flushes and closes the current file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeLocked()
+}
+
+func (w *Writer) rotateLocked(hour time.Time) error {
+	if err := w.closeLocked(); err != nil {
+		return err
+	}
+
+	// Appending to an existing hour (after a restart) adds a second gzip
+	// member, which gzip readers handle transparently.
+	path := filepath.Join(w.dir, FileName(hour))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening capture file: %w", err)
+	}
+
+	w.hour = hour
+	w.file = file
+	w.gz = gzip.NewWriter(file)
+	w.buf = bufio.NewWriter(w.gz)
+	return nil
+}
+
+func (w *Writer) closeLocked() error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.buf.Flush()
+	if gzErr := w.gz.Close(); err == nil {
+		err = gzErr
+	}
+	if fileErr := w.file.Close(); err == nil {
+		err = fileErr
+	}
+
+	w.file, w.gz, w.buf = nil, nil, nil
+	return err
+}
+
+// Reader reads frames back from a single capture file.
+type Reader struct {
+	file *os.File
+	gz   *gzip.Reader
+	buf  *bufio.Reader
+}
+
+// Open opens a capture file for reading.
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading capture file %s: %w", path, err)
+	}
+	return &Reader{file: file, gz: gz, buf: bufio.NewReader(gz)}, nil
+}
+
+// Next returns the next frame, or io.EOF at the end of the file.
+func (r *Reader) Next() (Frame, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r.buf, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// A file cut short by a crash ends in a partial record.
+			return Frame{}, io.EOF
+		}
+		return Frame{}, err
+	}
+
+	size := binary.BigEndian.Uint32(header[8:12])
+	if size > maxFrameSize {
+		return Frame{}, fmt.Errorf("frame of %d bytes exceeds limit, file is probably corrupt", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.buf, data); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Frame{}, io.EOF
+		}
+		return Frame{}, err
+	}
+
+	receivedAt := time.Unix(0, int64(binary.BigEndian.Uint64(header[0:8])))
+	return Frame{ReceivedAt: receivedAt, Data: data}, nil
+}
+
+// Close closes the underlying file.
+func (r *Reader) Close() error {
+	r.gz.Close()
+	return r.file.Close()
+}
+
+// Files expands paths into the capture files to read, in time order.
+// Directories contribute every capture file they contain.
+func Files(paths []string) ([]string, error) {
+	var files []string
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.IsDir() && strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, fileSuffix) {
+				files = append(files, filepath.Join(path, name))
+			}
+		}
+	}
+
+	// The hour in the name sorts lexically.
+	sort.SliceStable(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	return files, nil
+}
@@ -0,0 +1,133 @@
+package capture
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readAll(t *testing.T, path string) []Frame {
+	t.Helper()
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer r.Close()
+
+	var frames []Frame
+	for {
+		frame, err := r.Next()
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestRoundTripAndHourlyRotation(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := time.Date(2024, 3, 1, 14, 59, 59, 123456789, time.UTC)
+	second := first.Add(2 * time.Second)
+
+	frames := []Frame{
+		{ReceivedAt: first, Data: []byte(`[{"T":"success","msg":"connected"}]`)},
+		{ReceivedAt: first.Add(time.Millisecond), Data: []byte(`[{"T":"t","S":"AAPL","p":170.1}]`)},
+		{ReceivedAt: second, Data: []byte(`[{"T":"t","S":"MSFT","p":410.5}]`)},
+	}
+	for _, f := range frames {
+		if err := w.Write(f.ReceivedAt, f.Data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	firstFile := filepath.Join(dir, "frames-20240301T14.cap.gz")
+	secondFile := filepath.Join(dir, "frames-20240301T15.cap.gz")
+
+	got := readAll(t, firstFile)
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 frames in the first hour, got %d", len(got))
+	}
+	for i := range got {
+		if !got[i].ReceivedAt.Equal(frames[i].ReceivedAt) || string(got[i].Data) != string(frames[i].Data) {
+			t.Errorf("Frame %d mismatch: got %v %s", i, got[i].ReceivedAt, got[i].Data)
+		}
+	}
+
+	got = readAll(t, secondFile)
+	if len(got) != 1 || string(got[0].Data) != string(frames[2].Data) {
+		t.Fatalf("Expected the last frame in the second hour, got %v", got)
+	}
+}
+
+func TestAppendAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	at := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		w, err := NewWriter(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(at.Add(time.Duration(i)*time.Minute), []byte("frame")); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+	}
+
+	if got := readAll(t, filepath.Join(dir, FileName(at))); len(got) != 2 {
+		t.Fatalf("Expected frames from both runs, got %d", len(got))
+	}
+}
+
+func TestTruncatedFileEndsCleanly(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	w.Write(at, []byte("complete frame"))
+	w.Write(at, []byte("this frame will be cut short"))
+	w.Close()
+
+	path := filepath.Join(dir, FileName(at))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)-12], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if frame, err := r.Next(); err != nil || string(frame.Data) != "complete frame" {
+		t.Fatalf("Expected the complete frame, got %q, %v", frame.Data, err)
+	}
+	for {
+		if _, err := r.Next(); err != nil {
+			if err != io.EOF {
+				t.Fatalf("Expected io.EOF for a truncated file, got %v", err)
+			}
+			break
+		}
+	}
+}
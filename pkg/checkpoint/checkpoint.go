@@ -0,0 +1,179 @@
+package checkpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go-alpaca-streaming/pkg/metrics"
+	"go-alpaca-streaming/pkg/utils"
+)
+
+// Entry is the last trade of a symbol the sink acknowledged.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	ID       int       `json:"id"`
+	Exchange string    `json:"exchange"`
+	Tape     string    `json:"tape"`
+}
+
+// Raw returns the entry as a raw trade of symbol, carrying just the fields
+// that identify it.
+func (e Entry) Raw(symbol string) utils.RawTrade {
+	return utils.RawTrade{Type: "t", I: e.ID, Symbol: symbol, X: e.Exchange, Z: e.Tape}
+}
+
+// file is the content of the checkpoint file.
+type file struct {
+	Updated time.Time        `json:"updated"`
+	Symbols map[string]Entry `json:"symbols"`
+}
+
+var (
+	flushesTotal = metrics.Counter("checkpoint_flushes_total")
+	flushErrors  = metrics.Counter("checkpoint_flush_errors_total")
+)
+
+// Store keeps each symbol's checkpoint in memory and writes them to a
+// small JSON file periodically and on Close.
+type Store struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	entries map[string]Entry
+	dirty   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open loads the checkpoints at path, if the file exists. interval is how
+// often Start flushes them; 5s when not positive.
+func Open(path string, interval time.Duration) (*Store, error) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	s := &Store{path: path, interval: interval, entries: make(map[string]Entry)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for symbol, e := range f.Symbols {
+		s.entries[symbol] = e
+	}
+	return s, nil
+}
+
+// Record notes that the sink acknowledged a trade. A trade older than the
+// symbol's checkpoint, such as a late print, or without a time leaves it
+// alone.
+func (s *Store) Record(symbol string, e Entry) {
+	if e.Time.IsZero() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cur, ok := s.entries[symbol]; ok && !e.Time.After(cur.Time) {
+		return
+	}
+	s.entries[symbol] = e
+	s.dirty = true
+}
+
+// Entries returns a copy of every symbol's checkpoint.
+func (s *Store) Entries() map[string]Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[string]Entry, len(s.entries))
+	for symbol, e := range s.entries {
+		out[symbol] = e
+	}
+	return out
+}
+
+// Flush writes the checkpoints if they changed since the last flush. The
+// file is replaced atomically, so a crash leaves the previous one intact.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(file{Updated: time.Now().UTC(), Symbols: s.entries}, "", "  ")
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	err = os.MkdirAll(filepath.Dir(s.path), 0o755)
+	if err == nil {
+		err = os.WriteFile(tmp, data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		flushErrors.Add(1)
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return fmt.Errorf("writing checkpoint: %v", err)
+	}
+	flushesTotal.Add(1)
+	return nil
+}
+
+// Start flushes every interval until Close is called or ctx is done.
+func (s *Store) Start(ctx context.Context) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if err := s.Flush(); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the periodic flush and flushes a last time.
+func (s *Store) Close() {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+	if err := s.Flush(); err != nil {
+		log.Println(err)
+	}
+}
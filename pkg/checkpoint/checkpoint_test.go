@@ -0,0 +1,55 @@
+package checkpoint
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordKeepsNewest(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "checkpoint.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 3, 1, 15, 0, 0, 0, time.UTC)
+
+	s.Record("AAPL", Entry{Time: at, ID: 2})
+	s.Record("AAPL", Entry{Time: at.Add(-time.Second), ID: 1})
+	s.Record("AAPL", Entry{ID: 3})
+	if e := s.Entries()["AAPL"]; e.ID != 2 {
+		t.Errorf("Expected the newest trade to be kept, got %+v", e)
+	}
+}
+
+func TestFlushAndOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	s, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing recorded, nothing written.
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file before anything is recorded, got %v", err)
+	}
+
+	at := time.Date(2024, 3, 1, 15, 0, 0, 123456789, time.UTC)
+	s.Record("MSFT", Entry{Time: at, ID: 7, Exchange: "D", Tape: "C"})
+	s.Close()
+
+	reopened, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := reopened.Entries()["MSFT"]
+	if !e.Time.Equal(at) || e.ID != 7 || e.Exchange != "D" || e.Tape != "C" {
+		t.Errorf("Unexpected entry after reopening: %+v", e)
+	}
+	if raw := e.Raw("MSFT"); raw.Symbol != "MSFT" || raw.I != 7 || raw.X != "D" {
+		t.Errorf("Unexpected raw trade %+v", raw)
+	}
+}
@@ -0,0 +1,237 @@
+package conditions
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"go-alpaca-streaming/pkg/metrics"
+)
+
+// Flag is a named property of a trade derived from its condition codes.
+type Flag uint32
+
+const (
+	OddLot Flag = 1 << iota
+	ExtendedHours
+	IntermarketSweep
+	OutOfSequence
+	DerivativelyPriced
+	AveragePrice
+	CashSale
+	NextDay
+	Contingent
+	QualifiedContingent
+	PriceVariation
+	PriorReferencePrice
+	Cross
+	OpeningPrint
+	ClosingPrint
+	ReopeningPrint
+	OfficialOpen
+	OfficialClose
+	CorrectedClose
+	SoldLast
+)
+
+// flagNames gives each flag the field name it is written under.
+var flagNames = []struct {
+	flag Flag
+	name string
+}{
+	{OddLot, "odd_lot"},
+	{ExtendedHours, "extended_hours"},
+	{IntermarketSweep, "intermarket_sweep"},
+	{OutOfSequence, "out_of_sequence"},
+	{DerivativelyPriced, "derivatively_priced"},
+	{AveragePrice, "average_price"},
+	{CashSale, "cash_sale"},
+	{NextDay, "next_day"},
+	{Contingent, "contingent"},
+	{QualifiedContingent, "qualified_contingent"},
+	{PriceVariation, "price_variation"},
+	{PriorReferencePrice, "prior_reference_price"},
+	{Cross, "cross"},
+	{OpeningPrint, "opening_print"},
+	{ClosingPrint, "closing_print"},
+	{ReopeningPrint, "reopening_print"},
+	{OfficialOpen, "official_open"},
+	{OfficialClose, "official_close"},
+	{CorrectedClose, "corrected_close"},
+	{SoldLast, "sold_last"},
+}
+
+// Names returns the field names of the flags set in f, in a fixed order.
+func (f Flag) Names() []string {
+	var names []string
+	for _, fn := range flagNames {
+		if f&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	return names
+}
+
+// Plan is the set of condition codes a tape uses.
+type Plan string
+
+const (
+	// CTA covers tapes A (NYSE) and B (NYSE Arca, Cboe and other regionals).
+	CTA Plan = "CTA"
+	// UTP covers tape C (Nasdaq).
+	UTP Plan = "UTP"
+)
+
+// PlanForTape returns the plan whose condition codes a tape uses. Unknown
+// tapes are treated as CTA.
+func PlanForTape(tape string) Plan {
+	if tape == "C" {
+		return UTP
+	}
+	return CTA
+}
+
+// condition describes one code: the flags it sets and whether a trade
+// carrying it may update the consolidated last price, high/low and volume.
+type condition struct {
+	flags                 Flag
+	last, highLow, volume bool
+}
+
+func c(flags Flag, last, highLow, volume bool) condition {
+	return condition{flags: flags, last: last, highLow: highLow, volume: volume}
+}
+
+// Tables follow the "Trade Through Exempt / Update" matrices published by
+// the CTA and UTP plans. A trade is only eligible for an update if every one
+// of its conditions is.
+var tables = map[Plan]map[string]condition{
+	CTA: {
+		"@": c(0, true, true, true),
+		" ": c(0, true, true, true),
+		"B": c(AveragePrice, false, false, true),
+		"C": c(CashSale, false, false, true),
+		"E": c(0, true, true, true), // automatic execution
+		"F": c(IntermarketSweep, true, true, true),
+		"H": c(PriceVariation, false, false, true),
+		"I": c(OddLot, false, false, true),
+		"K": c(0, true, true, true), // rule 127 / rule 155
+		"L": c(SoldLast, true, true, true),
+		"M": c(OfficialClose, false, false, false),
+		"N": c(NextDay, false, false, true),
+		"O": c(OpeningPrint, true, true, true),
+		"P": c(PriorReferencePrice, false, true, true),
+		"Q": c(OfficialOpen, false, false, false),
+		"R": c(0, false, false, true), // seller
+		"T": c(ExtendedHours, false, false, true),
+		"U": c(ExtendedHours|OutOfSequence, false, false, true),
+		"V": c(Contingent, false, false, true),
+		"X": c(Cross, true, true, true),
+		"Z": c(OutOfSequence, false, true, true),
+		"4": c(DerivativelyPriced, false, true, true),
+		"5": c(ReopeningPrint, true, true, true),
+		"6": c(ClosingPrint, true, true, true),
+		"7": c(QualifiedContingent, false, false, true),
+		"9": c(CorrectedClose, true, true, false),
+	},
+	UTP: {
+		"@": c(0, true, true, true),
+		" ": c(0, true, true, true),
+		"A": c(0, true, true, true), // acquisition
+		"B": c(0, true, true, true), // bunched trade
+		"C": c(CashSale, false, false, true),
+		"D": c(0, true, true, true), // distribution
+		"F": c(IntermarketSweep, true, true, true),
+		"G": c(OutOfSequence, false, true, true), // bunched sold trade
+		"H": c(PriceVariation, false, false, true),
+		"I": c(OddLot, false, false, true),
+		"K": c(0, true, true, true), // rule 155
+		"L": c(SoldLast, true, true, true),
+		"M": c(OfficialClose, false, false, false),
+		"N": c(NextDay, false, false, true),
+		"O": c(OpeningPrint, true, true, true),
+		"P": c(PriorReferencePrice, false, true, true),
+		"Q": c(OfficialOpen, false, false, false),
+		"R": c(0, false, false, true), // seller
+		"S": c(0, true, true, true),   // split trade
+		"T": c(ExtendedHours, false, false, true),
+		"U": c(ExtendedHours|OutOfSequence, false, false, true),
+		"V": c(Contingent, false, false, true),
+		"W": c(AveragePrice, false, false, true),
+		"X": c(Cross, true, true, true),
+		"Y": c(0, true, true, true), // yellow flag
+		"Z": c(OutOfSequence, false, true, true),
+		"1": c(0, true, true, true), // stopped stock
+		"4": c(DerivativelyPriced, false, true, true),
+		"5": c(ReopeningPrint, true, true, true),
+		"6": c(ClosingPrint, true, true, true),
+		"7": c(QualifiedContingent, false, false, true),
+		"8": c(0, true, true, true), // 611 exempt placeholder
+		"9": c(CorrectedClose, true, true, false),
+	},
+}
+
+var unknownCodes = metrics.CounterMap("conditions_unknown_codes")
+
+// Result is what a trade's conditions say about it.
+type Result struct {
+	Flags Flag
+	// UpdatesLast is true if the trade may set the last price.
+	UpdatesLast bool
+	// UpdatesHighLow is true if the trade may set the high or low.
+	UpdatesHighLow bool
+	// UpdatesVolume is true if the trade counts toward volume.
+	UpdatesVolume bool
+	// Unknown lists codes missing from the plan's table, sorted.
+	Unknown []string
+}
+
+// Has reports whether all of flags are set.
+func (r Result) Has(flags Flag) bool {
+	return r.Flags&flags == flags
+}
+
+// Decode expands the condition codes of a trade printed on tape. A trade
+// without conditions is a regular sale. Unknown codes neither set flags nor
+// make the trade ineligible; they are counted under conditions_unknown_codes.
+func Decode(tape string, codes []string) Result {
+	plan := PlanForTape(tape)
+	table := tables[plan]
+
+	r := Result{UpdatesLast: true, UpdatesHighLow: true, UpdatesVolume: true}
+	for _, code := range codes {
+		if code == "" {
+			continue
+		}
+		cond, ok := table[code]
+		if !ok {
+			unknownCodes.Add(string(plan)+":"+code, 1)
+			r.Unknown = append(r.Unknown, code)
+			continue
+		}
+		r.Flags |= cond.flags
+		r.UpdatesLast = r.UpdatesLast && cond.last
+		r.UpdatesHighLow = r.UpdatesHighLow && cond.highLow
+		r.UpdatesVolume = r.UpdatesVolume && cond.volume
+	}
+	sort.Strings(r.Unknown)
+	return r
+}
+
+// Fields formats the result as line protocol fields: the three eligibility
+// flags always, and each named flag only when it is set.
+func (r Result) Fields() string {
+	var b strings.Builder
+	b.WriteString("updates_last=")
+	b.WriteString(strconv.FormatBool(r.UpdatesLast))
+	b.WriteString(",updates_high_low=")
+	b.WriteString(strconv.FormatBool(r.UpdatesHighLow))
+	b.WriteString(",updates_volume=")
+	b.WriteString(strconv.FormatBool(r.UpdatesVolume))
+	for _, name := range r.Flags.Names() {
+		b.WriteString(",")
+		b.WriteString(name)
+		b.WriteString("=true")
+	}
+	return b.String()
+}
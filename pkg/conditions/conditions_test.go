@@ -0,0 +1,58 @@
+package conditions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name                  string
+		tape                  string
+		codes                 []string
+		flags                 Flag
+		last, highLow, volume bool
+	}{
+		{"no conditions", "A", nil, 0, true, true, true},
+		{"regular sale", "C", []string{"@"}, 0, true, true, true},
+		{"odd lot sweep", "C", []string{"@", "F", "I"}, IntermarketSweep | OddLot, false, false, true},
+		{"form T", "A", []string{"@", "T"}, ExtendedHours, false, false, true},
+		{"out of sequence", "B", []string{"Z"}, OutOfSequence, false, true, true},
+		{"derivatively priced", "A", []string{"4"}, DerivativelyPriced, false, true, true},
+		{"official close", "C", []string{"M"}, OfficialClose, false, false, false},
+		// W is average price on UTP but unknown on CTA.
+		{"utp average price", "C", []string{"W"}, AveragePrice, false, false, true},
+		{"cta average price", "A", []string{"B"}, AveragePrice, false, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Decode(tt.tape, tt.codes)
+			if r.Flags != tt.flags {
+				t.Errorf("flags = %v, want %v", r.Flags.Names(), tt.flags.Names())
+			}
+			if r.UpdatesLast != tt.last || r.UpdatesHighLow != tt.highLow || r.UpdatesVolume != tt.volume {
+				t.Errorf("eligibility = %v/%v/%v, want %v/%v/%v",
+					r.UpdatesLast, r.UpdatesHighLow, r.UpdatesVolume, tt.last, tt.highLow, tt.volume)
+			}
+		})
+	}
+}
+
+func TestDecodeUnknownCode(t *testing.T) {
+	r := Decode("A", []string{"@", "W"})
+	if !reflect.DeepEqual(r.Unknown, []string{"W"}) {
+		t.Fatalf("Unknown = %v, want [W]", r.Unknown)
+	}
+	if !r.UpdatesLast || !r.UpdatesHighLow || !r.UpdatesVolume {
+		t.Fatalf("an unknown code must not make a trade ineligible: %+v", r)
+	}
+}
+
+func TestFields(t *testing.T) {
+	got := Decode("C", []string{"F", "I"}).Fields()
+	want := "updates_last=false,updates_high_low=false,updates_volume=true,odd_lot=true,intermarket_sweep=true"
+	if got != want {
+		t.Fatalf("Fields() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,782 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"go-alpaca-streaming/pkg/calendar"
+	author_symbols "go-alpaca-streaming/pkg/symbols"
+)
+
+// Every setting has a YAML key, an environment variable and a command-line
+// flag. The flag name is the dotted YAML path, e.g. -batch.max_size.
+// Precedence, lowest first: defaults, config file, environment, flags.
+// Fields tagged secret:"true" are redacted by Redacted.
+
+type Alpaca struct {
+	KeyID     string `yaml:"key_id" env:"APCA_API_KEY_ID" help:"Alpaca API key id"`
+	SecretKey string `yaml:"secret_key" env:"APCA_API_SECRET_KEY" secret:"true" help:"Alpaca API secret key"`
+	StreamURL string `yaml:"stream_url" env:"APCA_STREAM_URL" help:"market data stream endpoint"`
+}
+
+type Symbols struct {
+	List             []string      `yaml:"list" env:"SYMBOLS" help:"comma-separated symbols for the static source"`
+	Sources          []string      `yaml:"sources" env:"SYMBOL_SOURCES" help:"symbol sources tried in order: static, env, author, parquet, csv"`
+	EnvVar           string        `yaml:"env_var" env:"SYMBOLS_ENV_VAR" help:"environment variable read by the env source"`
+	AuthorURL        string        `yaml:"author_url" env:"AUTHOR_SYMBOLS_URL" help:"author symbols dataset endpoint"`
+	AuthorToken      string        `yaml:"author_token" env:"AUTHOR_SYMBOLS_TOKEN" secret:"true" help:"bearer token for the author symbols endpoint"`
+	AuthorTimeout    time.Duration `yaml:"author_timeout" env:"AUTHOR_SYMBOLS_TIMEOUT" help:"timeout of each author symbols request"`
+	AuthorRetries    int           `yaml:"author_retries" env:"AUTHOR_SYMBOLS_RETRIES" help:"retries of a failed author symbols request"`
+	AuthorMaxSymbols int           `yaml:"author_max_symbols" env:"AUTHOR_SYMBOLS_MAX" help:"most symbols used from the author symbols endpoint"`
+	AuthorMaxInvalid float64       `yaml:"author_max_invalid_share" env:"AUTHOR_SYMBOLS_MAX_INVALID_SHARE" help:"largest share of malformed entries accepted from the author symbols endpoint"`
+	AuthorInsecure   bool          `yaml:"author_insecure_skip_verify" env:"AUTHOR_SYMBOLS_INSECURE_SKIP_VERIFY" help:"skip TLS certificate verification for the author symbols endpoint"`
+	CacheFile        string        `yaml:"cache_file" env:"SYMBOLS_CACHE_FILE" help:"file keeping the last list from the author endpoint, empty to disable"`
+	CacheMaxAge      time.Duration `yaml:"cache_max_age" env:"SYMBOLS_CACHE_MAX_AGE" help:"oldest cached list used when the author endpoint fails"`
+	LocalPath        string        `yaml:"local_path" env:"LOCAL_SYMBOLS_PATH" help:"parquet file of symbols"`
+	CSVPath          string        `yaml:"csv_path" env:"CSV_SYMBOLS_PATH" help:"CSV file of symbols"`
+	MaxLocal         int           `yaml:"max_local" env:"MAX_LOCAL_SYMBOLS" help:"most symbols read from a file"`
+}
+
+// SymbolSources holds the settings of the symbol sources.
+func (s Symbols) SymbolSources() author_symbols.Sources {
+	return author_symbols.Sources{
+		Static: s.List,
+		EnvVar: s.EnvVar,
+		Author: author_symbols.HTTP{
+			URL:                s.AuthorURL,
+			Token:              s.AuthorToken,
+			Timeout:            s.AuthorTimeout,
+			Retries:            s.AuthorRetries,
+			MaxSymbols:         s.AuthorMaxSymbols,
+			MaxInvalidShare:    s.AuthorMaxInvalid,
+			InsecureSkipVerify: s.AuthorInsecure,
+		},
+		CachePath:   s.CacheFile,
+		CacheMaxAge: s.CacheMaxAge,
+		ParquetPath: s.LocalPath,
+		CSVPath:     s.CSVPath,
+		MaxLocal:    s.MaxLocal,
+	}
+}
+
+type Assets struct {
+	Enabled   bool          `yaml:"enabled" env:"ASSETS_ENABLED" help:"leave out symbols that aren't active, tradable Alpaca assets"`
+	URL       string        `yaml:"url" env:"ASSETS_URL" help:"trading API base URL serving /v2/assets"`
+	CacheFile string        `yaml:"cache_file" env:"ASSETS_CACHE_FILE" help:"file keeping the last assets list"`
+	MaxAge    time.Duration `yaml:"max_age" env:"ASSETS_MAX_AGE" help:"how long the cached assets list is used before fetching it again"`
+	Exchanges []string      `yaml:"exchanges" env:"ASSETS_EXCHANGES" help:"comma-separated exchanges accepted, all when empty"`
+}
+
+type Telegraf struct {
+	Host           string        `yaml:"host" env:"TELEGRAF_HOST" help:"Telegraf socket listener host"`
+	Port           string        `yaml:"port" env:"TELEGRAF_PORT" help:"Telegraf socket listener port"`
+	MaxRetries     int           `yaml:"max_retries" env:"TELEGRAF_MAX_RETRIES" help:"connect and write attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" env:"TELEGRAF_INITIAL_BACKOFF" help:"first retry delay, doubled each attempt"`
+}
+
+type Batch struct {
+	MaxSize       int           `yaml:"max_size" env:"BATCH_MAX_SIZE" help:"largest batch sent in one write"`
+	MaxLinger     time.Duration `yaml:"max_linger" env:"BATCH_MAX_LINGER" help:"longest a trade waits in a partial batch"`
+	Adaptive      bool          `yaml:"adaptive" env:"BATCH_ADAPTIVE" help:"size batches from throughput and sink latency"`
+	MinSize       int           `yaml:"min_size" env:"BATCH_MIN_SIZE" help:"smallest batch adaptive mode will choose"`
+	TargetLatency time.Duration `yaml:"target_latency" env:"BATCH_TARGET_LATENCY" help:"sink latency above which adaptive mode grows batches"`
+}
+
+type Workers struct {
+	Count     int `yaml:"count" env:"WORKER_COUNT" help:"number of workers writing to the sink"`
+	QueueSize int `yaml:"queue_size" env:"WORKER_QUEUE_SIZE" help:"trades buffered in front of each worker"`
+}
+
+type Backpressure struct {
+	Policy   string `yaml:"policy" env:"BACKPRESSURE_POLICY" help:"block, drop-oldest, drop-newest or spill-to-disk"`
+	SpillDir string `yaml:"spill_dir" env:"BACKPRESSURE_SPILL_DIR" help:"directory for spill-to-disk files"`
+}
+
+type Enrich struct {
+	Exchanges bool `yaml:"exchanges" env:"ENRICH_EXCHANGES" help:"tag trades with exchange name, MIC, off-exchange flag and tape name"`
+}
+
+type Points struct {
+	Identity string `yaml:"identity" env:"POINT_IDENTITY" help:"how trades sharing a timestamp are kept apart: sequence, nudge or none"`
+}
+
+type Bars struct {
+	Intervals       []string      `yaml:"intervals" env:"BAR_INTERVALS" help:"comma-separated bar intervals, e.g. 1s,5s,15s; no bars when empty"`
+	AllowedLateness time.Duration `yaml:"allowed_lateness" env:"BAR_ALLOWED_LATENESS" help:"how long emitted bars still accept late trades and corrections"`
+}
+
+// Durations parses the configured intervals.
+func (b Bars) Durations() ([]time.Duration, error) {
+	var out []time.Duration
+	for _, raw := range b.Intervals {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 || (24*time.Hour)%d != 0 {
+			return nil, fmt.Errorf("interval %s must be positive and divide a day evenly", raw)
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+type Stats struct {
+	Windows      []string      `yaml:"windows" env:"STATS_WINDOWS" help:"comma-separated rolling statistics windows, e.g. 1m,5m,30m; no stats when empty"`
+	EmitInterval time.Duration `yaml:"emit_interval" env:"STATS_EMIT_INTERVAL" help:"how often rolling statistics are written"`
+}
+
+// Durations parses the configured windows.
+func (s Stats) Durations() ([]time.Duration, error) {
+	var out []time.Duration
+	for _, raw := range s.Windows {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Second || d%time.Second != 0 {
+			return nil, fmt.Errorf("window %s must be a whole number of seconds", raw)
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+type Filter struct {
+	MinSize           int      `yaml:"min_size" env:"FILTER_MIN_SIZE" help:"drop trades smaller than this many shares"`
+	ExcludeConditions []string `yaml:"exclude_conditions" env:"FILTER_EXCLUDE_CONDITIONS" help:"comma-separated condition codes to drop, e.g. I for odd lots"`
+	ExcludeExchanges  []string `yaml:"exclude_exchanges" env:"FILTER_EXCLUDE_EXCHANGES" help:"comma-separated exchange codes to drop, e.g. D for TRF prints"`
+	MinPrice          float64  `yaml:"min_price" env:"FILTER_MIN_PRICE" help:"drop trades priced below this"`
+	MaxPrice          float64  `yaml:"max_price" env:"FILTER_MAX_PRICE" help:"drop trades priced above this"`
+	AllowSymbols      []string `yaml:"allow_symbols" env:"FILTER_ALLOW_SYMBOLS" help:"comma-separated symbols to keep; all others are dropped"`
+	DenySymbols       []string `yaml:"deny_symbols" env:"FILTER_DENY_SYMBOLS" help:"comma-separated symbols to drop"`
+}
+
+type Outliers struct {
+	Enabled      bool    `yaml:"enabled" env:"OUTLIERS_ENABLED" help:"flag trades priced far from the symbol's recent median"`
+	Window       int     `yaml:"window" env:"OUTLIERS_WINDOW" help:"recent prices per symbol the median is taken over"`
+	MinHistory   int     `yaml:"min_history" env:"OUTLIERS_MIN_HISTORY" help:"prices a symbol needs before anything is flagged"`
+	Threshold    float64 `yaml:"threshold" env:"OUTLIERS_THRESHOLD" help:"robust z-score (deviation in scaled MADs) above which a trade is flagged"`
+	MinDeviation float64 `yaml:"min_deviation" env:"OUTLIERS_MIN_DEVIATION" help:"smallest relative deviation from the median that is flagged"`
+	Route        string  `yaml:"route" env:"OUTLIERS_ROUTE" help:"tag (outlier=true on the trade) or measurement (separate measurement)"`
+}
+
+type Health struct {
+	Enabled            bool          `yaml:"enabled" env:"HEALTH_ENABLED" help:"warn when active symbols or the whole feed go quiet during regular hours"`
+	SymbolThreshold    time.Duration `yaml:"symbol_threshold" env:"HEALTH_SYMBOL_THRESHOLD" help:"silence after which a normally active symbol is reported stale"`
+	FeedThreshold      time.Duration `yaml:"feed_threshold" env:"HEALTH_FEED_THRESHOLD" help:"silence after which the whole feed is reported silent"`
+	MinTradesPerMinute float64       `yaml:"min_trades_per_minute" env:"HEALTH_MIN_TRADES_PER_MINUTE" help:"usual trade rate at which a symbol counts as normally active"`
+	CheckInterval      time.Duration `yaml:"check_interval" env:"HEALTH_CHECK_INTERVAL" help:"how often silence is checked"`
+}
+
+type Calendar struct {
+	File string `yaml:"file" env:"CALENDAR_FILE" help:"YAML file with extra holidays and early closes"`
+}
+
+type Schedule struct {
+	Enabled bool          `yaml:"enabled" env:"SCHEDULE_ENABLED" help:"connect only around trading days instead of around the clock"`
+	Lead    time.Duration `yaml:"lead" env:"SCHEDULE_LEAD" help:"how long before pre-market to connect"`
+	Linger  time.Duration `yaml:"linger" env:"SCHEDULE_LINGER" help:"how long after post-market to stay connected"`
+}
+
+type Backfill struct {
+	Enabled           bool          `yaml:"enabled" env:"BACKFILL_ENABLED" help:"fill the gap left by each reconnect from the historical trades API"`
+	URL               string        `yaml:"url" env:"BACKFILL_URL" help:"market data REST API base URL"`
+	Feed              string        `yaml:"feed" env:"BACKFILL_FEED" help:"historical data feed, sip or iex"`
+	PageLimit         int           `yaml:"page_limit" env:"BACKFILL_PAGE_LIMIT" help:"trades requested per page, at most 10000"`
+	RequestsPerMinute int           `yaml:"requests_per_minute" env:"BACKFILL_REQUESTS_PER_MINUTE" help:"most REST requests sent per minute"`
+	StateFile         string        `yaml:"state_file" env:"BACKFILL_STATE_FILE" help:"file recording backfill progress so it resumes after a restart"`
+	MaxWindow         time.Duration `yaml:"max_window" env:"BACKFILL_MAX_WINDOW" help:"longest gap filled automatically; older trades are left out"`
+}
+
+type Dedup struct {
+	Enabled    bool          `yaml:"enabled" env:"DEDUP_ENABLED" help:"drop trades already seen, e.g. live and again from a backfill"`
+	Window     time.Duration `yaml:"window" env:"DEDUP_WINDOW" help:"how far behind the newest trade, in trade time, trades are remembered"`
+	MaxEntries int           `yaml:"max_entries" env:"DEDUP_MAX_ENTRIES" help:"most trades remembered"`
+}
+
+type Checkpoint struct {
+	File          string        `yaml:"file" env:"CHECKPOINT_FILE" help:"file recording the last trade written per symbol, empty to disable"`
+	FlushInterval time.Duration `yaml:"flush_interval" env:"CHECKPOINT_FLUSH_INTERVAL" help:"how often checkpoints are written to the file"`
+}
+
+type Reconnect struct {
+	MaxAttempts    int           `yaml:"max_attempts" env:"RECONNECT_MAX_ATTEMPTS" help:"consecutive failures before giving up, 0 for never"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" env:"RECONNECT_INITIAL_BACKOFF" help:"first reconnect delay"`
+	MaxBackoff     time.Duration `yaml:"max_backoff" env:"RECONNECT_MAX_BACKOFF" help:"longest reconnect delay"`
+}
+
+type Capture struct {
+	Dir string `yaml:"dir" env:"CAPTURE_DIR" help:"record raw frames to this directory"`
+}
+
+type Metrics struct {
+	Addr string `yaml:"addr" env:"METRICS_ADDR" help:"serve /debug/vars on this address"`
+}
+
+type Sentry struct {
+	DSN string `yaml:"dsn" env:"GO_ALPACA_STREAMING_SENTRY_DSN" secret:"true" help:"Sentry/GlitchTip DSN"`
+}
+
+// StateDir holds the files the client keeps between runs by default. In
+// the container it is the mounted /data volume, so they survive a restart.
+const StateDir = "/data"
+
+// Config is the complete application configuration.
+type Config struct {
+	Alpaca       Alpaca       `yaml:"alpaca"`
+	Symbols      Symbols      `yaml:"symbols"`
+	Assets       Assets       `yaml:"assets"`
+	Telegraf     Telegraf     `yaml:"telegraf"`
+	Batch        Batch        `yaml:"batch"`
+	Workers      Workers      `yaml:"workers"`
+	Backpressure Backpressure `yaml:"backpressure"`
+	Enrich       Enrich       `yaml:"enrich"`
+	Points       Points       `yaml:"points"`
+	Bars         Bars         `yaml:"bars"`
+	Stats        Stats        `yaml:"stats"`
+	Filter       Filter       `yaml:"filter"`
+	Outliers     Outliers     `yaml:"outliers"`
+	Health       Health       `yaml:"health"`
+	Calendar     Calendar     `yaml:"calendar"`
+	Schedule     Schedule     `yaml:"schedule"`
+	Backfill     Backfill     `yaml:"backfill"`
+	Dedup        Dedup        `yaml:"dedup"`
+	Checkpoint   Checkpoint   `yaml:"checkpoint"`
+	Reconnect    Reconnect    `yaml:"reconnect"`
+	Capture      Capture      `yaml:"capture"`
+	Metrics      Metrics      `yaml:"metrics"`
+	Sentry       Sentry       `yaml:"sentry"`
+}
+
+// FileEnv names the environment variable that points at a config file when
+// -config is not given.
+const FileEnv = "ALPACA_STREAMING_CONFIG"
+
+// Default returns the built-in settings.
+func Default() *Config {
+	return &Config{
+		Alpaca: Alpaca{
+			StreamURL: "wss://stream.data.alpaca.markets/v2/sip",
+		},
+		Symbols: Symbols{
+			Sources:          []string{"static", "author", "parquet"},
+			EnvVar:           "STREAM_SYMBOLS",
+			AuthorURL:        author_symbols.DefaultAuthorURL,
+			AuthorTimeout:    author_symbols.DefaultTimeout,
+			AuthorRetries:    author_symbols.DefaultRetries,
+			AuthorMaxSymbols: author_symbols.DefaultMaxSymbols,
+			AuthorMaxInvalid: author_symbols.DefaultMaxInvalidShare,
+			CacheFile:        filepath.Join(StateDir, "alpaca-symbols.json"),
+			CacheMaxAge:      7 * 24 * time.Hour,
+			LocalPath:        author_symbols.DefaultLocalPath,
+			MaxLocal:         author_symbols.DefaultMaxLocal,
+		},
+		Assets: Assets{
+			URL:       "https://api.alpaca.markets",
+			CacheFile: filepath.Join(StateDir, "alpaca-assets.json"),
+			MaxAge:    24 * time.Hour,
+		},
+		Telegraf: Telegraf{
+			Host:           "telegraf",
+			Port:           "8094",
+			MaxRetries:     5,
+			InitialBackoff: 100 * time.Millisecond,
+		},
+		Batch: Batch{
+			MaxSize:       100,
+			MaxLinger:     time.Second,
+			MinSize:       10,
+			TargetLatency: 50 * time.Millisecond,
+		},
+		Workers: Workers{
+			Count:     10,
+			QueueSize: 1000,
+		},
+		Backpressure: Backpressure{
+			Policy:   policyBlock,
+			SpillDir: filepath.Join(StateDir, "alpaca-spill"),
+		},
+		Points: Points{
+			Identity: identitySequence,
+		},
+		Bars: Bars{
+			AllowedLateness: 2 * time.Second,
+		},
+		Stats: Stats{
+			EmitInterval: 10 * time.Second,
+		},
+		Outliers: Outliers{
+			Window:       50,
+			MinHistory:   20,
+			Threshold:    10,
+			MinDeviation: 0.005,
+			Route:        routeTag,
+		},
+		Health: Health{
+			SymbolThreshold:    5 * time.Minute,
+			FeedThreshold:      30 * time.Second,
+			MinTradesPerMinute: 1,
+			CheckInterval:      10 * time.Second,
+		},
+		Schedule: Schedule{
+			Lead:   5 * time.Minute,
+			Linger: 5 * time.Minute,
+		},
+		Backfill: Backfill{
+			URL:               "https://data.alpaca.markets",
+			Feed:              "sip",
+			PageLimit:         10000,
+			RequestsPerMinute: 200,
+			StateFile:         filepath.Join(StateDir, "alpaca-backfill.json"),
+			MaxWindow:         24 * time.Hour,
+		},
+		Dedup: Dedup{
+			Enabled:    true,
+			Window:     10 * time.Minute,
+			MaxEntries: 500000,
+		},
+		Checkpoint: Checkpoint{
+			File:          filepath.Join(StateDir, "alpaca-checkpoint.json"),
+			FlushInterval: 5 * time.Second,
+		},
+		Reconnect: Reconnect{
+			InitialBackoff: time.Second,
+			MaxBackoff:     time.Minute,
+		},
+	}
+}
+
+// Loader registers the configuration flags on a FlagSet and builds the
+// effective configuration once the flags have been parsed.
+type Loader struct {
+	file  *string
+	flags map[string]*flagValue
+}
+
+// NewLoader adds -config and one flag per setting to fs.
+func NewLoader(fs *flag.FlagSet) *Loader {
+	l := &Loader{
+		file:  fs.String("config", "", "YAML config file (default $"+FileEnv+")"),
+		flags: make(map[string]*flagValue),
+	}
+
+	defaults := Default()
+	for _, f := range fields(defaults) {
+		v := &flagValue{isBool: f.value.Kind() == reflect.Bool}
+		l.flags[f.path] = v
+		usage := f.help
+		if f.env != "" {
+			usage += " ($" + f.env + ")"
+		}
+		fs.Var(v, f.path, usage)
+	}
+
+	return l
+}
+
+// Load builds the configuration. Call it after fs.Parse.
+func (l *Loader) Load() (*Config, error) {
+	cfg := Default()
+
+	path := *l.file
+	if path == "" {
+		path = os.Getenv(FileEnv)
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range fields(cfg) {
+		if f.env == "" {
+			continue
+		}
+		if raw, ok := os.LookupEnv(f.env); ok && raw != "" {
+			if err := setField(f.value, raw); err != nil {
+				return nil, fmt.Errorf("environment variable %s: %w", f.env, err)
+			}
+		}
+	}
+
+	for _, f := range fields(cfg) {
+		if v := l.flags[f.path]; v != nil && v.set {
+			if err := setField(f.value, v.raw); err != nil {
+				return nil, fmt.Errorf("flag -%s: %w", f.path, err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// The values of the enum settings. The packages that use them parse the
+// same strings; these only let Validate check them.
+const (
+	policyBlock       = "block"
+	policyDropOldest  = "drop-oldest"
+	policyDropNewest  = "drop-newest"
+	policySpillToDisk = "spill-to-disk"
+
+	identitySequence = "sequence"
+	identityNudge    = "nudge"
+	identityNone     = "none"
+
+	routeTag         = "tag"
+	routeMeasurement = "measurement"
+)
+
+var (
+	policies   = []string{policyBlock, policyDropOldest, policyDropNewest, policySpillToDisk}
+	identities = []string{identitySequence, identityNudge, identityNone}
+	routes     = []string{routeTag, routeMeasurement}
+)
+
+// enum normalizes an enum setting the way the parsing packages do.
+func enum(s string) string { return strings.ToLower(strings.TrimSpace(s)) }
+
+// oneOf reports whether s is one of values. Empty means the default.
+func oneOf(s string, values []string) bool {
+	if s == "" {
+		return true
+	}
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate reports every invalid setting at once.
+func (cfg *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if u, err := url.Parse(cfg.Alpaca.StreamURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		add("alpaca.stream_url must be a ws:// or wss:// URL, got %q", cfg.Alpaca.StreamURL)
+	}
+	if cfg.Symbols.MaxLocal <= 0 {
+		add("symbols.max_local must be positive")
+	}
+	if u, err := url.Parse(cfg.Symbols.AuthorURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("symbols.author_url must be an http:// or https:// URL, got %q", cfg.Symbols.AuthorURL)
+	}
+	if cfg.Symbols.AuthorTimeout <= 0 || cfg.Symbols.AuthorRetries < 0 || cfg.Symbols.AuthorMaxSymbols <= 0 {
+		add("symbols.author_timeout and symbols.author_max_symbols must be positive, symbols.author_retries not negative")
+	}
+	if cfg.Symbols.AuthorMaxInvalid <= 0 || cfg.Symbols.AuthorMaxInvalid >= 1 {
+		add("symbols.author_max_invalid_share must be between 0 and 1, got %v", cfg.Symbols.AuthorMaxInvalid)
+	}
+	if cfg.Symbols.CacheMaxAge <= 0 {
+		add("symbols.cache_max_age must be positive")
+	}
+	if chain, err := author_symbols.NewChain(cfg.Symbols.Sources, cfg.Symbols.SymbolSources()); err != nil {
+		add("symbols.sources: %v", err)
+	} else if len(chain) == 0 {
+		add("symbols.sources must name at least one source that can be used")
+	}
+	if u, err := url.Parse(cfg.Assets.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("assets.url must be an http:// or https:// URL, got %q", cfg.Assets.URL)
+	}
+	if cfg.Assets.MaxAge <= 0 {
+		add("assets.max_age must be positive")
+	}
+	if cfg.Telegraf.Host == "" {
+		add("telegraf.host must be set")
+	}
+	if port, err := strconv.Atoi(cfg.Telegraf.Port); err != nil || port <= 0 || port > 65535 {
+		add("telegraf.port must be a port number, got %q", cfg.Telegraf.Port)
+	}
+	if cfg.Telegraf.MaxRetries <= 0 {
+		add("telegraf.max_retries must be positive")
+	}
+	if cfg.Batch.MaxSize <= 0 {
+		add("batch.max_size must be positive")
+	}
+	if cfg.Batch.MaxLinger <= 0 {
+		add("batch.max_linger must be positive")
+	}
+	if cfg.Batch.MinSize <= 0 || cfg.Batch.MinSize > cfg.Batch.MaxSize {
+		add("batch.min_size must be between 1 and batch.max_size")
+	}
+	if cfg.Workers.Count <= 0 {
+		add("workers.count must be positive")
+	}
+	if cfg.Workers.QueueSize <= 0 {
+		add("workers.queue_size must be positive")
+	}
+	if policy := enum(cfg.Backpressure.Policy); !oneOf(policy, policies) {
+		add("backpressure.policy must be one of %s, got %q", strings.Join(policies, ", "), cfg.Backpressure.Policy)
+	} else if policy == policySpillToDisk && cfg.Backpressure.SpillDir == "" {
+		add("backpressure.spill_dir must be set for spill-to-disk")
+	}
+	if _, err := cfg.Bars.Durations(); err != nil {
+		add("bars.intervals: %v", err)
+	}
+	if cfg.Bars.AllowedLateness < 0 {
+		add("bars.allowed_lateness must not be negative")
+	}
+	if !oneOf(enum(cfg.Points.Identity), identities) {
+		add("points.identity must be one of %s, got %q", strings.Join(identities, ", "), cfg.Points.Identity)
+	}
+	if _, err := cfg.Stats.Durations(); err != nil {
+		add("stats.windows: %v", err)
+	}
+	if cfg.Stats.EmitInterval <= 0 {
+		add("stats.emit_interval must be positive")
+	}
+	if cfg.Filter.MinSize < 0 {
+		add("filter.min_size must not be negative")
+	}
+	if cfg.Filter.MinPrice < 0 || cfg.Filter.MaxPrice < 0 ||
+		(cfg.Filter.MaxPrice > 0 && cfg.Filter.MinPrice > cfg.Filter.MaxPrice) {
+		add("filter.min_price and filter.max_price must not be negative, and min_price must not exceed max_price")
+	}
+	if cfg.Outliers.Window <= 0 || cfg.Outliers.MinHistory <= 0 || cfg.Outliers.MinHistory > cfg.Outliers.Window {
+		add("outliers.window and outliers.min_history must be positive, with min_history no larger than window")
+	}
+	if cfg.Outliers.Threshold <= 0 || cfg.Outliers.MinDeviation <= 0 {
+		add("outliers.threshold and outliers.min_deviation must be positive")
+	}
+	if !oneOf(enum(cfg.Outliers.Route), routes) {
+		add("outliers.route must be one of %s, got %q", strings.Join(routes, ", "), cfg.Outliers.Route)
+	}
+	if cfg.Health.SymbolThreshold <= 0 || cfg.Health.FeedThreshold <= 0 || cfg.Health.CheckInterval <= 0 {
+		add("health.symbol_threshold, health.feed_threshold and health.check_interval must be positive")
+	}
+	if cfg.Health.MinTradesPerMinute <= 0 {
+		add("health.min_trades_per_minute must be positive")
+	}
+	if cfg.Calendar.File != "" {
+		if _, err := calendar.Load(cfg.Calendar.File); err != nil {
+			add("calendar.file: %v", err)
+		}
+	}
+	if cfg.Schedule.Lead < 0 || cfg.Schedule.Linger < 0 {
+		add("schedule.lead and schedule.linger must not be negative")
+	}
+	if u, err := url.Parse(cfg.Backfill.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("backfill.url must be an http:// or https:// URL, got %q", cfg.Backfill.URL)
+	}
+	if cfg.Backfill.Feed != "sip" && cfg.Backfill.Feed != "iex" {
+		add("backfill.feed must be sip or iex, got %q", cfg.Backfill.Feed)
+	}
+	if cfg.Backfill.PageLimit <= 0 || cfg.Backfill.PageLimit > 10000 {
+		add("backfill.page_limit must be between 1 and 10000")
+	}
+	if cfg.Backfill.RequestsPerMinute <= 0 {
+		add("backfill.requests_per_minute must be positive")
+	}
+	if cfg.Backfill.MaxWindow <= 0 {
+		add("backfill.max_window must be positive")
+	}
+	if cfg.Dedup.Window <= 0 || cfg.Dedup.MaxEntries <= 0 {
+		add("dedup.window and dedup.max_entries must be positive")
+	}
+	if cfg.Checkpoint.FlushInterval <= 0 {
+		add("checkpoint.flush_interval must be positive")
+	}
+	if cfg.Reconnect.MaxAttempts < 0 {
+		add("reconnect.max_attempts must not be negative")
+	}
+	if cfg.Reconnect.InitialBackoff <= 0 || cfg.Reconnect.MaxBackoff < cfg.Reconnect.InitialBackoff {
+		add("reconnect.initial_backoff must be positive and no larger than reconnect.max_backoff")
+	}
+	if cfg.Metrics.Addr != "" {
+		if _, _, err := net.SplitHostPort(cfg.Metrics.Addr); err != nil {
+			add("metrics.addr must be host:port, got %q", cfg.Metrics.Addr)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// RequireCredentials checks the settings only needed to talk to Alpaca.
+func (cfg *Config) RequireCredentials() error {
+	if cfg.Alpaca.KeyID == "" {
+		return errors.New("alpaca.key_id is not set (APCA_API_KEY_ID)")
+	}
+	if cfg.Alpaca.SecretKey == "" {
+		return errors.New("alpaca.secret_key is not set (APCA_API_SECRET_KEY)")
+	}
+	return nil
+}
+
+// Redacted returns a copy with every secret that is set replaced by a marker.
+func (cfg *Config) Redacted() *Config {
+	out := *cfg
+	out.Symbols.List = append([]string(nil), cfg.Symbols.List...)
+	out.Symbols.Sources = append([]string(nil), cfg.Symbols.Sources...)
+	out.Assets.Exchanges = append([]string(nil), cfg.Assets.Exchanges...)
+	out.Bars.Intervals = append([]string(nil), cfg.Bars.Intervals...)
+	out.Stats.Windows = append([]string(nil), cfg.Stats.Windows...)
+	out.Filter.ExcludeConditions = append([]string(nil), cfg.Filter.ExcludeConditions...)
+	out.Filter.ExcludeExchanges = append([]string(nil), cfg.Filter.ExcludeExchanges...)
+	out.Filter.AllowSymbols = append([]string(nil), cfg.Filter.AllowSymbols...)
+	out.Filter.DenySymbols = append([]string(nil), cfg.Filter.DenySymbols...)
+	for _, f := range fields(&out) {
+		if f.secret && f.value.Kind() == reflect.String && f.value.String() != "" {
+			f.value.SetString("<redacted>")
+		}
+	}
+	return &out
+}
+
+// YAML renders the configuration as a config file would be written.
+func (cfg *Config) YAML() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// field describes one leaf setting.
+type field struct {
+	path   string
+	env    string
+	help   string
+	secret bool
+	value  reflect.Value
+}
+
+// fields lists every leaf setting of cfg, addressable for assignment.
+func fields(cfg *Config) []field {
+	var out []field
+
+	root := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Field(i)
+		sectionName := root.Type().Field(i).Tag.Get("yaml")
+
+		for j := 0; j < section.NumField(); j++ {
+			sf := section.Type().Field(j)
+			out = append(out, field{
+				path:   sectionName + "." + sf.Tag.Get("yaml"),
+				env:    sf.Tag.Get("env"),
+				help:   sf.Tag.Get("help"),
+				secret: sf.Tag.Get("secret") == "true",
+				value:  section.Field(j),
+			})
+		}
+	}
+
+	return out
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setField parses raw into v according to v's type.
+func setField(v reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// flagValue remembers a flag's raw value until Load applies it.
+type flagValue struct {
+	raw    string
+	set    bool
+	isBool bool
+}
+
+// IsBoolFlag lets boolean settings be given as a bare -name.
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.raw
+}
+
+func (f *flagValue) Set(s string) error {
+	f.raw = s
+	f.set = true
+	return nil
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go-alpaca-streaming/pkg/backpressure"
+	"go-alpaca-streaming/pkg/outlier"
+	"go-alpaca-streaming/pkg/websocket_conn"
+)
+
+func load(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	loader := NewLoader(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return loader.Load()
+}
+
+func TestPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+batch:
+  max_size: 200
+  max_linger: 5s
+workers:
+  count: 3
+symbols:
+  list: [AAPL, MSFT]
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("BATCH_MAX_SIZE", "300")
+	t.Setenv("WORKER_COUNT", "4")
+
+	cfg, err := load(t, "-config", path, "-workers.count", "5", "-batch.adaptive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Batch.MaxLinger != 5*time.Second {
+		t.Errorf("Expected max_linger from the file, got %v", cfg.Batch.MaxLinger)
+	}
+	if cfg.Batch.MaxSize != 300 {
+		t.Errorf("Expected the environment to beat the file, got %d", cfg.Batch.MaxSize)
+	}
+	if cfg.Workers.Count != 5 {
+		t.Errorf("Expected the flag to beat the environment, got %d", cfg.Workers.Count)
+	}
+	if !cfg.Batch.Adaptive {
+		t.Error("Expected a bare boolean flag to enable the setting")
+	}
+	if strings.Join(cfg.Symbols.List, ",") != "AAPL,MSFT" {
+		t.Errorf("Expected symbols from the file, got %v", cfg.Symbols.List)
+	}
+	if cfg.Telegraf.Port != "8094" {
+		t.Errorf("Expected the default telegraf port, got %q", cfg.Telegraf.Port)
+	}
+}
+
+func TestUnknownFileKeyIsRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("batch:\n  max_sise: 10\n"), 0o644)
+
+	if _, err := load(t, "-config", path); err == nil {
+		t.Fatal("Expected a typo in the config file to be an error")
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := Default()
+	cfg.Batch.MaxSize = 0
+	cfg.Backpressure.Policy = "sometimes"
+	cfg.Telegraf.Port = "http"
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected validation to fail")
+	}
+	for _, key := range []string{"batch.max_size", "backpressure.policy", "telegraf.port"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected %s in %q", key, err)
+		}
+	}
+}
+
+// The enum values are kept here so that config needs none of the packages
+// that use them; they must still be what those packages parse.
+func TestEnumsMatchTheirPackages(t *testing.T) {
+	for _, p := range policies {
+		if got, err := backpressure.ParsePolicy(p); err != nil || string(got) != p {
+			t.Errorf("backpressure.ParsePolicy(%q) = %q, %v", p, got, err)
+		}
+	}
+	for _, id := range identities {
+		if got, err := websocket_conn.ParsePointIdentity(id); err != nil || string(got) != id {
+			t.Errorf("websocket_conn.ParsePointIdentity(%q) = %q, %v", id, got, err)
+		}
+	}
+	for _, r := range routes {
+		if got, err := outlier.ParseRoute(r); err != nil || string(got) != r {
+			t.Errorf("outlier.ParseRoute(%q) = %q, %v", r, got, err)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Default()
+	cfg.Alpaca.KeyID = "AKID"
+	cfg.Alpaca.SecretKey = "super-secret"
+	cfg.Sentry.DSN = "https://key@glitchtip.example/1"
+
+	out, err := cfg.Redacted().YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(out)
+
+	if strings.Contains(text, "super-secret") || strings.Contains(text, "glitchtip.example") {
+		t.Fatalf("Secrets leaked into output:\n%s", text)
+	}
+	if !strings.Contains(text, "AKID") {
+		t.Errorf("Expected the non-secret key id to be shown:\n%s", text)
+	}
+	if cfg.Alpaca.SecretKey != "super-secret" {
+		t.Error("Redacted modified the original configuration")
+	}
+}
@@ -0,0 +1,180 @@
+package dedup
+
+import (
+	"sync"
+	"time"
+
+	"go-alpaca-streaming/pkg/metrics"
+	"go-alpaca-streaming/pkg/utils"
+)
+
+// Key identifies a trade. Trade ids are only unique per symbol, exchange
+// and tape.
+type Key struct {
+	Symbol   string
+	Exchange string
+	ID       int
+	Tape     string
+}
+
+// KeyOf returns the key of a raw trade.
+func KeyOf(raw utils.RawTrade) Key {
+	return Key{Symbol: raw.Symbol, Exchange: raw.X, ID: raw.I, Tape: raw.Z}
+}
+
+// Config bounds the cache.
+type Config struct {
+	// Window is how far behind the newest trade, in trade time, trades are
+	// remembered. Older trades can't be checked and are let through.
+	Window time.Duration
+	// MaxEntries caps the number of trades remembered; the oldest are
+	// forgotten first.
+	MaxEntries int
+}
+
+// DefaultConfig returns the bounds used when nothing is configured.
+func DefaultConfig() Config {
+	return Config{Window: 10 * time.Minute, MaxEntries: 500000}
+}
+
+func (cfg Config) normalize() Config {
+	def := DefaultConfig()
+	if cfg.Window <= 0 {
+		cfg.Window = def.Window
+	}
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = def.MaxEntries
+	}
+	return cfg
+}
+
+var (
+	hitsTotal    = metrics.Counter("dedup_hits_total")
+	evictedTotal = metrics.Counter("dedup_evicted_total")
+	entries      = metrics.Counter("dedup_entries")
+)
+
+type entry struct {
+	key Key
+	at  int64 // trade time, Unix nanoseconds
+}
+
+// Cache remembers recent trades so a trade seen twice, for example once
+// live and once from a backfill, is only written once. It is safe for
+// concurrent use, so the stream and a backfill can share one.
+type Cache struct {
+	cfg Config
+
+	mu     sync.Mutex
+	seen   map[Key]int64
+	order  []entry // insertion order, oldest first, from head
+	head   int
+	newest int64
+}
+
+// New creates an empty cache.
+func New(cfg Config) *Cache {
+	cfg = cfg.normalize()
+	return &Cache{cfg: cfg, seen: make(map[Key]int64)}
+}
+
+// Seen reports whether the trade was already seen and otherwise remembers
+// it, in one step, so of two copies arriving together only one gets
+// through. at is the trade's timestamp. Forget the trade if it is then
+// not written, so a later copy can stand in for it.
+func (c *Cache) Seen(raw utils.RawTrade, at time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.containsLocked(KeyOf(raw)) {
+		return true
+	}
+	c.addLocked(KeyOf(raw), at)
+	return false
+}
+
+// Contains reports whether the trade was already seen, without
+// remembering it.
+func (c *Cache) Contains(raw utils.RawTrade) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.containsLocked(KeyOf(raw))
+}
+
+// Forget releases a trade Seen remembered, such as one whose write failed.
+func (c *Cache) Forget(raw utils.RawTrade) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.seen, KeyOf(raw))
+	entries.Set(int64(len(c.seen)))
+}
+
+// Add remembers a trade.
+func (c *Cache) Add(raw utils.RawTrade, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[KeyOf(raw)]; !ok {
+		c.addLocked(KeyOf(raw), at)
+	}
+}
+
+func (c *Cache) containsLocked(key Key) bool {
+	if _, ok := c.seen[key]; ok {
+		hitsTotal.Add(1)
+		return true
+	}
+	return false
+}
+
+func (c *Cache) addLocked(key Key, at time.Time) {
+	// Without a timestamp a trade can't be expired in order.
+	if at.IsZero() {
+		return
+	}
+	ns := at.UnixNano()
+	if ns > c.newest {
+		c.newest = ns
+	}
+	horizon := c.newest - int64(c.cfg.Window)
+	if ns < horizon {
+		return
+	}
+
+	c.seen[key] = ns
+	c.order = append(c.order, entry{key, ns})
+	c.expireLocked(horizon)
+}
+
+// expireLocked forgets trades older than horizon and, past MaxEntries, the
+// oldest ones. Trades arrive roughly in time order, so the queue is
+// checked from the front only.
+func (c *Cache) expireLocked(horizon int64) {
+	for c.head < len(c.order) {
+		e := c.order[c.head]
+		if e.at >= horizon && len(c.seen) <= c.cfg.MaxEntries {
+			break
+		}
+		if len(c.seen) > c.cfg.MaxEntries && e.at >= horizon {
+			evictedTotal.Add(1)
+		}
+		// A key re-added after expiring has a newer entry further back.
+		if c.seen[e.key] == e.at {
+			delete(c.seen, e.key)
+		}
+		c.head++
+	}
+
+	// Reclaim the consumed front of the queue once it is half the slice.
+	if c.head > len(c.order)/2 {
+		c.order = append(c.order[:0], c.order[c.head:]...)
+		c.head = 0
+	}
+	entries.Set(int64(len(c.seen)))
+}
+
+// Len returns the number of trades remembered.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.seen)
+}
@@ -0,0 +1,84 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+
+	"go-alpaca-streaming/pkg/utils"
+)
+
+var base = time.Date(2024, 3, 1, 15, 0, 0, 0, time.UTC)
+
+func trade(symbol string, id int) utils.RawTrade {
+	return utils.RawTrade{Type: "t", I: id, Symbol: symbol, X: "Q", Z: "C"}
+}
+
+func TestSeenDropsRepeats(t *testing.T) {
+	c := New(Config{Window: time.Minute})
+
+	if c.Seen(trade("AAPL", 1), base) {
+		t.Fatal("First sighting reported as a repeat")
+	}
+	if !c.Seen(trade("AAPL", 1), base) {
+		t.Error("Repeat not detected")
+	}
+
+	// The same id on another symbol, exchange or tape is a different trade.
+	other := trade("AAPL", 1)
+	other.X = "V"
+	if c.Seen(trade("MSFT", 1), base) || c.Seen(other, base) {
+		t.Error("Different trades with the same id reported as repeats")
+	}
+}
+
+func TestOldTradesAreForgotten(t *testing.T) {
+	c := New(Config{Window: time.Minute})
+
+	c.Seen(trade("AAPL", 1), base)
+	c.Seen(trade("AAPL", 2), base.Add(2*time.Minute))
+	if c.Len() != 1 {
+		t.Errorf("Expected the trade outside the window to be forgotten, %d remembered", c.Len())
+	}
+	if c.Seen(trade("AAPL", 1), base) {
+		t.Error("A trade older than the window can't be checked and should pass")
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	c := New(Config{Window: time.Hour, MaxEntries: 2})
+
+	for id := 1; id <= 3; id++ {
+		c.Seen(trade("AAPL", id), base.Add(time.Duration(id)*time.Second))
+	}
+	if c.Len() != 2 {
+		t.Fatalf("Expected 2 trades remembered, got %d", c.Len())
+	}
+	if c.Contains(trade("AAPL", 1)) || !c.Contains(trade("AAPL", 3)) {
+		t.Error("Expected the oldest trade to be evicted")
+	}
+}
+
+func TestContainsDoesNotRemember(t *testing.T) {
+	c := New(Config{})
+
+	if c.Contains(trade("AAPL", 1)) || c.Contains(trade("AAPL", 1)) {
+		t.Fatal("Contains should not remember the trade")
+	}
+	c.Add(trade("AAPL", 1), base)
+	if !c.Contains(trade("AAPL", 1)) {
+		t.Error("Expected the added trade to be remembered")
+	}
+}
+
+func TestForgetReleasesTrade(t *testing.T) {
+	c := New(Config{})
+
+	c.Seen(trade("AAPL", 1), base)
+	c.Forget(trade("AAPL", 1))
+	if c.Seen(trade("AAPL", 1), base) {
+		t.Error("A forgotten trade should be let through again")
+	}
+	if !c.Seen(trade("AAPL", 1), base) {
+		t.Error("Expected the trade to be remembered again")
+	}
+}
@@ -0,0 +1,54 @@
+package eventclock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells time in trade time: the newest trade timestamp observed,
+// moved forward at wall-clock pace while no newer trade arrives. Stages use
+// it rather than the wall clock so that replays behave like the live
+// stream, and so that time still passes when the feed goes quiet.
+type Clock struct {
+	// Wall returns the wall-clock time; time.Now when nil.
+	Wall func() time.Time
+
+	mu       sync.Mutex
+	latest   time.Time // newest trade timestamp seen
+	latestAt time.Time // wall-clock time it was seen
+}
+
+// Observe records a trade timestamp.
+func (c *Clock) Observe(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t.After(c.latest) {
+		c.latest = t
+		c.latestAt = c.wall()
+	}
+}
+
+// Now returns the current trade time, or the zero time before the first
+// trade. now is the current wall-clock time.
+func (c *Clock) Now(now time.Time) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.latest.IsZero() {
+		return time.Time{}
+	}
+	return c.latest.Add(now.Sub(c.latestAt))
+}
+
+// Current returns the trade time as of the clock's own wall clock.
+func (c *Clock) Current() time.Time {
+	return c.Now(c.wall())
+}
+
+func (c *Clock) wall() time.Time {
+	if c.Wall != nil {
+		return c.Wall()
+	}
+	return time.Now()
+}
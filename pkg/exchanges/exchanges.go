@@ -0,0 +1,57 @@
+package exchanges
+
+// Venue describes the exchange code Alpaca sends in a trade's "x" field.
+type Venue struct {
+	Code string
+	Name string
+	// MIC is the ISO 10383 market identifier code. Off-exchange prints
+	// reported through a FINRA facility use XOFF.
+	MIC string
+	// OffExchange is true for trades reported to a FINRA TRF or the ADF
+	// rather than executed on a lit exchange (dark pools, internalisers).
+	OffExchange bool
+}
+
+// venues follows Alpaca's stock exchange code list.
+var venues = map[string]Venue{
+	"A": {"A", "NYSE American", "XASE", false},
+	"B": {"B", "Nasdaq BX", "XBOS", false},
+	"C": {"C", "NYSE National", "XCIS", false},
+	"D": {"D", "FINRA ADF/TRF", "XOFF", true},
+	"E": {"E", "Market Independent", "", false},
+	"H": {"H", "MIAX Pearl", "EPRL", false},
+	"I": {"I", "Nasdaq ISE", "XISX", false},
+	"J": {"J", "Cboe EDGA", "EDGA", false},
+	"K": {"K", "Cboe EDGX", "EDGX", false},
+	"L": {"L", "Long-Term Stock Exchange", "LTSE", false},
+	"M": {"M", "NYSE Chicago", "XCHI", false},
+	"N": {"N", "New York Stock Exchange", "XNYS", false},
+	"P": {"P", "NYSE Arca", "ARCX", false},
+	"Q": {"Q", "Nasdaq", "XNAS", false},
+	"S": {"S", "Nasdaq Small Cap", "XNAS", false},
+	"T": {"T", "Nasdaq Int", "XNAS", false},
+	"U": {"U", "Members Exchange", "MEMX", false},
+	"V": {"V", "IEX", "IEXG", false},
+	"W": {"W", "Cboe Stock Exchange", "XCBO", false},
+	"X": {"X", "Nasdaq PSX", "XPHL", false},
+	"Y": {"Y", "Cboe BYX", "BATY", false},
+	"Z": {"Z", "Cboe BZX", "BATS", false},
+}
+
+// Lookup returns the venue for an exchange code.
+func Lookup(code string) (Venue, bool) {
+	v, ok := venues[code]
+	return v, ok
+}
+
+// tapes names the SIP tapes by the listing market of the securities on them.
+var tapes = map[string]string{
+	"A": "NYSE",
+	"B": "NYSE Arca/regional",
+	"C": "Nasdaq",
+}
+
+// TapeName returns the name of a tape, or "" if the code is unknown.
+func TapeName(tape string) string {
+	return tapes[tape]
+}
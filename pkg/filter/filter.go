@@ -0,0 +1,133 @@
+package filter
+
+import (
+	"strings"
+
+	"go-alpaca-streaming/pkg/metrics"
+	author_symbols "go-alpaca-streaming/pkg/symbols"
+	"go-alpaca-streaming/pkg/utils"
+)
+
+// Config holds the filtering rules. Zero values disable a rule.
+type Config struct {
+	// MinSize drops trades smaller than this many shares.
+	MinSize int
+	// ExcludeConditions drops trades carrying any of these condition codes,
+	// e.g. "I" for odd lots.
+	ExcludeConditions []string
+	// ExcludeExchanges drops trades from these exchange codes, e.g. "D" for
+	// FINRA TRF prints.
+	ExcludeExchanges []string
+	// MinPrice and MaxPrice drop trades priced outside the band.
+	MinPrice float64
+	MaxPrice float64
+	// AllowSymbols, when set, drops every other symbol.
+	AllowSymbols []string
+	// DenySymbols drops these symbols.
+	DenySymbols []string
+}
+
+// Rule names, as used in the filter_dropped_by_rule metric.
+const (
+	RuleAllowSymbols      = "allow_symbols"
+	RuleDenySymbols       = "deny_symbols"
+	RuleExcludeExchanges  = "exclude_exchanges"
+	RuleExcludeConditions = "exclude_conditions"
+	RuleMinSize           = "min_size"
+	RulePriceBand         = "price_band"
+)
+
+var (
+	droppedByRule = metrics.CounterMap("filter_dropped_by_rule")
+	passedTotal   = metrics.Counter("filter_passed_total")
+)
+
+// Filter decides which trades are written. It is read-only once built and
+// safe for concurrent use.
+type Filter struct {
+	cfg        Config
+	conditions map[string]bool
+	exchanges  map[string]bool
+	allow      map[string]bool
+	deny       map[string]bool
+}
+
+// New builds a filter from cfg. It returns nil if no rule is set, so callers
+// can skip filtering altogether.
+func New(cfg Config) *Filter {
+	f := &Filter{
+		cfg:        cfg,
+		conditions: set(cfg.ExcludeConditions, false),
+		exchanges:  set(cfg.ExcludeExchanges, true),
+		allow:      symbolSet(cfg.AllowSymbols),
+		deny:       symbolSet(cfg.DenySymbols),
+	}
+	if cfg.MinSize <= 0 && cfg.MinPrice <= 0 && cfg.MaxPrice <= 0 &&
+		len(f.conditions) == 0 && len(f.exchanges) == 0 && len(f.allow) == 0 && len(f.deny) == 0 {
+		return nil
+	}
+	return f
+}
+
+// set builds a lookup set. Condition codes are case-sensitive, so only
+// exchanges are upper-cased.
+func set(items []string, upper bool) map[string]bool {
+	m := make(map[string]bool, len(items))
+	for _, item := range items {
+		if upper {
+			item = strings.ToUpper(strings.TrimSpace(item))
+		}
+		if item != "" {
+			m[item] = true
+		}
+	}
+	return m
+}
+
+// symbolSet builds a symbol lookup set, normalized as for subscriptions so
+// that "BRK/B" matches the streamed "BRK.B".
+func symbolSet(symbols []string) map[string]bool {
+	m := make(map[string]bool, len(symbols))
+	for _, s := range symbols {
+		if s = author_symbols.NormalizeSymbol(s); s != "" {
+			m[s] = true
+		}
+	}
+	return m
+}
+
+// Check returns the name of the first rule that drops the trade, or "" if
+// it passes. Every drop is counted under filter_dropped_by_rule.
+func (f *Filter) Check(trade utils.RawTrade) string {
+	rule := f.check(trade)
+	if rule == "" {
+		passedTotal.Add(1)
+	} else {
+		droppedByRule.Add(rule, 1)
+	}
+	return rule
+}
+
+func (f *Filter) check(trade utils.RawTrade) string {
+	if len(f.allow) > 0 && !f.allow[trade.Symbol] {
+		return RuleAllowSymbols
+	}
+	if f.deny[trade.Symbol] {
+		return RuleDenySymbols
+	}
+	if f.exchanges[trade.X] {
+		return RuleExcludeExchanges
+	}
+	for _, c := range trade.C {
+		if f.conditions[c] {
+			return RuleExcludeConditions
+		}
+	}
+	if f.cfg.MinSize > 0 && trade.Size < f.cfg.MinSize {
+		return RuleMinSize
+	}
+	if (f.cfg.MinPrice > 0 && trade.Price < f.cfg.MinPrice) || (f.cfg.MaxPrice > 0 && trade.Price > f.cfg.MaxPrice) {
+		return RulePriceBand
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+package filter
+
+import (
+	"expvar"
+	"testing"
+
+	"go-alpaca-streaming/pkg/utils"
+)
+
+// dropped returns the filter_dropped_by_rule counter for rule.
+func dropped(rule string) int64 {
+	if v, ok := droppedByRule.Get(rule).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestNewWithoutRulesReturnsNil(t *testing.T) {
+	if f := New(Config{}); f != nil {
+		t.Fatalf("Expected no filter without rules, got %+v", f)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	f := New(Config{
+		MinSize:           10,
+		ExcludeConditions: []string{"I"},
+		ExcludeExchanges:  []string{"d"},
+		MinPrice:          1,
+		MaxPrice:          1000,
+		DenySymbols:       []string{"GME"},
+	})
+
+	base := utils.RawTrade{Symbol: "AAPL", X: "V", Price: 170, Size: 100, C: []string{"@"}}
+	tests := []struct {
+		name   string
+		modify func(*utils.RawTrade)
+		want   string
+	}{
+		{"passes", func(*utils.RawTrade) {}, ""},
+		{"odd lot", func(tr *utils.RawTrade) { tr.C = []string{"@", "I"} }, RuleExcludeConditions},
+		{"TRF", func(tr *utils.RawTrade) { tr.X = "D" }, RuleExcludeExchanges},
+		{"small", func(tr *utils.RawTrade) { tr.Size = 5 }, RuleMinSize},
+		{"too cheap", func(tr *utils.RawTrade) { tr.Price = 0.5 }, RulePriceBand},
+		{"too dear", func(tr *utils.RawTrade) { tr.Price = 5000 }, RulePriceBand},
+		{"denied", func(tr *utils.RawTrade) { tr.Symbol = "GME" }, RuleDenySymbols},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trade := base
+			tt.modify(&trade)
+			before := dropped(tt.want)
+			if got := f.Check(trade); got != tt.want {
+				t.Fatalf("Check() = %q, want %q", got, tt.want)
+			}
+			if tt.want != "" && dropped(tt.want) != before+1 {
+				t.Fatalf("Expected the %s counter to go up", tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowSymbols(t *testing.T) {
+	f := New(Config{AllowSymbols: []string{"aapl"}})
+	if rule := f.Check(utils.RawTrade{Symbol: "AAPL"}); rule != "" {
+		t.Fatalf("Expected AAPL to pass, got %q", rule)
+	}
+	if rule := f.Check(utils.RawTrade{Symbol: "MSFT"}); rule != RuleAllowSymbols {
+		t.Fatalf("Expected MSFT to be dropped by %s, got %q", RuleAllowSymbols, rule)
+	}
+}
+
+func TestSymbolsAreNormalized(t *testing.T) {
+	f := New(Config{AllowSymbols: []string{"BRK/B"}, DenySymbols: []string{"bf.b "}})
+	if rule := f.Check(utils.RawTrade{Symbol: "BRK.B"}); rule != "" {
+		t.Fatalf("Expected BRK.B to pass, got %q", rule)
+	}
+
+	f = New(Config{DenySymbols: []string{"bf/b "}})
+	if rule := f.Check(utils.RawTrade{Symbol: "BF.B"}); rule != RuleDenySymbols {
+		t.Fatalf("Expected BF.B to be dropped by %s, got %q", RuleDenySymbols, rule)
+	}
+}
@@ -0,0 +1,314 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"go-alpaca-streaming/pkg/calendar"
+	"go-alpaca-streaming/pkg/metrics"
+)
+
+// Measurement is the line protocol measurement health events are written to.
+const Measurement = "alpaca_equities_streaming_health"
+
+// Event kinds.
+const (
+	StaleSymbol  = "stale_symbol"
+	FeedSilence  = "feed_silence"
+	allSymbolTag = "*"
+)
+
+// Config sets the silence thresholds.
+type Config struct {
+	// SymbolThreshold is how long a normally active symbol may go without a
+	// trade during regular hours before it is reported stale.
+	SymbolThreshold time.Duration
+	// FeedThreshold is how long the connection may go without any trade
+	// during regular hours before the feed is reported silent.
+	FeedThreshold time.Duration
+	// MinTradesPerMinute is the average rate at which a symbol counts as
+	// normally active. Quieter symbols are never reported stale.
+	MinTradesPerMinute float64
+	// CheckInterval is how often silence is checked.
+	CheckInterval time.Duration
+	// Calendar decides when the regular session is open. It defaults to
+	// the NYSE calendar.
+	Calendar *calendar.Calendar
+}
+
+// DefaultConfig returns the thresholds used when nothing is configured.
+func DefaultConfig() Config {
+	return Config{
+		SymbolThreshold:    5 * time.Minute,
+		FeedThreshold:      30 * time.Second,
+		MinTradesPerMinute: 1,
+		CheckInterval:      10 * time.Second,
+	}
+}
+
+func (cfg Config) normalize() Config {
+	def := DefaultConfig()
+	if cfg.SymbolThreshold <= 0 {
+		cfg.SymbolThreshold = def.SymbolThreshold
+	}
+	if cfg.FeedThreshold <= 0 {
+		cfg.FeedThreshold = def.FeedThreshold
+	}
+	if cfg.MinTradesPerMinute <= 0 {
+		cfg.MinTradesPerMinute = def.MinTradesPerMinute
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = def.CheckInterval
+	}
+	if cfg.Calendar == nil {
+		cfg.Calendar = calendar.NYSE()
+	}
+	return cfg
+}
+
+// Event reports a symbol or the whole feed going quiet, or recovering.
+type Event struct {
+	Kind string
+	// Symbol is empty for FeedSilence.
+	Symbol string
+	// Stale is true when the silence starts and false when it ends.
+	Stale bool
+	// Silent is how long nothing had arrived when the event was raised.
+	Silent time.Duration
+	// TradesPerMinute is the symbol's usual rate.
+	TradesPerMinute float64
+	At              time.Time
+}
+
+// LineProtocol formats the event as a point in Measurement.
+func (e Event) LineProtocol() string {
+	symbol := e.Symbol
+	if symbol == "" {
+		symbol = allSymbolTag
+	}
+	fields := fmt.Sprintf("stale=%t,silent_seconds=%f", e.Stale, e.Silent.Seconds())
+	if e.Kind == StaleSymbol {
+		fields += fmt.Sprintf(",trades_per_minute=%f", e.TradesPerMinute)
+	}
+	return fmt.Sprintf("%s,kind=%s,symbol=%s %s %d", Measurement, e.Kind, symbol, fields, e.At.UnixNano())
+}
+
+// EmitFunc receives events as they are raised.
+type EmitFunc func(events []Event)
+
+var (
+	staleSymbols = metrics.Counter("health_stale_symbols")
+	feedSilent   = metrics.Counter("health_feed_silent")
+	staleEvents  = metrics.CounterMap("health_events_total")
+)
+
+// minTradesForRate is how many trades a symbol needs before its rate is
+// trusted.
+const minTradesForRate = 10
+
+// gapWeight is the weight of the newest gap in a symbol's average gap.
+const gapWeight = 0.05
+
+type symbolState struct {
+	last   time.Time
+	avgGap time.Duration
+	trades int
+	stale  bool
+}
+
+func (s *symbolState) tradesPerMinute() float64 {
+	if s.trades < minTradesForRate || s.avgGap <= 0 {
+		return 0
+	}
+	return float64(time.Minute) / float64(s.avgGap)
+}
+
+// Monitor tracks when each symbol, and the feed as a whole, last traded,
+// and raises events when they go quiet during regular trading hours. It
+// works on receive (wall-clock) time, so it is only useful on a live stream.
+type Monitor struct {
+	cfg  Config
+	emit EmitFunc
+	now  func() time.Time
+
+	mu        sync.Mutex
+	lastTrade time.Time
+	feedStale bool
+	symbols   map[string]*symbolState
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates a monitor that hands events to emit.
+func New(cfg Config, emit EmitFunc) *Monitor {
+	return &Monitor{
+		cfg:     cfg.normalize(),
+		emit:    emit,
+		now:     time.Now,
+		symbols: make(map[string]*symbolState),
+	}
+}
+
+// Trade records that a trade for symbol was received.
+func (m *Monitor) Trade(symbol string) {
+	now := m.now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastTrade = now
+
+	s := m.symbols[symbol]
+	if s == nil {
+		s = &symbolState{}
+		m.symbols[symbol] = s
+	}
+	// Only gaps within a session say anything about a symbol's usual rate;
+	// not the overnight one to today's first trade.
+	day, _ := m.cfg.Calendar.Day(now)
+	if !s.last.IsZero() && m.regular(now) && m.regular(s.last) && !s.last.Before(day.Open) {
+		gap := now.Sub(s.last)
+		if s.avgGap == 0 {
+			s.avgGap = gap
+		} else {
+			s.avgGap = time.Duration(gapWeight*float64(gap) + (1-gapWeight)*float64(s.avgGap))
+		}
+		s.trades++
+	}
+	s.last = now
+}
+
+// Check raises events for silences that started or ended since the last
+// check. Outside regular hours silence is expected, and anything reported
+// stale is quietly reset.
+func (m *Monitor) Check() []Event {
+	now := m.now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var events []Event
+
+	if !m.regular(now) {
+		m.feedStale = false
+		for _, s := range m.symbols {
+			s.stale = false
+		}
+		staleSymbols.Set(0)
+		feedSilent.Set(0)
+		return nil
+	}
+
+	// Before the first trade, silence is counted from when checking began,
+	// and a trade from an earlier session counts from today's open.
+	if m.lastTrade.IsZero() {
+		m.lastTrade = now
+	}
+	day, _ := m.cfg.Calendar.Day(now)
+	silent := now.Sub(m.lastTrade)
+	if m.lastTrade.Before(day.Open) {
+		silent = now.Sub(day.Open)
+	}
+	if stale := silent > m.cfg.FeedThreshold; stale != m.feedStale {
+		m.feedStale = stale
+		events = append(events, Event{Kind: FeedSilence, Stale: stale, Silent: silent, At: now})
+	}
+
+	stale := 0
+	for symbol, s := range m.symbols {
+		rate := s.tradesPerMinute()
+		if rate < m.cfg.MinTradesPerMinute && !s.stale {
+			continue
+		}
+		// A symbol that hasn't traded yet this session, such as one with
+		// no pre-market prints, is only watched once it does.
+		if s.last.Before(day.Open) {
+			continue
+		}
+		silent := now.Sub(s.last)
+		if isStale := silent > m.cfg.SymbolThreshold; isStale != s.stale {
+			s.stale = isStale
+			events = append(events, Event{Kind: StaleSymbol, Symbol: symbol, Stale: isStale, Silent: silent, TradesPerMinute: rate, At: now})
+		}
+		if s.stale {
+			stale++
+		}
+	}
+
+	staleSymbols.Set(int64(stale))
+	if m.feedStale {
+		feedSilent.Set(1)
+	} else {
+		feedSilent.Set(0)
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Symbol < events[j].Symbol })
+	for _, e := range events {
+		if e.Stale {
+			staleEvents.Add(e.Kind, 1)
+		}
+	}
+	return events
+}
+
+// Start checks every CheckInterval until Close is called or ctx is done,
+// logging each event and handing it to emit.
+func (m *Monitor) Start(ctx context.Context) {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(m.cfg.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				events := m.Check()
+				for _, e := range events {
+					logEvent(e)
+				}
+				if len(events) > 0 {
+					m.emit(events)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops checking.
+func (m *Monitor) Close() {
+	if m.stop != nil {
+		close(m.stop)
+		<-m.done
+		m.stop = nil
+	}
+}
+
+func logEvent(e Event) {
+	switch {
+	case e.Kind == FeedSilence && e.Stale:
+		log.Printf("Warning: no trades received for %v; the stream may be stuck", e.Silent.Round(time.Second))
+	case e.Kind == FeedSilence:
+		log.Println("Trades are arriving again")
+	case e.Stale:
+		log.Printf("Warning: %s has not traded for %v (usually %.1f trades/min)",
+			e.Symbol, e.Silent.Round(time.Second), e.TradesPerMinute)
+	default:
+		log.Printf("%s is trading again", e.Symbol)
+	}
+}
+
+// regular reports whether t falls in the regular session.
+func (m *Monitor) regular(t time.Time) bool {
+	return m.cfg.Calendar.Session(t) == calendar.Regular
+}
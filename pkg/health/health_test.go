@@ -0,0 +1,127 @@
+package health
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 10:00 New York time on a Friday.
+var open = time.Date(2024, 3, 1, 15, 0, 0, 0, time.UTC)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newMonitor(clock *fakeClock) *Monitor {
+	m := New(Config{SymbolThreshold: 5 * time.Minute, FeedThreshold: 30 * time.Second, MinTradesPerMinute: 1}, nil)
+	m.now = clock.now
+	return m
+}
+
+func TestStaleSymbolAndRecovery(t *testing.T) {
+	clock := &fakeClock{t: open}
+	m := newMonitor(clock)
+
+	// AAPL trades every 10s; XYZ only every 10 minutes.
+	for i := 0; i < 20; i++ {
+		m.Trade("AAPL")
+		if i%60 == 0 {
+			m.Trade("XYZ")
+		}
+		clock.advance(10 * time.Second)
+	}
+	if events := m.Check(); len(events) != 0 {
+		t.Fatalf("Expected no events while trading, got %+v", events)
+	}
+
+	// MSFT keeps the feed alive while AAPL goes quiet.
+	for i := 0; i < 35; i++ {
+		m.Trade("MSFT")
+		clock.advance(10 * time.Second)
+	}
+	events := m.Check()
+	if len(events) != 1 || events[0].Kind != StaleSymbol || events[0].Symbol != "AAPL" || !events[0].Stale {
+		t.Fatalf("Expected AAPL to be stale, got %+v", events)
+	}
+	if rate := events[0].TradesPerMinute; rate < 5 || rate > 7 {
+		t.Errorf("AAPL rate = %v, want about 6/min", rate)
+	}
+	if events := m.Check(); len(events) != 0 {
+		t.Errorf("Expected a stale symbol to be reported once, got %+v", events)
+	}
+
+	m.Trade("AAPL")
+	events = m.Check()
+	if len(events) != 1 || events[0].Symbol != "AAPL" || events[0].Stale {
+		t.Fatalf("Expected AAPL to recover, got %+v", events)
+	}
+}
+
+func TestFeedSilence(t *testing.T) {
+	clock := &fakeClock{t: open}
+	m := newMonitor(clock)
+
+	m.Trade("AAPL")
+	clock.advance(31 * time.Second)
+	events := m.Check()
+	if len(events) != 1 || events[0].Kind != FeedSilence || !events[0].Stale {
+		t.Fatalf("Expected feed silence, got %+v", events)
+	}
+
+	line := events[0].LineProtocol()
+	if !strings.HasPrefix(line, Measurement+",kind=feed_silence,symbol=* stale=true,silent_seconds=31.") {
+		t.Errorf("Unexpected line protocol %q", line)
+	}
+
+	m.Trade("AAPL")
+	events = m.Check()
+	if len(events) != 1 || events[0].Stale {
+		t.Fatalf("Expected the feed to recover, got %+v", events)
+	}
+}
+
+func TestNoEventsOutsideRegularHours(t *testing.T) {
+	// 18:00 New York time.
+	clock := &fakeClock{t: open.Add(8 * time.Hour)}
+	m := newMonitor(clock)
+
+	m.Trade("AAPL")
+	clock.advance(time.Hour)
+	if events := m.Check(); len(events) != 0 {
+		t.Errorf("Expected silence after hours to be ignored, got %+v", events)
+	}
+}
+
+func TestPreviousSessionDoesNotCountAsSilence(t *testing.T) {
+	// AAPL trades actively on Thursday.
+	clock := &fakeClock{t: open.Add(-24 * time.Hour)}
+	m := newMonitor(clock)
+	for i := 0; i < 20; i++ {
+		m.Trade("AAPL")
+		clock.advance(10 * time.Second)
+	}
+
+	// On Friday it has no pre-market prints. Past the threshold after the
+	// open, only MSFT has traded.
+	clock.t = open.Add(-30 * time.Minute)
+	for i := 0; i < 36; i++ {
+		m.Trade("MSFT")
+		clock.advance(10 * time.Second)
+	}
+	if events := m.Check(); len(events) != 0 {
+		t.Fatalf("Expected Thursday's last trade not to make AAPL stale, got %+v", events)
+	}
+
+	// Once it has traded this session, it is watched again.
+	m.Trade("AAPL")
+	for i := 0; i < 36; i++ {
+		m.Trade("MSFT")
+		clock.advance(10 * time.Second)
+	}
+	events := m.Check()
+	if len(events) != 1 || events[0].Symbol != "AAPL" || !events[0].Stale {
+		t.Fatalf("Expected AAPL to be stale, got %+v", events)
+	}
+}
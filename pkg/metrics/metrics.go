@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// All counters are published through expvar, so they show up under
+// /debug/vars when Serve is running.
+
+var mu sync.Mutex
+
+// Counter returns the named counter, creating it on first use.
+func Counter(name string) *expvar.Int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if v, ok := expvar.Get(name).(*expvar.Int); ok {
+		return v
+	}
+	return expvar.NewInt(name)
+}
+
+// CounterMap returns the named map of counters, creating it on first use.
+// Maps are used for per-symbol and per-rule breakdowns.
+func CounterMap(name string) *expvar.Map {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if v, ok := expvar.Get(name).(*expvar.Map); ok {
+		return v
+	}
+	return expvar.NewMap(name)
+}
+
+// Serve exposes the counters at http://addr/debug/vars. It blocks, so run it
+// in its own goroutine.
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	log.Printf("Serving metrics on %s/debug/vars", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,208 @@
+package outlier
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"go-alpaca-streaming/pkg/conditions"
+	"go-alpaca-streaming/pkg/metrics"
+)
+
+// Route decides where flagged trades are written.
+type Route string
+
+const (
+	// Tag writes flagged trades to the trades measurement with outlier=true.
+	Tag Route = "tag"
+	// Measurement writes flagged trades to a separate measurement instead.
+	Measurement Route = "measurement"
+)
+
+// ParseRoute converts a configuration string into a Route.
+func ParseRoute(s string) (Route, error) {
+	switch r := Route(strings.ToLower(strings.TrimSpace(s))); r {
+	case Tag, Measurement:
+		return r, nil
+	case "":
+		return Tag, nil
+	default:
+		return "", fmt.Errorf("unknown outlier route %q", s)
+	}
+}
+
+// Config tunes the detector.
+type Config struct {
+	// Window is the number of recent prices per symbol the median and MAD
+	// are computed over.
+	Window int
+	// MinHistory is how many prices a symbol needs before anything is flagged.
+	MinHistory int
+	// Threshold is the robust z-score, |price - median| / (1.4826 * MAD),
+	// above which a trade is flagged.
+	Threshold float64
+	// MinDeviation is the smallest relative deviation from the median that
+	// can be flagged. It keeps a symbol whose prints are all at one price
+	// (MAD of zero) from flagging a one-tick move.
+	MinDeviation float64
+	Route        Route
+}
+
+// DefaultConfig returns the settings used when nothing is configured.
+func DefaultConfig() Config {
+	return Config{
+		Window:       50,
+		MinHistory:   20,
+		Threshold:    10,
+		MinDeviation: 0.005,
+		Route:        Tag,
+	}
+}
+
+func (cfg Config) normalize() Config {
+	def := DefaultConfig()
+	if cfg.Window <= 0 {
+		cfg.Window = def.Window
+	}
+	if cfg.MinHistory <= 0 || cfg.MinHistory > cfg.Window {
+		cfg.MinHistory = min(def.MinHistory, cfg.Window)
+	}
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = def.Threshold
+	}
+	if cfg.MinDeviation <= 0 {
+		cfg.MinDeviation = def.MinDeviation
+	}
+	if cfg.Route == "" {
+		cfg.Route = def.Route
+	}
+	return cfg
+}
+
+var (
+	flaggedBySymbol = metrics.CounterMap("outlier_flagged_by_symbol")
+	flaggedTotal    = metrics.Counter("outlier_flagged_total")
+)
+
+// ring holds a symbol's most recent prices.
+type ring struct {
+	prices []float64
+	next   int
+	full   bool
+}
+
+func (r *ring) add(price float64) {
+	r.prices[r.next] = price
+	r.next = (r.next + 1) % len(r.prices)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *ring) values() []float64 {
+	if r.full {
+		return r.prices
+	}
+	return r.prices[:r.next]
+}
+
+// Detector flags trades whose price is far from the symbol's recent median,
+// measured in median absolute deviations. The median and MAD are robust, so
+// a single bad print neither hides itself nor shifts the baseline much, and
+// a genuine move is accepted once it makes up half the window.
+type Detector struct {
+	cfg Config
+
+	mu      sync.Mutex
+	symbols map[string]*ring
+	scratch []float64
+}
+
+// New creates a detector.
+func New(cfg Config) *Detector {
+	cfg = cfg.normalize()
+	return &Detector{
+		cfg:     cfg,
+		symbols: make(map[string]*ring),
+		scratch: make([]float64, cfg.Window),
+	}
+}
+
+// Route returns where flagged trades should be written.
+func (d *Detector) Route() Route {
+	return d.cfg.Route
+}
+
+// Check scores a trade against the symbol's recent prices and reports
+// whether it is an outlier. Trades that may not update the last price,
+// including out-of-sequence, average-price and derivatively priced prints,
+// are expected to be off-market; they are neither scored nor added to the
+// history.
+func (d *Detector) Check(symbol string, price float64, cond conditions.Result) (score float64, outlier bool) {
+	if !cond.UpdatesLast || cond.Has(conditions.OutOfSequence) || price <= 0 {
+		return 0, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r := d.symbols[symbol]
+	if r == nil {
+		r = &ring{prices: make([]float64, d.cfg.Window)}
+		d.symbols[symbol] = r
+	}
+	defer r.add(price)
+
+	history := r.values()
+	if len(history) < d.cfg.MinHistory {
+		return 0, false
+	}
+
+	median, mad := d.medianMAD(history)
+	deviation := math.Abs(price - median)
+	if deviation < d.cfg.MinDeviation*median {
+		return 0, false
+	}
+
+	// 1.4826 scales the MAD to a standard deviation for normal data.
+	scale := 1.4826 * mad
+	if scale == 0 {
+		scale = d.cfg.MinDeviation * median
+	}
+	if scale == 0 {
+		return 0, false
+	}
+
+	score = deviation / scale
+	if score > d.cfg.Threshold {
+		flaggedBySymbol.Add(symbol, 1)
+		flaggedTotal.Add(1)
+		return score, true
+	}
+	return score, false
+}
+
+// medianMAD returns the median of values and their median absolute
+// deviation from it.
+func (d *Detector) medianMAD(values []float64) (float64, float64) {
+	buf := d.scratch[:len(values)]
+	copy(buf, values)
+	median := medianOf(buf)
+
+	for i, v := range values {
+		buf[i] = math.Abs(v - median)
+	}
+	return median, medianOf(buf)
+}
+
+// medianOf sorts values in place and returns their median.
+func medianOf(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
@@ -0,0 +1,68 @@
+package outlier
+
+import (
+	"testing"
+
+	"go-alpaca-streaming/pkg/conditions"
+)
+
+var regular = conditions.Decode("C", []string{"@"})
+
+func TestCheckFlagsFatFinger(t *testing.T) {
+	d := New(Config{Window: 20, MinHistory: 10, Threshold: 10})
+
+	for i := 0; i < 20; i++ {
+		if _, outlier := d.Check("AAPL", 100+float64(i%5)*0.01, regular); outlier {
+			t.Fatalf("Trade %d flagged while building history", i)
+		}
+	}
+
+	score, outlier := d.Check("AAPL", 1000, regular)
+	if !outlier {
+		t.Fatalf("Expected a 10x print to be flagged, score %v", score)
+	}
+	if _, outlier := d.Check("AAPL", 100.03, regular); outlier {
+		t.Fatal("A normal print after the outlier must not be flagged")
+	}
+}
+
+func TestCheckSkipsOffMarketConditions(t *testing.T) {
+	d := New(Config{Window: 20, MinHistory: 10, Threshold: 10})
+	for i := 0; i < 20; i++ {
+		d.Check("MSFT", 400, regular)
+	}
+
+	for _, codes := range [][]string{{"Z"}, {"@", "4"}, {"W"}} {
+		cond := conditions.Decode("C", codes)
+		if _, outlier := d.Check("MSFT", 300, cond); outlier {
+			t.Errorf("Trade with conditions %v must not be flagged", codes)
+		}
+	}
+}
+
+func TestCheckAcceptsGenuineMove(t *testing.T) {
+	d := New(Config{Window: 10, MinHistory: 5, Threshold: 10})
+	for i := 0; i < 10; i++ {
+		d.Check("GME", 20, regular)
+	}
+
+	flagged := 0
+	for i := 0; i < 10; i++ {
+		if _, outlier := d.Check("GME", 40, regular); outlier {
+			flagged++
+		}
+	}
+	if flagged == 0 || flagged > 5 {
+		t.Fatalf("Expected the first prints of a new level to be flagged until it dominates, got %d", flagged)
+	}
+}
+
+func TestMinDeviationWithFlatHistory(t *testing.T) {
+	d := New(Config{Window: 10, MinHistory: 5, Threshold: 10, MinDeviation: 0.005})
+	for i := 0; i < 10; i++ {
+		d.Check("SPY", 500, regular)
+	}
+	if _, outlier := d.Check("SPY", 500.01, regular); outlier {
+		t.Fatal("A one-cent move on a flat history must not be flagged")
+	}
+}
@@ -0,0 +1,102 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go-alpaca-streaming/pkg/capture"
+)
+
+// FrameHandler receives each replayed frame. Returning false stops the replay.
+type FrameHandler func(ctx context.Context, frame []byte) bool
+
+// Options controls replay pacing.
+type Options struct {
+	// Speed scales the gaps between frames: 1 replays at the original pace,
+	// 10 ten times faster. Zero or less replays as fast as possible.
+	Speed float64
+}
+
+// Stats summarises a replay.
+type Stats struct {
+	Files   int
+	Frames  int
+	Bytes   int64
+	Elapsed time.Duration
+	// Span is the wall-clock time covered by the captured frames.
+	Span time.Duration
+}
+
+func (s Stats) String() string {
+	rate := 0.0
+	if s.Elapsed > 0 {
+		rate = float64(s.Frames) / s.Elapsed.Seconds()
+	}
+	return fmt.Sprintf("%d frames (%d bytes) from %d files in %v, %.0f frames/s, covering %v of capture",
+		s.Frames, s.Bytes, s.Files, s.Elapsed.Round(time.Millisecond), rate, s.Span.Round(time.Millisecond))
+}
+
+// Run reads the capture files in order and hands every frame to handle,
+// pacing them according to opts.
+func Run(ctx context.Context, files []string, opts Options, handle FrameHandler) (Stats, error) {
+	var stats Stats
+	start := time.Now()
+
+	// The first frame is replayed immediately; later frames are scheduled
+	// relative to it.
+	var firstAt time.Time
+	var lastAt time.Time
+
+	for _, path := range files {
+		r, err := capture.Open(path)
+		if err != nil {
+			return stats, err
+		}
+		stats.Files++
+
+		for {
+			frame, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				r.Close()
+				return stats, fmt.Errorf("%s: %w", path, err)
+			}
+
+			if firstAt.IsZero() {
+				firstAt = frame.ReceivedAt
+			}
+			lastAt = frame.ReceivedAt
+
+			if opts.Speed > 0 {
+				due := start.Add(time.Duration(float64(frame.ReceivedAt.Sub(firstAt)) / opts.Speed))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+						r.Close()
+						return stats, ctx.Err()
+					}
+				}
+			}
+
+			if !handle(ctx, frame.Data) {
+				r.Close()
+				return stats, ctx.Err()
+			}
+			stats.Frames++
+			stats.Bytes += int64(len(frame.Data))
+			stats.Elapsed = time.Since(start)
+			stats.Span = lastAt.Sub(firstAt)
+		}
+
+		r.Close()
+	}
+
+	stats.Elapsed = time.Since(start)
+	return stats, nil
+}
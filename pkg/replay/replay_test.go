@@ -0,0 +1,90 @@
+package replay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go-alpaca-streaming/pkg/capture"
+)
+
+func writeCapture(t *testing.T, gaps ...time.Duration) []string {
+	t.Helper()
+
+	dir := t.TempDir()
+	w, err := capture.NewWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 3, 1, 14, 59, 59, 900000000, time.UTC)
+	for i, gap := range gaps {
+		at = at.Add(gap)
+		if err := w.Write(at, []byte{byte('a' + i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	files, err := capture.Files([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestRunAsFastAsPossible(t *testing.T) {
+	// The second gap crosses the hour, so frames span two files.
+	files := writeCapture(t, 0, time.Hour, time.Hour)
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 capture files, got %d", len(files))
+	}
+
+	var got string
+	stats, err := Run(context.Background(), files, Options{Speed: 0}, func(ctx context.Context, frame []byte) bool {
+		got += string(frame)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "abc" {
+		t.Fatalf("Expected frames in capture order, got %q", got)
+	}
+	if stats.Frames != 3 || stats.Files != 3 || stats.Span != 2*time.Hour {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if stats.Elapsed > time.Second {
+		t.Fatalf("Expected an unpaced replay to be quick, took %v", stats.Elapsed)
+	}
+}
+
+func TestRunHonoursSpeed(t *testing.T) {
+	files := writeCapture(t, 0, 200*time.Millisecond, 200*time.Millisecond)
+
+	stats, err := Run(context.Background(), files, Options{Speed: 4}, func(ctx context.Context, frame []byte) bool {
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 400ms of capture at 4x should take about 100ms.
+	if stats.Elapsed < 90*time.Millisecond || stats.Elapsed > 300*time.Millisecond {
+		t.Fatalf("Expected about 100ms at 4x speed, took %v", stats.Elapsed)
+	}
+}
+
+func TestRunStopsWhenHandlerDeclines(t *testing.T) {
+	files := writeCapture(t, 0, 0, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stats, err := Run(ctx, files, Options{}, func(ctx context.Context, frame []byte) bool {
+		cancel()
+		return false
+	})
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if stats.Frames != 0 {
+		t.Fatalf("Expected no frames counted, got %d", stats.Frames)
+	}
+}
@@ -0,0 +1,70 @@
+package sink
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"go-alpaca-streaming/pkg/telegraf"
+)
+
+// Sink is where validated line protocol ends up.
+type Sink interface {
+	Write(lines []string) error
+}
+
+// Telegraf writes to the shared Telegraf connection. The connection is set
+// up and torn down by the caller with telegraf.SetupTelegrafConnection and
+// telegraf.CloseTelegrafConnection.
+type Telegraf struct{}
+
+func (Telegraf) Write(lines []string) error {
+	return telegraf.SendToTelegraf(lines)
+}
+
+// Discard drops everything. It is used for benchmarking the pipeline.
+type Discard struct{}
+
+func (Discard) Write(lines []string) error {
+	return nil
+}
+
+// Writer writes one line per point to an io.Writer, such as os.Stdout.
+type Writer struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// NewWriter creates a Writer sink around w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+func (s *Writer) Write(lines []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, line := range lines {
+		if _, err := s.w.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+// New returns the sink with the given name: telegraf, stdout or discard.
+// stdout writes to out.
+func New(name string, out io.Writer) (Sink, error) {
+	switch strings.ToLower(name) {
+	case "", "telegraf":
+		return Telegraf{}, nil
+	case "stdout":
+		return NewWriter(out), nil
+	case "discard":
+		return Discard{}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink %q", name)
+	}
+}
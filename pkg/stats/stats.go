@@ -0,0 +1,356 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go-alpaca-streaming/pkg/eventclock"
+	"go-alpaca-streaming/pkg/utils"
+)
+
+// Measurement is the line protocol measurement statistics are written to.
+const Measurement = "alpaca_equities_streaming_stats"
+
+// Trade is the part of a decoded trade the stats stage needs.
+type Trade struct {
+	Symbol string
+	Price  float64
+	Size   int
+	Time   time.Time
+
+	UpdatesHighLow bool
+	UpdatesVolume  bool
+}
+
+// Config selects the rolling windows and how often they are emitted.
+type Config struct {
+	// Windows are rounded down to whole seconds.
+	Windows      []time.Duration
+	EmitInterval time.Duration
+}
+
+// Snapshot is one symbol's statistics over one window.
+type Snapshot struct {
+	Symbol string
+	Window time.Duration
+	// At is the end of the window.
+	At time.Time
+
+	Volume int64
+	Trades int
+	VWAP   float64
+	// High and Low come from trades that may update the high/low and are
+	// only meaningful when HasRange is true.
+	High, Low float64
+	HasRange  bool
+}
+
+// Range returns High - Low, or 0 without a range.
+func (s Snapshot) Range() float64 {
+	if !s.HasRange {
+		return 0
+	}
+	return s.High - s.Low
+}
+
+// AvgTradeSize returns the mean size of the trades counted toward volume.
+func (s Snapshot) AvgTradeSize() float64 {
+	if s.Trades == 0 {
+		return 0
+	}
+	return float64(s.Volume) / float64(s.Trades)
+}
+
+// TradesPerSecond returns the trade rate over the window.
+func (s Snapshot) TradesPerSecond() float64 {
+	return float64(s.Trades) / s.Window.Seconds()
+}
+
+// LineProtocol formats the snapshot as a point in Measurement.
+func (s Snapshot) LineProtocol() string {
+	fields := fmt.Sprintf("volume=%d,trade_count=%d,avg_trade_size=%f,trades_per_sec=%f",
+		s.Volume, s.Trades, s.AvgTradeSize(), s.TradesPerSecond())
+	if s.Volume > 0 {
+		fields += fmt.Sprintf(",vwap=%f", s.VWAP)
+	}
+	if s.HasRange {
+		fields += fmt.Sprintf(",high=%f,low=%f,range=%f", s.High, s.Low, s.Range())
+	}
+	return fmt.Sprintf("%s,symbol=%s,window=%s %s %d",
+		Measurement, s.Symbol, utils.ShortDuration(s.Window), fields, s.At.UnixNano())
+}
+
+// EmitFunc receives a round of snapshots.
+type EmitFunc func(snapshots []Snapshot)
+
+// bucketsPerWindow is how many buckets a window is split into. Windows up
+// to that many seconds use one-second buckets; longer ones use coarser
+// buckets, so a series costs the same whatever the window.
+const bucketsPerWindow = 60
+
+// bucket holds the trades of one bucket-width interval.
+type bucket struct {
+	idx       int64 // the interval, in bucket widths since the Unix epoch
+	volume    int64
+	trades    int
+	notional  float64
+	high, low float64
+	hasRange  bool
+}
+
+// ring keeps one window's buckets.
+type ring struct {
+	width   int64 // seconds per bucket
+	buckets []bucket
+	lastIdx int64
+}
+
+func newRing(window time.Duration) ring {
+	secs := int64(window / time.Second)
+	width := max(1, secs/bucketsPerWindow)
+	// Round up, so the window is covered in full.
+	n := (secs + width - 1) / width
+	return ring{width: width, buckets: make([]bucket, n)}
+}
+
+func (r *ring) add(t Trade) {
+	idx := floorDiv(t.Time.Unix(), r.width)
+	// A trade older than the window would overwrite a newer bucket.
+	if idx <= r.lastIdx-int64(len(r.buckets)) {
+		return
+	}
+	b := &r.buckets[mod(idx, len(r.buckets))]
+	if b.idx != idx {
+		*b = bucket{idx: idx}
+	}
+
+	if t.UpdatesVolume {
+		b.volume += int64(t.Size)
+		b.trades++
+		b.notional += t.Price * float64(t.Size)
+	}
+	if t.UpdatesHighLow {
+		if !b.hasRange || t.Price > b.high {
+			b.high = t.Price
+		}
+		if !b.hasRange || t.Price < b.low {
+			b.low = t.Price
+		}
+		b.hasRange = true
+	}
+
+	if idx > r.lastIdx {
+		r.lastIdx = idx
+	}
+}
+
+// sum adds up the buckets of the window ending in the second end. With
+// buckets wider than a second, the oldest part of the window is cut off
+// by up to one bucket, as the newest bucket is still filling.
+func (r *ring) sum(end int64) bucket {
+	last := floorDiv(end, r.width)
+	var total bucket
+	for idx := last - int64(len(r.buckets)) + 1; idx <= last; idx++ {
+		b := r.buckets[mod(idx, len(r.buckets))]
+		if b.idx != idx {
+			continue
+		}
+		total.volume += b.volume
+		total.trades += b.trades
+		total.notional += b.notional
+		if b.hasRange {
+			if !total.hasRange || b.high > total.high {
+				total.high = b.high
+			}
+			if !total.hasRange || b.low < total.low {
+				total.low = b.low
+			}
+			total.hasRange = true
+		}
+	}
+	return total
+}
+
+// series holds a symbol's rings, one per window.
+type series struct {
+	rings   []ring
+	lastSec int64
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+func mod(a int64, n int) int {
+	m := int(a % int64(n))
+	if m < 0 {
+		m += n
+	}
+	return m
+}
+
+// Tracker keeps rolling per-symbol statistics over several windows and
+// emits them periodically. Time is trade time, as for bars, so replays
+// produce the same statistics as the live stream.
+type Tracker struct {
+	windows []time.Duration
+	every   time.Duration
+	emit    EmitFunc
+	clock   eventclock.Clock
+
+	mu     sync.Mutex
+	series map[string]*series
+	// longest is the longest window, in seconds.
+	longest int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates a tracker that hands each round of snapshots to emit.
+func New(cfg Config, emit EmitFunc) *Tracker {
+	var windows []time.Duration
+	for _, w := range cfg.Windows {
+		if w = w.Truncate(time.Second); w > 0 {
+			windows = append(windows, w)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+
+	every := cfg.EmitInterval
+	if every <= 0 {
+		every = 10 * time.Second
+	}
+
+	var longest int64 = 1
+	if len(windows) > 0 {
+		longest = int64(windows[len(windows)-1] / time.Second)
+	}
+
+	return &Tracker{
+		windows: windows,
+		every:   every,
+		emit:    emit,
+		series:  make(map[string]*series),
+		longest: longest,
+	}
+}
+
+// Add records a trade. It is safe to call from any goroutine.
+func (t *Tracker) Add(trade Trade) {
+	if trade.Time.IsZero() || (!trade.UpdatesHighLow && !trade.UpdatesVolume) {
+		return
+	}
+	t.clock.Observe(trade.Time)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.series[trade.Symbol]
+	if s == nil {
+		s = &series{rings: make([]ring, len(t.windows))}
+		for i, w := range t.windows {
+			s.rings[i] = newRing(w)
+		}
+		t.series[trade.Symbol] = s
+	}
+	for i := range s.rings {
+		s.rings[i].add(trade)
+	}
+	if sec := trade.Time.Unix(); sec > s.lastSec {
+		s.lastSec = sec
+	}
+}
+
+// Snapshots computes every symbol's statistics as of at, in trade time.
+// Symbols without a trade in the longest window are forgotten; shorter
+// windows without trades are left out.
+func (t *Tracker) Snapshots(at time.Time) []Snapshot {
+	if at.IsZero() {
+		return nil
+	}
+	end := at.Unix()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []Snapshot
+	for symbol, s := range t.series {
+		if s.lastSec <= end-t.longest {
+			delete(t.series, symbol)
+			continue
+		}
+		for i, w := range t.windows {
+			total := s.rings[i].sum(end)
+			if total.trades == 0 && !total.hasRange {
+				continue
+			}
+			snap := Snapshot{
+				Symbol:   symbol,
+				Window:   w,
+				At:       time.Unix(end, 0).UTC(),
+				Volume:   total.volume,
+				Trades:   total.trades,
+				High:     total.high,
+				Low:      total.low,
+				HasRange: total.hasRange,
+			}
+			if total.volume > 0 {
+				snap.VWAP = total.notional / float64(total.volume)
+			}
+			out = append(out, snap)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Symbol != out[j].Symbol {
+			return out[i].Symbol < out[j].Symbol
+		}
+		return out[i].Window < out[j].Window
+	})
+	return out
+}
+
+// Start emits snapshots every EmitInterval until Close is called or ctx is done.
+func (t *Tracker) Start(ctx context.Context) {
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(t.every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.stop:
+				return
+			case now := <-ticker.C:
+				if snaps := t.Snapshots(t.clock.Now(now)); len(snaps) > 0 {
+					t.emit(snaps)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the periodic emission and emits a last round, so a replay
+// ends with statistics for its final moments.
+func (t *Tracker) Close() {
+	if t.stop != nil {
+		close(t.stop)
+		<-t.done
+		t.stop = nil
+	}
+	if snaps := t.Snapshots(t.clock.Current()); len(snaps) > 0 {
+		t.emit(snaps)
+	}
+}
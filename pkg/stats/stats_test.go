@@ -0,0 +1,100 @@
+package stats
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var base = time.Date(2024, 3, 1, 14, 30, 0, 0, time.UTC)
+
+func trade(symbol string, price float64, size int, at time.Duration) Trade {
+	return Trade{Symbol: symbol, Price: price, Size: size, Time: base.Add(at), UpdatesHighLow: true, UpdatesVolume: true}
+}
+
+func TestSnapshotsOverRollingWindows(t *testing.T) {
+	tr := New(Config{Windows: []time.Duration{time.Minute, 5 * time.Minute}}, nil)
+
+	tr.Add(trade("AAPL", 10, 100, 0))
+	tr.Add(trade("AAPL", 14, 300, 4*time.Minute))
+	tr.Add(trade("AAPL", 12, 100, 4*time.Minute+30*time.Second))
+
+	// An odd lot adds volume but not range.
+	odd := trade("AAPL", 99, 20, 4*time.Minute+40*time.Second)
+	odd.UpdatesHighLow = false
+	tr.Add(odd)
+
+	snaps := tr.Snapshots(base.Add(4*time.Minute + 50*time.Second))
+	if len(snaps) != 2 {
+		t.Fatalf("Expected 1m and 5m snapshots, got %+v", snaps)
+	}
+
+	oneMin, fiveMin := snaps[0], snaps[1]
+	if oneMin.Window != time.Minute || oneMin.Volume != 420 || oneMin.Trades != 3 {
+		t.Errorf("Unexpected 1m snapshot %+v", oneMin)
+	}
+	if oneMin.High != 14 || oneMin.Low != 12 || oneMin.Range() != 2 {
+		t.Errorf("1m range = %v-%v, want 12-14", oneMin.Low, oneMin.High)
+	}
+	if fiveMin.Volume != 520 || fiveMin.Trades != 4 || fiveMin.Low != 10 {
+		t.Errorf("Unexpected 5m snapshot %+v", fiveMin)
+	}
+	wantVWAP := (10*100 + 14*300 + 12*100 + 99*20) / 520.0
+	if fiveMin.VWAP != wantVWAP {
+		t.Errorf("5m VWAP = %v, want %v", fiveMin.VWAP, wantVWAP)
+	}
+	if fiveMin.AvgTradeSize() != 130 || fiveMin.TradesPerSecond() != 4.0/300 {
+		t.Errorf("avg size/rate = %v/%v", fiveMin.AvgTradeSize(), fiveMin.TradesPerSecond())
+	}
+}
+
+func TestLongWindowsUseCoarserBuckets(t *testing.T) {
+	tr := New(Config{Windows: []time.Duration{30 * time.Minute}}, nil)
+
+	tr.Add(trade("AAPL", 10, 100, 0))
+	tr.Add(trade("AAPL", 11, 200, 29*time.Minute))
+
+	r := tr.series["AAPL"].rings[0]
+	if len(r.buckets) != bucketsPerWindow || r.width != 30 {
+		t.Fatalf("30m window has %d buckets of %ds, want %d of 30s", len(r.buckets), r.width, bucketsPerWindow)
+	}
+
+	snaps := tr.Snapshots(base.Add(29*time.Minute + 50*time.Second))
+	if len(snaps) != 1 || snaps[0].Volume != 300 {
+		t.Fatalf("Expected both trades in the 30m window, got %+v", snaps)
+	}
+
+	// Once the first trade's bucket has left the window, only the second
+	// trade is counted.
+	snaps = tr.Snapshots(base.Add(30*time.Minute + 10*time.Second))
+	if len(snaps) != 1 || snaps[0].Volume != 200 {
+		t.Fatalf("Expected only the second trade in the 30m window, got %+v", snaps)
+	}
+}
+
+func TestSnapshotsForgetQuietSymbols(t *testing.T) {
+	tr := New(Config{Windows: []time.Duration{time.Minute}}, nil)
+	tr.Add(trade("MSFT", 10, 1, 0))
+
+	if snaps := tr.Snapshots(base.Add(30 * time.Second)); len(snaps) != 1 {
+		t.Fatalf("Expected a snapshot while the trade is in the window, got %+v", snaps)
+	}
+	if snaps := tr.Snapshots(base.Add(2 * time.Minute)); len(snaps) != 0 {
+		t.Fatalf("Expected no snapshot once the window has passed, got %+v", snaps)
+	}
+	if len(tr.series) != 0 {
+		t.Fatalf("Expected the quiet symbol to be forgotten")
+	}
+}
+
+func TestSnapshotLineProtocol(t *testing.T) {
+	s := Snapshot{Symbol: "AAPL", Window: time.Minute, At: base, Volume: 200, Trades: 2, VWAP: 10.5, High: 11, Low: 10, HasRange: true}
+	line := s.LineProtocol()
+	want := "alpaca_equities_streaming_stats,symbol=AAPL,window=1m volume=200,trade_count=2,avg_trade_size=100.000000,trades_per_sec=0.033333,vwap=10.500000,high=11.000000,low=10.000000,range=1.000000 1709303400000000000"
+	if line != want {
+		t.Errorf("LineProtocol() =\n%s\nwant\n%s", line, want)
+	}
+	if !strings.HasPrefix(line, Measurement+",") {
+		t.Errorf("Unexpected measurement in %s", line)
+	}
+}
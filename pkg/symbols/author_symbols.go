@@ -1,79 +1,272 @@
 package author_symbols
 
 import (
-	"log"
-    "crypto/tls"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go-alpaca-streaming/pkg/metrics"
+
 	"github.com/xitongsys/parquet-go-source/local"
-    "github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/reader"
 )
 
-
 type Symbol struct {
-    Symbol string `parquet:"name=symbol, type=UTF8"`
+	Symbol string `parquet:"name=symbol, type=UTF8"`
+}
+
+const (
+	// DefaultAuthorURL is the author symbols dataset endpoint.
+	DefaultAuthorURL = "https://algotrading.ventures/datastreaming/v1/datasets/author_symbols"
+	// DefaultLocalPath is the fallback parquet file.
+	DefaultLocalPath = "/data/deriv_symbols_used.parquet"
+	// DefaultMaxLocal is the most symbols read from a local file.
+	DefaultMaxLocal = 500
+)
+
+// HTTP fetches symbols from a datasets endpoint that returns a JSON array
+// of strings, such as the author symbols endpoint. Network errors and 5xx
+// or 429 responses are retried with backoff, and the payload is validated
+// before it is used.
+type HTTP struct {
+	URL string
+	// Token, when set, is sent as a bearer token.
+	Token string
+	// Timeout bounds each request; DefaultTimeout when not positive.
+	Timeout time.Duration
+	// Retries is how many times a failed request is retried.
+	Retries int
+	// InitialBackoff is the wait before the first retry, doubled after
+	// each; one second when not positive.
+	InitialBackoff time.Duration
+	// MaxSymbols caps the list; DefaultMaxSymbols when not positive.
+	MaxSymbols int
+	// MaxInvalidShare is the largest share of malformed entries a payload
+	// may have before it is rejected; DefaultMaxInvalidShare when not
+	// positive.
+	MaxInvalidShare float64
+	// InsecureSkipVerify skips TLS certificate verification.
+	InsecureSkipVerify bool
+	// Client is the HTTP client; one built from the fields above when nil.
+	Client *http.Client
 }
 
-const maxLocalSymbols = 500  // Constant to define max number of symbols
+const (
+	// DefaultTimeout bounds each request to the datasets endpoint.
+	DefaultTimeout = 10 * time.Second
+	// DefaultMaxSymbols is the most symbols used from the endpoint.
+	DefaultMaxSymbols = 10000
+	// DefaultRetries is how often the configuration retries a request.
+	DefaultRetries = 3
+	// DefaultMaxInvalidShare is the largest share of malformed entries
+	// accepted in a payload.
+	DefaultMaxInvalidShare = 0.05
+)
+
+// ErrNotModified is returned by SymbolsIfChanged when the list hasn't
+// changed since the given version.
+var ErrNotModified = errors.New("not modified")
 
+// symbolPattern is what a valid ticker looks like, share classes and
+// when-issued suffixes included, such as BRK.B or ABC-WI.
+var symbolPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9./-]{0,20}$`)
 
-func GetAuthorSymbols() ([]string, error) {
-    var symbols []string
+var (
+	fetchRetries   = metrics.Counter("symbols_fetch_retries_total")
+	notModifiedHit = metrics.Counter("symbols_not_modified_total")
+	invalidSymbols = metrics.Counter("symbols_invalid_total")
+)
 
-    // Create a custom HTTP client
-    tr := &http.Transport{
-        TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-    }
-    client := &http.Client{Transport: tr}
+func (h HTTP) Name() string { return "author symbols endpoint" }
 
+func (h HTTP) Symbols(ctx context.Context) ([]string, error) {
+	symbols, _, err := h.SymbolsIfChanged(ctx, "")
+	return symbols, err
+}
 
-    // Perform the HTTP request
-    response, err := client.Get("https://algotrading.ventures/datastreaming/v1/datasets/author_symbols")
-    if err != nil {
-        return nil, err
-    }
-    defer response.Body.Close()
+// SymbolsIfChanged fetches the list unless its ETag still matches etag,
+// in which case it returns ErrNotModified. It also returns the new ETag,
+// empty if the server sends none.
+func (h HTTP) SymbolsIfChanged(ctx context.Context, etag string) ([]string, string, error) {
+	client := h.Client
+	if client == nil {
+		client = h.newClient()
+	}
+	backoff := h.InitialBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
 
-    err = json.NewDecoder(response.Body).Decode(&symbols)
-    if err != nil {
-        return nil, err
-    }
+	for attempt := 0; ; attempt++ {
+		symbols, newETag, retry, err := h.get(ctx, client, etag)
+		if err == nil || !retry || attempt >= h.Retries {
+			return symbols, newETag, err
+		}
+		log.Printf("Fetching symbols failed: %v. Retrying in %v.", err, backoff)
+		fetchRetries.Add(1)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+		backoff *= 2
+	}
+}
 
-    return symbols, nil
+func (h HTTP) newClient() *http.Client {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if h.InsecureSkipVerify {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{Transport: tr, Timeout: timeout}
 }
 
+// get makes one request. retry reports whether a failure may be temporary.
+func (h HTTP) get(ctx context.Context, client *http.Client, etag string) (symbols []string, newETag string, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, "", false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, "", ctx.Err() == nil, err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotModified && etag != "":
+		notModifiedHit.Add(1)
+		return nil, etag, false, ErrNotModified
+	case response.StatusCode != http.StatusOK:
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		err := fmt.Errorf("GET %s: %s: %s", h.URL, response.Status, strings.TrimSpace(string(body)))
+		return nil, "", response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests, err
+	}
 
-// Fallback to fetch symbols from local Parquet file
-func GetLocalSymbols() []string {
-    localFilePath := "/data/deriv_symbols_used.parquet"
-    fr, err := local.NewLocalFileReader(localFilePath)
-    if err != nil {
-        log.Fatal("Can't open local file: ", err)
-        return nil
-    }
-
-    pr, err := reader.NewParquetReader(fr, new(Symbol), 4)
-    if err != nil {
-        log.Fatal("Can't create parquet reader: ", err)
-        return nil
-    }
-
-    var symbols []string
-    symbolsBuffer := make([]Symbol, 1)
-
-    numRows := int(pr.GetNumRows())
-    if numRows > maxLocalSymbols {
-        numRows = maxLocalSymbols  // Limit to 500 symbols
-    }
-
-    for i := 0; i < numRows; i++ {
-        if err := pr.Read(&symbolsBuffer); err != nil {
-            log.Println("Read error: ", err)
-        }
-        symbols = append(symbols, symbolsBuffer[0].Symbol)
-    }
-
-    pr.ReadStop()
-    fr.Close()
-    return symbols
-}
\ No newline at end of file
+	var raw []string
+	if err := json.NewDecoder(response.Body).Decode(&raw); err != nil {
+		return nil, "", false, fmt.Errorf("malformed symbols payload from %s, want a JSON array of strings: %v", h.URL, err)
+	}
+	symbols, err = h.validate(raw)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("invalid symbols payload from %s: %v", h.URL, err)
+	}
+	return symbols, response.Header.Get("ETag"), false, nil
+}
+
+// validate drops, and logs, malformed symbols and duplicates, and caps
+// the list at MaxSymbols. It fails when more than MaxInvalidShare of the
+// entries are malformed, which points to a broken payload rather than a few
+// bad tickers, so that a cached list is used instead.
+func (h HTTP) validate(raw []string) ([]string, error) {
+	max := h.MaxSymbols
+	if max <= 0 {
+		max = DefaultMaxSymbols
+	}
+	maxInvalid := h.MaxInvalidShare
+	if maxInvalid <= 0 {
+		maxInvalid = DefaultMaxInvalidShare
+	}
+
+	var invalid []string
+	seen := make(map[string]bool, len(raw))
+	symbols := make([]string, 0, len(raw))
+	for _, s := range raw {
+		s = strings.TrimSpace(s)
+		if !symbolPattern.MatchString(s) {
+			invalid = append(invalid, fmt.Sprintf("%q", s))
+			continue
+		}
+		if !seen[s] {
+			seen[s] = true
+			symbols = append(symbols, s)
+		}
+	}
+
+	examples := invalid
+	if len(examples) > 3 {
+		examples = examples[:3]
+	}
+	switch {
+	case len(raw) == 0:
+		return nil, ErrNoSymbols
+	case float64(len(invalid)) > maxInvalid*float64(len(raw)):
+		return nil, fmt.Errorf("%d of %d symbols are malformed, such as %s", len(invalid), len(raw), strings.Join(examples, ", "))
+	case len(invalid) > 0:
+		invalidSymbols.Add(int64(len(invalid)))
+		log.Printf("Dropped %d malformed symbols from %s, such as %s.", len(invalid), h.URL, strings.Join(examples, ", "))
+	}
+	if dropped := len(raw) - len(invalid) - len(symbols); dropped > 0 {
+		log.Printf("Dropped %d duplicate symbols from %s.", dropped, h.URL)
+	}
+	if len(symbols) > max {
+		log.Printf("%s returned %d symbols; using the first %d.", h.URL, len(symbols), max)
+		symbols = symbols[:max]
+	}
+	return symbols, nil
+}
+
+// Parquet reads symbols from the symbol column of a local parquet file.
+type Parquet struct {
+	Path string
+	// Max is the most symbols read; DefaultMaxLocal when not positive.
+	Max int
+}
+
+func (p Parquet) Name() string { return "local parquet file" }
+
+func (p Parquet) Symbols(ctx context.Context) ([]string, error) {
+	fr, err := local.NewLocalFileReader(p.Path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open %s: %v", p.Path, err)
+	}
+	defer fr.Close()
+
+	pr, err := reader.NewParquetReader(fr, new(Symbol), 4)
+	if err != nil {
+		return nil, fmt.Errorf("can't create parquet reader for %s: %v", p.Path, err)
+	}
+	defer pr.ReadStop()
+
+	numRows := int(pr.GetNumRows())
+	if max := limit(p.Max); numRows > max {
+		numRows = max // Limit to Max symbols
+	}
+
+	rows := make([]Symbol, numRows)
+	if err := pr.Read(&rows); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", p.Path, err)
+	}
+	symbols := make([]string, len(rows))
+	for i, row := range rows {
+		symbols[i] = row.Symbol
+	}
+	return clean(symbols), nil
+}
+
+func limit(max int) int {
+	if max <= 0 {
+		return DefaultMaxLocal
+	}
+	return max
+}
@@ -0,0 +1,142 @@
+package author_symbols
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPRetriesAndAuthenticates(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Missing bearer token: %v", r.Header)
+		}
+		if requests.Add(1) == 1 {
+			http.Error(w, "try again", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`["AAPL","MSFT","AAPL","BRK.B"]`))
+	}))
+	defer srv.Close()
+
+	h := HTTP{URL: srv.URL, Token: "token", Retries: 2, InitialBackoff: time.Millisecond}
+	symbols, err := h.Symbols(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(symbols, ",") != "AAPL,MSFT,BRK.B" {
+		t.Errorf("Expected duplicates dropped, got %v", symbols)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("Expected one retry, got %d requests", requests.Load())
+	}
+}
+
+func TestHTTPRejectsBadPayloads(t *testing.T) {
+	for name, tc := range map[string]struct {
+		body string
+		want string
+	}{
+		"not an array":   {body: `{"symbols":["AAPL"]}`, want: "malformed symbols payload"},
+		"not strings":    {body: `[1,2]`, want: "malformed symbols payload"},
+		"mostly invalid": {body: `["AAPL","<html>","</html>"]`, want: `2 of 3 symbols are malformed, such as "<html>"`},
+		"too many bad":   {body: `["AAPL","MSFT","SPY","QQQ","<html>"]`, want: `1 of 5 symbols are malformed`},
+		"client error":   {body: "", want: "404"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var requests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				if tc.body == "" {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			_, err := HTTP{URL: srv.URL, Retries: 3}.Symbols(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Expected an error containing %q, got %v", tc.want, err)
+			}
+			if requests.Load() != 1 {
+				t.Errorf("Expected no retries, got %d requests", requests.Load())
+			}
+		})
+	}
+}
+
+func TestHTTPDropsBadSymbols(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`["AAPL","<html>","MSFT","SPY","QQQ"]`))
+	}))
+	defer srv.Close()
+
+	symbols, err := HTTP{URL: srv.URL, MaxSymbols: 3, MaxInvalidShare: 0.25}.Symbols(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(symbols, ",") != "AAPL,MSFT,SPY" {
+		t.Errorf("Expected the bad symbol dropped and the list capped, got %v", symbols)
+	}
+}
+
+func TestCachedKeepsListWhenPayloadIsRejected(t *testing.T) {
+	body := `["AAPL","MSFT"]`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "symbols.json")
+	cached := Cached{Provider: HTTP{URL: srv.URL}, Path: path, MaxAge: time.Hour}
+	if _, err := cached.Symbols(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	body = `["AAPL","<html>","MSFT"]`
+	symbols, err := cached.Symbols(context.Background())
+	if err != nil || strings.Join(symbols, ",") != "AAPL,MSFT" {
+		t.Fatalf("Expected the cached list, got %v, %v", symbols, err)
+	}
+	if f, err := cached.read(); err != nil || strings.Join(f.Symbols, ",") != "AAPL,MSFT" {
+		t.Errorf("Expected the cache to be kept, got %+v, %v", f, err)
+	}
+}
+
+func TestCachedSendsETag(t *testing.T) {
+	var notModified atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`["AAPL","MSFT"]`))
+	}))
+	defer srv.Close()
+
+	cached := Cached{Provider: HTTP{URL: srv.URL}, Path: filepath.Join(t.TempDir(), "symbols.json"), MaxAge: time.Hour}
+	for i := 0; i < 2; i++ {
+		symbols, err := cached.Symbols(context.Background())
+		if err != nil || strings.Join(symbols, ",") != "AAPL,MSFT" {
+			t.Fatalf("Fetch %d: got %v, %v", i, symbols, err)
+		}
+	}
+	if notModified.Load() != 1 {
+		t.Errorf("Expected the second fetch to be conditional, got %d not modified", notModified.Load())
+	}
+
+	// Asked directly, the provider reports the list unchanged.
+	if _, _, err := (HTTP{URL: srv.URL}).SymbolsIfChanged(context.Background(), `"v1"`); !errors.Is(err, ErrNotModified) {
+		t.Errorf("Expected ErrNotModified, got %v", err)
+	}
+}
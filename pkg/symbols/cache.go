@@ -0,0 +1,133 @@
+package author_symbols
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheFile is the content of a Cached provider's file.
+type cacheFile struct {
+	Fetched time.Time `json:"fetched"`
+	Source  string    `json:"source"`
+	// ETag versions the list, for providers that support conditional
+	// requests.
+	ETag    string   `json:"etag,omitempty"`
+	Symbols []string `json:"symbols"`
+}
+
+// conditional is a Provider that can skip downloading a list that hasn't
+// changed, such as HTTP.
+type conditional interface {
+	SymbolsIfChanged(ctx context.Context, etag string) ([]string, string, error)
+}
+
+// Cached saves every list its Provider returns to a file, and uses the
+// saved list when the provider fails, as long as it isn't older than
+// MaxAge. A recent list from the endpoint is a better fallback than a
+// static file that may be months old.
+type Cached struct {
+	Provider Provider
+	Path     string
+	MaxAge   time.Duration
+	// ReadOnly uses the saved list but never writes it, for commands that
+	// only look at the symbols.
+	ReadOnly bool
+}
+
+func (c Cached) Name() string { return c.Provider.Name() + " (or its cache)" }
+
+func (c Cached) Symbols(ctx context.Context) ([]string, error) {
+	var symbols []string
+	var etag string
+	var err error
+	if p, ok := c.Provider.(conditional); ok {
+		// An unchanged list is taken from the cache, however old it is.
+		prev, prevErr := c.read()
+		if prevErr != nil || len(prev.Symbols) == 0 {
+			prev = cacheFile{}
+		}
+		symbols, etag, err = p.SymbolsIfChanged(ctx, prev.ETag)
+		if errors.Is(err, ErrNotModified) {
+			log.Printf("Symbols from %s unchanged since %s.", c.Provider.Name(), prev.Fetched.Format(time.RFC3339))
+			symbols, err = prev.Symbols, nil
+		}
+	} else {
+		symbols, err = c.Provider.Symbols(ctx)
+	}
+	if err == nil && len(symbols) == 0 {
+		err = ErrNoSymbols
+	}
+	if err == nil {
+		if c.ReadOnly {
+			return symbols, nil
+		}
+		if err := c.save(symbols, etag); err != nil {
+			log.Printf("Failed to cache symbols: %v", err)
+		}
+		return symbols, nil
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+
+	cached, cacheErr := c.load()
+	if cacheErr != nil {
+		return nil, fmt.Errorf("%w; cache: %v", err, cacheErr)
+	}
+	log.Printf("%s failed (%v); using %d symbols cached from %s at %s.",
+		c.Provider.Name(), err, len(cached.Symbols), cached.Source, cached.Fetched.Format(time.RFC3339))
+	return cached.Symbols, nil
+}
+
+func (c Cached) save(symbols []string, etag string) error {
+	data, err := json.MarshalIndent(cacheFile{
+		Fetched: time.Now().UTC(),
+		Source:  c.Provider.Name(),
+		ETag:    etag,
+		Symbols: symbols,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0o755); err != nil {
+		return err
+	}
+	tmp := c.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.Path)
+}
+
+func (c Cached) read() (cacheFile, error) {
+	var f cacheFile
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("%s: %v", c.Path, err)
+	}
+	return f, nil
+}
+
+// load reads the cache, failing if it is missing, empty or too old.
+func (c Cached) load() (cacheFile, error) {
+	f, err := c.read()
+	if err != nil {
+		return f, err
+	}
+	if len(f.Symbols) == 0 {
+		return f, ErrNoSymbols
+	}
+	if age := time.Since(f.Fetched); c.MaxAge > 0 && age > c.MaxAge {
+		return f, fmt.Errorf("fetched %v ago, older than %v", age.Round(time.Minute), c.MaxAge)
+	}
+	return f, nil
+}
@@ -0,0 +1,67 @@
+package author_symbols
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flaky is a provider that fails when err is set.
+type flaky struct {
+	symbols []string
+	err     error
+}
+
+func (f *flaky) Name() string { return "flaky" }
+
+func (f *flaky) Symbols(ctx context.Context) ([]string, error) { return f.symbols, f.err }
+
+func TestCachedFallsBackToLastList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "symbols.json")
+	source := &flaky{symbols: []string{"AAPL", "MSFT"}}
+	cached := Cached{Provider: source, Path: path, MaxAge: time.Hour}
+
+	if _, err := cached.Symbols(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	source.err = errors.New("endpoint down")
+	symbols, err := cached.Symbols(context.Background())
+	if err != nil || strings.Join(symbols, ",") != "AAPL,MSFT" {
+		t.Fatalf("Expected the cached list, got %v, %v", symbols, err)
+	}
+
+	// A cache older than MaxAge is not used, so the chain moves on.
+	data, _ := json.Marshal(cacheFile{Fetched: time.Now().Add(-2 * time.Hour), Source: "flaky", Symbols: symbols})
+	os.WriteFile(path, data, 0o644)
+	if _, err := cached.Symbols(context.Background()); err == nil || !strings.Contains(err.Error(), "older than") {
+		t.Errorf("Expected a stale cache error, got %v", err)
+	}
+}
+
+func TestReadOnlyCacheIsNotWritten(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "symbols.json")
+	source := &flaky{symbols: []string{"AAPL"}}
+	cached := Cached{Provider: source, Path: path, MaxAge: time.Hour, ReadOnly: true}
+
+	if _, err := cached.Symbols(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected no cache file, got %v", err)
+	}
+
+	// A cache written by someone else is still used.
+	data, _ := json.Marshal(cacheFile{Fetched: time.Now(), Source: "flaky", Symbols: []string{"MSFT"}})
+	os.WriteFile(path, data, 0o644)
+	source.err = errors.New("endpoint down")
+	symbols, err := cached.Symbols(context.Background())
+	if err != nil || strings.Join(symbols, ",") != "MSFT" {
+		t.Fatalf("Expected the cached list, got %v, %v", symbols, err)
+	}
+}
@@ -0,0 +1,31 @@
+package author_symbols
+
+import "strings"
+
+// Normalize brings symbols into the form Alpaca uses: trimmed, upper case
+// and with a share class after a dot, so BRK/B and brk b become BRK.B.
+// Empty symbols and repeats are dropped; the order is kept.
+func Normalize(symbols []string) []string {
+	seen := make(map[string]bool, len(symbols))
+	out := make([]string, 0, len(symbols))
+	for _, s := range symbols {
+		s = NormalizeSymbol(s)
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		out = append(out, s)
+	}
+	return out
+}
+
+// NormalizeSymbol normalizes a single symbol; see Normalize.
+func NormalizeSymbol(s string) string {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == ' ' {
+			return '.'
+		}
+		return r
+	}, s)
+}
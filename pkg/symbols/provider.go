@@ -0,0 +1,235 @@
+package author_symbols
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Provider is a source of symbols to subscribe to.
+type Provider interface {
+	// Name describes the source in logs.
+	Name() string
+	// Symbols returns the symbols, or an error if the source has none.
+	Symbols(ctx context.Context) ([]string, error)
+}
+
+// ErrNoSymbols is returned by a source that worked but had no symbols.
+var ErrNoSymbols = errors.New("no symbols")
+
+// Static is a fixed list of symbols, such as one from the configuration.
+type Static []string
+
+func (s Static) Name() string { return "configuration" }
+
+func (s Static) Symbols(ctx context.Context) ([]string, error) {
+	if symbols := clean(s); len(symbols) > 0 {
+		return symbols, nil
+	}
+	return nil, ErrNoSymbols
+}
+
+// Env reads a comma-separated list of symbols from the environment
+// variable it names.
+type Env string
+
+func (e Env) Name() string { return "environment variable " + string(e) }
+
+func (e Env) Symbols(ctx context.Context) ([]string, error) {
+	value, ok := os.LookupEnv(string(e))
+	if !ok {
+		return nil, fmt.Errorf("%s is not set", string(e))
+	}
+	if symbols := clean(strings.Split(value, ",")); len(symbols) > 0 {
+		return symbols, nil
+	}
+	return nil, ErrNoSymbols
+}
+
+// CSV reads symbols from a CSV file. With a header row that has a symbol
+// column, that column is used; otherwise the first column of every row.
+type CSV struct {
+	Path string
+	// Max is the most symbols read; DefaultMaxLocal when not positive.
+	Max int
+}
+
+func (c CSV) Name() string { return "CSV file " + c.Path }
+
+func (c CSV) Symbols(ctx context.Context) ([]string, error) {
+	f, err := os.Open(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	column := 0
+	var symbols []string
+	for first := true; len(symbols) < limit(c.Max); first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", c.Path, err)
+		}
+		if first {
+			if i := header(record); i >= 0 {
+				column = i
+				continue
+			}
+		}
+		if column < len(record) {
+			symbols = append(symbols, record[column])
+		}
+	}
+
+	if symbols = clean(symbols); len(symbols) > 0 {
+		return symbols, nil
+	}
+	return nil, ErrNoSymbols
+}
+
+// header returns the index of the symbol column if record is a header row,
+// or -1.
+func header(record []string) int {
+	for i, field := range record {
+		if strings.EqualFold(strings.TrimSpace(field), "symbol") {
+			return i
+		}
+	}
+	return -1
+}
+
+// clean trims the symbols and drops empty ones.
+func clean(symbols []string) []string {
+	var out []string
+	for _, s := range symbols {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Chain tries its providers in order and uses the first that has symbols.
+type Chain []Provider
+
+func (c Chain) Name() string {
+	names := make([]string, len(c))
+	for i, p := range c {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, ", then ")
+}
+
+func (c Chain) Symbols(ctx context.Context) ([]string, error) {
+	symbols, _, err := c.Resolve(ctx)
+	return symbols, err
+}
+
+// Resolve returns the symbols of the first provider that has any, and its
+// name. Failures before it are logged; if every provider fails, the error
+// lists them all.
+func (c Chain) Resolve(ctx context.Context) ([]string, string, error) {
+	var errs []error
+	for _, p := range c {
+		symbols, err := p.Symbols(ctx)
+		if err == nil && len(symbols) == 0 {
+			err = ErrNoSymbols
+		}
+		if err == nil {
+			return symbols, p.Name(), nil
+		}
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		log.Printf("No symbols from %s: %v", p.Name(), err)
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+	}
+	if len(errs) == 0 {
+		return nil, "", errors.New("no symbol sources configured")
+	}
+	return nil, "", fmt.Errorf("no symbol source succeeded: %w", errors.Join(errs...))
+}
+
+// Sources holds the settings NewChain builds providers from.
+type Sources struct {
+	// Static is the list for the static source. The source is left out of
+	// the chain when the list is empty.
+	Static []string
+	// EnvVar names the variable read by the env source.
+	EnvVar string
+	// Author is the author source: its URL and request settings.
+	Author HTTP
+	// CachePath, when set, keeps the last list the author source returned,
+	// to fall back on while it is younger than CacheMaxAge.
+	CachePath   string
+	CacheMaxAge time.Duration
+	// CacheReadOnly uses the cache without ever writing it.
+	CacheReadOnly bool
+	// ParquetPath and CSVPath are the files of the parquet and csv sources.
+	ParquetPath string
+	CSVPath     string
+	// MaxLocal caps the symbols read from a file.
+	MaxLocal int
+}
+
+// SourceNames lists the names NewChain accepts.
+var SourceNames = []string{"static", "env", "author", "parquet", "csv"}
+
+// NewChain builds a chain of the named sources, in order.
+func NewChain(names []string, src Sources) (Chain, error) {
+	var chain Chain
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "static":
+			if len(src.Static) > 0 {
+				chain = append(chain, Static(src.Static))
+			}
+		case "env":
+			if src.EnvVar == "" {
+				return nil, errors.New("the env symbol source needs a variable name")
+			}
+			chain = append(chain, Env(src.EnvVar))
+		case "author":
+			if src.Author.URL == "" {
+				return nil, errors.New("the author symbol source needs a URL")
+			}
+			var p Provider = src.Author
+			if src.CachePath != "" {
+				p = Cached{Provider: p, Path: src.CachePath, MaxAge: src.CacheMaxAge, ReadOnly: src.CacheReadOnly}
+			}
+			chain = append(chain, p)
+		case "parquet":
+			if src.ParquetPath == "" {
+				return nil, errors.New("the parquet symbol source needs a path")
+			}
+			chain = append(chain, Parquet{Path: src.ParquetPath, Max: src.MaxLocal})
+		case "csv":
+			if src.CSVPath == "" {
+				return nil, errors.New("the csv symbol source needs a path")
+			}
+			chain = append(chain, CSV{Path: src.CSVPath, Max: src.MaxLocal})
+		default:
+			return nil, fmt.Errorf("unknown symbol source %q, want one of %s", name, strings.Join(SourceNames, ", "))
+		}
+	}
+	return chain, nil
+}
+
+// Default is the chain used when none is configured: the author symbols
+// endpoint, then the local parquet file.
+func Default() Chain {
+	return Chain{HTTP{URL: DefaultAuthorURL, Retries: DefaultRetries}, Parquet{Path: DefaultLocalPath}}
+}
@@ -0,0 +1,87 @@
+package author_symbols
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChainFallsBack(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	t.Setenv("TEST_SYMBOLS", " aapl, MSFT ,,")
+	chain := Chain{
+		Parquet{Path: filepath.Join(t.TempDir(), "missing.parquet")},
+		HTTP{URL: srv.URL},
+		Env("TEST_SYMBOLS"),
+		Static{"SPY"},
+	}
+	symbols, source, err := chain.Resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(symbols, ",") != "aapl,MSFT" || source != "environment variable TEST_SYMBOLS" {
+		t.Errorf("Got %v from %s", symbols, source)
+	}
+}
+
+func TestChainReturnsEveryError(t *testing.T) {
+	chain := Chain{Env("TEST_SYMBOLS_UNSET"), Static{}}
+	_, _, err := chain.Resolve(context.Background())
+	if err == nil {
+		t.Fatal("Expected an error when no source has symbols")
+	}
+	if !errors.Is(err, ErrNoSymbols) || !strings.Contains(err.Error(), "TEST_SYMBOLS_UNSET is not set") {
+		t.Errorf("Expected both failures in %v", err)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	dir := t.TempDir()
+	withHeader := filepath.Join(dir, "header.csv")
+	os.WriteFile(withHeader, []byte("name,symbol\nApple,AAPL\nMicrosoft,MSFT\nTesla,TSLA\n"), 0o644)
+	plain := filepath.Join(dir, "plain.csv")
+	os.WriteFile(plain, []byte("AAPL\nMSFT\n"), 0o644)
+
+	symbols, err := CSV{Path: withHeader, Max: 2}.Symbols(context.Background())
+	if err != nil || strings.Join(symbols, ",") != "AAPL,MSFT" {
+		t.Errorf("Got %v, %v from the symbol column", symbols, err)
+	}
+	symbols, err = CSV{Path: plain}.Symbols(context.Background())
+	if err != nil || strings.Join(symbols, ",") != "AAPL,MSFT" {
+		t.Errorf("Got %v, %v from the first column", symbols, err)
+	}
+}
+
+func TestNewChain(t *testing.T) {
+	src := Sources{EnvVar: "X", Author: HTTP{URL: "http://example.com"}, ParquetPath: "s.parquet"}
+	chain, err := NewChain([]string{"static", "env", "author", "parquet"}, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An empty static list is left out.
+	if len(chain) != 3 {
+		t.Errorf("Expected 3 providers, got %s", chain.Name())
+	}
+	if _, err := NewChain([]string{"csv"}, src); err == nil {
+		t.Error("Expected csv without a path to fail")
+	}
+	if _, err := NewChain([]string{"ftp"}, src); err == nil {
+		t.Error("Expected an unknown source to fail")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	got := Normalize([]string{" aapl", "BRK/B", "brk.b", "", "BF B", "MSFT", "AAPL"})
+	if want := "AAPL,BRK.B,BF.B,MSFT"; strings.Join(got, ",") != want {
+		t.Errorf("Got %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+package telegraf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ValidateLineProtocol parses a single line of InfluxDB line protocol,
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// and describes the first problem it finds. Backslash escapes are honoured
+// in names and tags, and field values must be a float, an integer (i), an
+// unsigned integer (u), a boolean or a double-quoted string.
+func ValidateLineProtocol(line string) error {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.TrimSpace(line) == "" {
+		return errors.New("empty line")
+	}
+
+	measurement, i := scanUntil(line, 0, ", ")
+	if measurement == "" {
+		return errors.New("missing measurement")
+	}
+
+	// Tags
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		key, i = scanUntil(line, i+1, "=, ")
+		if key == "" {
+			return fmt.Errorf("empty tag key at column %d", i+1)
+		}
+		if i >= len(line) || line[i] != '=' {
+			return fmt.Errorf("tag %q has no value", key)
+		}
+		value, i = scanUntil(line, i+1, ", ")
+		if value == "" {
+			return fmt.Errorf("tag %q has an empty value", key)
+		}
+	}
+
+	if i >= len(line) || line[i] != ' ' {
+		return errors.New("missing field set")
+	}
+	i++
+
+	// Fields
+	for {
+		var key string
+		key, i = scanUntil(line, i, "=, ")
+		if key == "" {
+			return fmt.Errorf("empty field key at column %d", i+1)
+		}
+		if i >= len(line) || line[i] != '=' {
+			return fmt.Errorf("field %q has no value", key)
+		}
+		i++
+
+		var value string
+		var err error
+		if i < len(line) && line[i] == '"' {
+			value, i, err = scanString(line, i)
+			if err != nil {
+				return fmt.Errorf("field %q: %w", key, err)
+			}
+		} else {
+			value, i = scanUntil(line, i, ", ")
+			if err := validateFieldValue(value); err != nil {
+				return fmt.Errorf("field %q: %w", key, err)
+			}
+		}
+
+		if i < len(line) && line[i] == ',' {
+			i++
+			continue
+		}
+		break
+	}
+
+	if i == len(line) {
+		return nil // no timestamp; the server assigns one
+	}
+	if line[i] != ' ' {
+		return fmt.Errorf("unexpected %q at column %d", line[i], i+1)
+	}
+
+	timestamp := line[i+1:]
+	if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	return nil
+}
+
+// scanUntil returns the text from start up to the first unescaped byte in
+// stops, and the index of that byte.
+func scanUntil(line string, start int, stops string) (string, int) {
+	i := start
+	for i < len(line) {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) {
+			i += 2
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		i++
+	}
+	return line[start:i], i
+}
+
+// scanString reads a double-quoted string field starting at the opening quote.
+func scanString(line string, start int) (string, int, error) {
+	i := start + 1
+	for i < len(line) {
+		switch line[i] {
+		case '\\':
+			i += 2
+			continue
+		case '"':
+			return line[start : i+1], i + 1, nil
+		}
+		i++
+	}
+	return "", i, errors.New("unterminated string")
+}
+
+func validateFieldValue(value string) error {
+	if value == "" {
+		return errors.New("empty value")
+	}
+
+	switch value {
+	case "t", "T", "true", "True", "TRUE", "f", "F", "false", "False", "FALSE":
+		return nil
+	}
+
+	switch value[len(value)-1] {
+	case 'i':
+		if _, err := strconv.ParseInt(value[:len(value)-1], 10, 64); err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		return nil
+	case 'u':
+		if _, err := strconv.ParseUint(value[:len(value)-1], 10, 64); err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", value)
+		}
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value %q (strings must be double-quoted)", value)
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("%q is not a finite number", value)
+	}
+	return nil
+}
+
+var tagEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `)
+
+// EscapeTag escapes a tag key or value for line protocol.
+func EscapeTag(s string) string {
+	return tagEscaper.Replace(s)
+}
@@ -0,0 +1,46 @@
+package telegraf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLineProtocol(t *testing.T) {
+	valid := []string{
+		`trades,symbol=AAPL price=101.5,size=100i 1709303400123456789`,
+		`trades price=1`,
+		`trades,exchange=New\ York\,NY price=1e3,volume=7u`,
+		`trades,symbol=AAPL conditions="@ T",odd_lot=true`,
+		`trades,symbol=AAPL note="say \"hi\", ok",flag=F 1`,
+	}
+	for _, line := range valid {
+		if err := ValidateLineProtocol(line); err != nil {
+			t.Errorf("ValidateLineProtocol(%q) = %v, want nil", line, err)
+		}
+	}
+
+	invalid := map[string]string{
+		``:                                   "empty",
+		`trades`:                             "missing field set",
+		`trades,symbol price=1`:              "no value",
+		`trades,symbol= price=1`:             "empty value",
+		`trades,symbol=AAPL price=abc`:       "invalid value",
+		`trades,symbol=AAPL size=1.5i`:       "invalid integer",
+		`trades,symbol=AAPL size=-1u`:        "invalid unsigned",
+		`trades,symbol=AAPL note="open`:      "unterminated",
+		`trades,symbol=AAPL price=1 soon`:    "invalid timestamp",
+		`trades,symbol=AAPL price=1,=2`:      "empty field key",
+		`trades,symbol=AAPL price=NaN`:       "finite",
+		`trades,symbol=AAPL price=1 1 extra`: "invalid timestamp",
+	}
+	for line, want := range invalid {
+		err := ValidateLineProtocol(line)
+		if err == nil {
+			t.Errorf("ValidateLineProtocol(%q) = nil, want error containing %q", line, want)
+			continue
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("ValidateLineProtocol(%q) = %v, want error containing %q", line, err, want)
+		}
+	}
+}
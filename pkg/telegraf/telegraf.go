@@ -6,7 +6,7 @@ import (
 	"log"
 	"math"
 	"net"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,13 +15,44 @@ var telegrafPort string = "8094"
 var maxRetries int = 5
 var initialBackoff time.Duration = 100 * time.Millisecond
 
+// Configure overrides the connection settings. Zero values keep the current
+// setting. Call it before SetupTelegrafConnection.
+func Configure(host, port string, retries int, backoff time.Duration) {
+	if host != "" {
+		telegrafHost = host
+	}
+	if port != "" {
+		telegrafPort = port
+	}
+	if retries > 0 {
+		maxRetries = retries
+	}
+	if backoff > 0 {
+		initialBackoff = backoff
+	}
+}
+
+// connMu guards sharedConn. It is held for one line's write at a time, so
+// lines from concurrent callers never interleave, but never while sleeping
+// or dialing, so one worker's retries don't stall the others.
+var connMu sync.Mutex
 var sharedConn net.Conn
 
+var errNotConnected = errors.New("Telegraf connection is not established")
+
+// telegrafAddr returns the host:port to dial.
+func telegrafAddr() string {
+	return net.JoinHostPort(telegrafHost, telegrafPort)
+}
+
 func SetupTelegrafConnection() {
+	connMu.Lock()
+	defer connMu.Unlock()
+
 	var err error
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		sharedConn, err = net.Dial("tcp", fmt.Sprintf("%s:%s", telegrafHost, telegrafPort))
+		sharedConn, err = net.Dial("tcp", telegrafAddr())
 		if err == nil {
 			return // Connection successful
 		}
@@ -37,42 +68,43 @@ func SetupTelegrafConnection() {
 }
 
 func SendToTelegraf(processedData []string) error {
-	if sharedConn == nil {
+	connMu.Lock()
+	connected := sharedConn != nil
+	connMu.Unlock()
+	if !connected {
 		log.Println("Telegraf connection is not established.")
-		return errors.New("Telegraf connection is not established")
+		return errNotConnected
 	}
 
 	for _, lineData := range processedData {
 		var err error
 		for attempt := 0; attempt < maxRetries; attempt++ {
-			_, err = fmt.Fprintf(sharedConn, "%s\n", lineData)
+			var conn net.Conn
+			conn, err = writeLine(lineData)
 			if err == nil {
 				break // Write successful
 			}
+			if conn == nil {
+				return err
+			}
+
+			backoff := time.Duration(math.Pow(2, float64(attempt))) * initialBackoff
 
 			// If we get a network error, the connection might be broken
 			if netErr, ok := err.(net.Error); ok {
 				log.Printf("Network error writing to Telegraf (attempt %d/%d): %v",
 					attempt+1, maxRetries, netErr)
 
-				// Try to re-establish connection
-				closeErr := sharedConn.Close()
-				if closeErr != nil {
-					log.Printf("Error closing broken connection: %v", closeErr)
-				}
-
 				// Exponential backoff before reconnecting
-				backoff := time.Duration(math.Pow(2, float64(attempt))) * initialBackoff
 				time.Sleep(backoff)
 
-				reconnectErr := reconnectTelegraf()
+				reconnectErr := replaceConn(conn)
 				if reconnectErr != nil {
 					// If reconnection fails, return the original error
 					return err
 				}
 			} else {
 				// Not a network error, just retry the write
-				backoff := time.Duration(math.Pow(2, float64(attempt))) * initialBackoff
 				log.Printf("Failed to write data to Telegraf (attempt %d/%d): %v. Retrying in %v...",
 					attempt+1, maxRetries, err, backoff)
 				time.Sleep(backoff)
@@ -89,13 +121,57 @@ func SendToTelegraf(processedData []string) error {
 	return nil
 }
 
-// reconnectTelegraf attempts to re-establish the connection to Telegraf
+// writeLine writes one line on the shared connection and returns the
+// connection it used, nil if there is none.
+func writeLine(line string) (net.Conn, error) {
+	connMu.Lock()
+	defer connMu.Unlock()
+
+	if sharedConn == nil {
+		return nil, errNotConnected
+	}
+	_, err := fmt.Fprintf(sharedConn, "%s\n", line)
+	return sharedConn, err
+}
+
+// reconnectTelegraf attempts to re-establish the connection to Telegraf.
 func reconnectTelegraf() error {
+	return replaceConn(nil)
+}
+
+// replaceConn dials Telegraf, retrying with backoff, and makes the new
+// connection the shared one. broken is the connection a write failed on;
+// if another caller has replaced it in the meantime, its connection is
+// kept and the new one closed. connMu is only held to swap connections.
+func replaceConn(broken net.Conn) error {
 	var err error
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		sharedConn, err = net.Dial("tcp", fmt.Sprintf("%s:%s", telegrafHost, telegrafPort))
+		connMu.Lock()
+		replaced := broken != nil && sharedConn != broken
+		connMu.Unlock()
+		if replaced {
+			return nil
+		}
+
+		var conn net.Conn
+		conn, err = net.Dial("tcp", telegrafAddr())
 		if err == nil {
+			connMu.Lock()
+			old := sharedConn
+			replaced = broken != nil && old != broken
+			if !replaced {
+				sharedConn = conn
+			}
+			connMu.Unlock()
+
+			if replaced {
+				conn.Close()
+				return nil
+			}
+			if old != nil {
+				old.Close()
+			}
 			log.Println("Successfully reconnected to Telegraf")
 			return nil
 		}
@@ -110,6 +186,9 @@ func reconnectTelegraf() error {
 }
 
 func CloseTelegrafConnection() {
+	connMu.Lock()
+	defer connMu.Unlock()
+
 	if sharedConn != nil {
 		sharedConn.Close()
 	}
@@ -119,11 +198,5 @@ func CloseTelegrafConnection() {
 
 // IsValidLineProtocol validates if the given string conforms to InfluxDB Line Protocol.
 func IsValidLineProtocol(line string) bool {
-	// A very basic check to see if the line contains essential components:
-	// measurement, field-key, field-value, and timestamp.
-	// For more rigorous validation, you might want to use regex or more advanced parsing.
-	if strings.Count(line, ",") > 0 && strings.Count(line, "=") > 0 && strings.Count(line, " ") > 0 {
-		return true
-	}
-	return false
+	return ValidateLineProtocol(line) == nil
 }
@@ -269,3 +269,33 @@ func TestReconnectTelegrafFailure(t *testing.T) {
 		t.Fatal("Expected reconnection to fail, but it succeeded")
 	}
 }
+
+// refusingConn fails every write with an error that isn't a network error.
+type refusingConn struct{ net.Conn }
+
+func (refusingConn) Write([]byte) (int, error) { return 0, fmt.Errorf("refused") }
+
+func TestSendToTelegrafDoesNotHoldLockWhileRetrying(t *testing.T) {
+	connMu.Lock()
+	sharedConn = refusingConn{}
+	connMu.Unlock()
+	defer func() {
+		connMu.Lock()
+		sharedConn = nil
+		connMu.Unlock()
+	}()
+
+	done := make(chan error)
+	go func() { done <- SendToTelegraf([]string{"cpu usage=0.5"}) }()
+
+	// While the sender backs off, other workers can still write.
+	time.Sleep(50 * time.Millisecond)
+	if !connMu.TryLock() {
+		t.Fatal("Expected the connection to be free while the sender backs off")
+	}
+	connMu.Unlock()
+
+	if err := <-done; err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+}
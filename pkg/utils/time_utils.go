@@ -2,6 +2,7 @@ package utils
 
 import (
 	"log"
+	"strings"
 	"time"
 )
 
@@ -10,8 +11,6 @@ func SleepForSeconds(seconds time.Duration) {
 	time.Sleep(time.Second * seconds)
 }
 
-
-
 // ParseStrConvertToEpochNs converts a time string in RFC3339 format to epoch time in nanoseconds.
 func ParseStrConvertToEpochNs(timeStr string) int64 {
 	t, err := time.Parse(time.RFC3339, timeStr)
@@ -23,4 +22,17 @@ func ParseStrConvertToEpochNs(timeStr string) int64 {
 	}
 
 	return t.UnixNano()
-}
\ No newline at end of file
+}
+
+// ShortDuration formats d without zero trailing units, e.g. "1m" rather
+// than "1m0s" and "1h30m" rather than "1h30m0s".
+func ShortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
@@ -0,0 +1,135 @@
+package websocket_conn
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"go-alpaca-streaming/pkg/metrics"
+)
+
+// PointIdentity decides how two trades that would otherwise form the same
+// point, same series and same nanosecond, are kept apart. Without one the
+// later trade silently overwrites the earlier.
+type PointIdentity string
+
+const (
+	// IdentityNone writes trades as they are.
+	IdentityNone PointIdentity = "none"
+	// IdentitySequence tags the second and later trades of a series at one
+	// timestamp with seq=1, seq=2 and so on. The first has no seq tag, so
+	// most points, and every timestamp, are unchanged. The sequence comes
+	// from the trades seen in this process, so a trade written twice, by a
+	// retried backfill page or by a live and a backfilled copy, may get a
+	// different seq and become a second point. The default.
+	IdentitySequence PointIdentity = "sequence"
+	// IdentityNudge moves every trade's timestamp forward by trade_id
+	// modulo 1000 nanoseconds. It depends on the trade alone, so writing a
+	// trade again always produces the same point, but every timestamp
+	// shifts and trades whose ids are a multiple of 1000 apart still
+	// collide.
+	IdentityNudge PointIdentity = "nudge"
+)
+
+// ParsePointIdentity converts a configuration string into a PointIdentity.
+func ParsePointIdentity(s string) (PointIdentity, error) {
+	switch p := PointIdentity(strings.ToLower(strings.TrimSpace(s))); p {
+	case IdentityNone, IdentitySequence, IdentityNudge:
+		return p, nil
+	case "":
+		return IdentitySequence, nil
+	default:
+		return "", fmt.Errorf("unknown point identity %q", s)
+	}
+}
+
+// nudgeModulus bounds the nudge below a microsecond.
+const nudgeModulus = 1000
+
+// recentTimestamps is how many recent timestamps are remembered per series
+// for IdentitySequence, so that slightly reordered trades still count.
+const recentTimestamps = 8
+
+// maxSeries bounds the series remembered for IdentitySequence. Series not
+// seen for a while are forgotten first.
+const maxSeries = 100000
+
+var sequencedTotal = metrics.Counter("point_identity_sequenced_total")
+
+// seriesTimes holds the most recent timestamps of a series and how many
+// trades each has had.
+type seriesTimes struct {
+	times  [recentTimestamps]int64
+	counts [recentTimestamps]int
+	next   int
+}
+
+// count returns how many trades at ts the series had before, and counts
+// this one.
+func (s *seriesTimes) count(ts int64) int {
+	for i, t := range s.times {
+		if t == ts && s.counts[i] > 0 {
+			s.counts[i]++
+			return s.counts[i] - 1
+		}
+	}
+	s.times[s.next] = ts
+	s.counts[s.next] = 1
+	s.next = (s.next + 1) % recentTimestamps
+	return 0
+}
+
+// PointIdentifier applies a PointIdentity. It is safe for concurrent use;
+// share one between the stream and the backfiller so their sequences
+// agree.
+type PointIdentifier struct {
+	mode PointIdentity
+
+	mu sync.Mutex
+	// series and previous are two generations of series. Once series
+	// holds maxSeries/2, it becomes previous and the old previous, the
+	// series not seen since, is dropped.
+	series   map[string]*seriesTimes
+	previous map[string]*seriesTimes
+}
+
+// NewPointIdentifier creates an identifier for mode.
+func NewPointIdentifier(mode PointIdentity) *PointIdentifier {
+	return &PointIdentifier{mode: mode, series: make(map[string]*seriesTimes)}
+}
+
+// lookupLocked returns the timestamps of a series, creating them if needed.
+func (id *PointIdentifier) lookupLocked(key string) *seriesTimes {
+	if s := id.series[key]; s != nil {
+		return s
+	}
+	s := id.previous[key]
+	if s == nil {
+		s = &seriesTimes{}
+	}
+	if len(id.series) >= maxSeries/2 {
+		id.previous = id.series
+		id.series = make(map[string]*seriesTimes)
+	}
+	id.series[key] = s
+	return s
+}
+
+// Apply sets the sequence or adjusts the timestamp of a trade about to be
+// formatted. Trades of one series must be applied in order.
+func (id *PointIdentifier) Apply(data *TradeData) {
+	switch id.mode {
+	case IdentityNudge:
+		data.Time += int64(data.I % nudgeModulus)
+	case IdentitySequence:
+		key := data.seriesKey()
+
+		id.mu.Lock()
+		data.Sequence = id.lookupLocked(key).count(data.Time)
+		id.mu.Unlock()
+
+		if data.Sequence > 0 {
+			sequencedTotal.Add(1)
+		}
+	}
+}
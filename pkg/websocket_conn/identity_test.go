@@ -0,0 +1,76 @@
+package websocket_conn
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"go-alpaca-streaming/pkg/utils"
+)
+
+func sameInstant(ids ...int) []*TradeData {
+	var out []*TradeData
+	for _, id := range ids {
+		out = append(out, ConvertToTradeData(utils.RawTrade{
+			Type: "t", I: id, Symbol: "AAPL", X: "V", Price: 170, Size: 100,
+			Time: "2024-03-01T15:00:00.123456789Z", C: []string{"@"}, Z: "C",
+		}))
+	}
+	return out
+}
+
+func TestSequenceTagsCollidingTrades(t *testing.T) {
+	id := NewPointIdentifier(IdentitySequence)
+
+	trades := sameInstant(1, 2, 3)
+	// A trade on another exchange is another series.
+	trades[2].X = "Q"
+
+	var lines []string
+	for _, data := range trades {
+		id.Apply(data)
+		lines = append(lines, data.FormatTradeLineProtocol())
+	}
+
+	if strings.Contains(lines[0], "seq=") {
+		t.Errorf("The first trade should not be tagged: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], ",seq=1 ") {
+		t.Errorf("Expected seq=1 on the second trade: %s", lines[1])
+	}
+	if strings.Contains(lines[2], "seq=") {
+		t.Errorf("A trade on another series should not be tagged: %s", lines[2])
+	}
+}
+
+func TestNudgeOffsetsByTradeID(t *testing.T) {
+	id := NewPointIdentifier(IdentityNudge)
+
+	trades := sameInstant(1001, 1002)
+	base := trades[0].Time
+	for _, data := range trades {
+		id.Apply(data)
+	}
+	if trades[0].Time != base+1 || trades[1].Time != base+2 {
+		t.Errorf("Expected offsets of 1 and 2ns, got %d and %d", trades[0].Time-base, trades[1].Time-base)
+	}
+}
+
+func TestParsePointIdentity(t *testing.T) {
+	if p, err := ParsePointIdentity(""); err != nil || p != IdentitySequence {
+		t.Errorf("Expected sequence by default, got %q, %v", p, err)
+	}
+	if _, err := ParsePointIdentity("random"); err == nil {
+		t.Error("Expected an unknown identity to be rejected")
+	}
+}
+
+func TestSequenceBoundsSeries(t *testing.T) {
+	id := NewPointIdentifier(IdentitySequence)
+	for i := 0; i < maxSeries+10; i++ {
+		id.lookupLocked(strconv.Itoa(i))
+	}
+	if n := len(id.series) + len(id.previous); n > maxSeries {
+		t.Errorf("Expected at most %d series, got %d", maxSeries, n)
+	}
+}
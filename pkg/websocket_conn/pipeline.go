@@ -0,0 +1,381 @@
+package websocket_conn
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"go-alpaca-streaming/pkg/bars"
+	"go-alpaca-streaming/pkg/calendar"
+	"go-alpaca-streaming/pkg/checkpoint"
+	"go-alpaca-streaming/pkg/conditions"
+	"go-alpaca-streaming/pkg/dedup"
+	"go-alpaca-streaming/pkg/filter"
+	"go-alpaca-streaming/pkg/health"
+	"go-alpaca-streaming/pkg/metrics"
+	"go-alpaca-streaming/pkg/outlier"
+	"go-alpaca-streaming/pkg/sink"
+	"go-alpaca-streaming/pkg/stats"
+	"go-alpaca-streaming/pkg/telegraf"
+	"go-alpaca-streaming/pkg/utils"
+	"go-alpaca-streaming/pkg/workerpool"
+)
+
+// invalidLines counts trades dropped because their line protocol failed
+// validation.
+var invalidLines = metrics.Counter("invalid_lines_total")
+
+// Pipeline takes raw websocket frames through decode, convert, batch and
+// sink. Live streaming and replay both feed frames through it, so they
+// exercise exactly the same path.
+type Pipeline struct {
+	sink     sink.Sink
+	pool     *workerpool.Pool
+	enrich   bool
+	calendar *calendar.Calendar
+
+	// aggregator builds bars from the trades; nil when no intervals are configured.
+	aggregator *bars.Aggregator
+	// stats keeps rolling statistics; nil when no windows are configured.
+	stats *stats.Tracker
+	// filter drops unwanted trades before they are queued; nil without rules.
+	filter *filter.Filter
+	// dedup drops trades already seen; nil when disabled.
+	dedup *dedup.Cache
+	// identity keeps trades sharing a timestamp from overwriting each
+	// other; nil writes them as they are.
+	identity *PointIdentifier
+	// outliers flags suspicious prices; nil when detection is off.
+	outliers *outlier.Detector
+	// monitor watches for symbols and the feed going quiet. Only the live
+	// client sets it, since it works on receive time.
+	monitor *health.Monitor
+	// checkpoint records the last trade written per symbol. Only the live
+	// client sets it.
+	checkpoint *checkpoint.Store
+	// received is when the last trade arrived, in Unix nanoseconds.
+	received atomic.Int64
+}
+
+// NewPipeline creates a pipeline that writes to s.
+func NewPipeline(opts ClientOptions, s sink.Sink) (*Pipeline, error) {
+	p := &Pipeline{
+		sink:     s,
+		enrich:   opts.EnrichExchanges,
+		calendar: opts.Calendar,
+		filter:   filter.New(opts.Filter),
+		dedup:    opts.Dedup,
+		identity: opts.Identity,
+	}
+	if p.calendar == nil {
+		p.calendar = calendar.NYSE()
+	}
+
+	workers := opts.Workers
+	workers.Backpressure.OnDrop = p.forget
+	pool, err := workerpool.New(workers, opts.Batch, p.handleWebSocketBatch)
+	if err != nil {
+		return nil, err
+	}
+	p.pool = pool
+
+	if len(opts.Bars.Intervals) > 0 {
+		p.aggregator = bars.New(opts.Bars, p.writeBars)
+	}
+	if opts.Outliers != nil {
+		p.outliers = outlier.New(*opts.Outliers)
+	}
+	if len(opts.Stats.Windows) > 0 {
+		p.stats = stats.New(opts.Stats, p.writeStats)
+	}
+
+	return p, nil
+}
+
+// Start launches the workers.
+func (p *Pipeline) Start(ctx context.Context) {
+	p.pool.Start(ctx)
+	if p.aggregator != nil {
+		p.aggregator.Start(ctx)
+	}
+	if p.stats != nil {
+		p.stats.Start(ctx)
+	}
+}
+
+// Close waits for queued trades to be written, then writes any open bars
+// and a last round of statistics.
+func (p *Pipeline) Close() {
+	p.pool.Close()
+	if p.aggregator != nil {
+		p.aggregator.Close()
+	}
+	if p.stats != nil {
+		p.stats.Close()
+	}
+}
+
+// streamMessage is any element of a frame. Control messages only use T,
+// Msg and Code; trades and cancels use the embedded RawTrade; corrections
+// use the embedded correction.
+type streamMessage struct {
+	utils.RawTrade
+	correction
+	Msg  string `json:"msg"`
+	Code int    `json:"code"`
+}
+
+// correction holds the fields of a trade correction ("c") message.
+type correction struct {
+	OrigID         int      `json:"oi"`
+	OrigPrice      float64  `json:"op"`
+	OrigSize       int      `json:"os"`
+	OrigConditions []string `json:"oc"`
+	CorrID         int      `json:"ci"`
+	CorrPrice      float64  `json:"cp"`
+	CorrSize       int      `json:"cs"`
+	CorrConditions []string `json:"cc"`
+}
+
+// ProcessFrame decodes one websocket frame and queues any trades in it. It
+// returns false if ctx ended while waiting for queue space.
+//
+// Messages are dispatched on their type rather than on connection state, so
+// a replay that starts from a capture file in the middle of a session still
+// decodes its trades.
+func (p *Pipeline) ProcessFrame(ctx context.Context, message []byte) bool {
+	var messages []streamMessage
+	if err := json.Unmarshal(message, &messages); err != nil {
+		log.Printf("Error unmarshalling message: %v", err)
+		log.Printf("Message: %s", message)
+		return true
+	}
+
+	for _, msg := range messages {
+		switch msg.Type {
+		case "t":
+			p.received.Store(time.Now().UnixNano())
+			if p.monitor != nil {
+				p.monitor.Trade(msg.Symbol)
+			}
+
+			// Repeats are dropped before anything counts them. The trade is
+			// remembered here, so a copy arriving before it is written is
+			// dropped too, and forgotten again if it is lost to a failed
+			// write or a full queue, so a backfill can still fill it in.
+			if p.dedup != nil && p.dedup.Seen(msg.RawTrade, tradeTime(msg.RawTrade)) {
+				continue
+			}
+
+			// Bars and stats are built here, in arrival order, rather than
+			// after the worker queues, so batching delays don't make trades late.
+			p.observe(msg.RawTrade)
+
+			// Filtered trades are still part of the bars and stats; they
+			// are only kept out of the trades measurement.
+			if p.filter != nil && p.filter.Check(msg.RawTrade) != "" {
+				continue
+			}
+
+			/// This is where we send the trade data to the rest
+			// of the application for processing.
+			if !p.pool.Submit(ctx, msg.RawTrade) {
+				p.forget(msg.RawTrade)
+				return false
+			}
+		case "c":
+			if p.aggregator != nil {
+				cond := conditions.Decode(msg.Z, msg.CorrConditions)
+				p.aggregator.Correct(msg.Symbol, msg.X, msg.Z, msg.OrigID, bars.Trade{
+					ID:             msg.CorrID,
+					Price:          msg.CorrPrice,
+					Size:           msg.CorrSize,
+					Time:           tradeTime(msg.RawTrade),
+					UpdatesLast:    cond.UpdatesLast,
+					UpdatesHighLow: cond.UpdatesHighLow,
+					UpdatesVolume:  cond.UpdatesVolume,
+				})
+			}
+		case "x":
+			// Cancels and errors both withdraw the trade.
+			if p.aggregator != nil {
+				p.aggregator.Cancel(msg.Symbol, msg.X, msg.Z, msg.I)
+			}
+		case "success", "subscription":
+			log.Println("Received success message.")
+		case "error":
+			log.Printf("Received error message: %d %s", msg.Code, msg.Msg)
+		default:
+			log.Printf("Received unknown or unhandled message type: %v", msg.Type)
+		}
+	}
+	return true
+}
+
+// lastReceived returns when the last trade arrived, or the zero time if
+// none has.
+func (p *Pipeline) lastReceived() time.Time {
+	if ns := p.received.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// handleWebSocketBatch processes a slice of RawTrade objects.
+func (p *Pipeline) handleWebSocketBatch(rawTrades []utils.RawTrade) {
+	var validLineProtocols []string
+	// written holds the trades behind validLineProtocols.
+	var written []utils.RawTrade
+
+	// Iterate over each RawTrade to convert and validate
+	for _, raw := range rawTrades {
+		convertedData := ConvertToTradeData(raw)
+		convertedData.Enriched = p.enrich
+		// The session comes from the trade's own timestamp, so a replay
+		// tags trades as they were tagged live.
+		if convertedData.Time != 0 {
+			convertedData.Session = p.calendar.Session(time.Unix(0, convertedData.Time))
+		}
+
+		// Each symbol is handled by a single worker, so the detector sees
+		// its trades in order.
+		if p.outliers != nil {
+			score, flagged := p.outliers.Check(raw.Symbol, raw.Price, convertedData.Conditions)
+			if flagged {
+				convertedData.Outlier = true
+				convertedData.OutlierScore = score
+				if p.outliers.Route() == outlier.Measurement {
+					convertedData.Measurement = OutliersMeasurement
+				}
+			}
+		}
+
+		if p.identity != nil {
+			p.identity.Apply(convertedData)
+		}
+
+		lineProtocol := convertedData.FormatTradeLineProtocol()
+
+		if err := telegraf.ValidateLineProtocol(lineProtocol); err != nil {
+			invalidLines.Add(1)
+			log.Println("Invalid line protocol:", lineProtocol, err)
+			continue
+		}
+		validLineProtocols = append(validLineProtocols, lineProtocol)
+		written = append(written, raw)
+	}
+
+	// Send all valid line protocols to the sink
+	if len(validLineProtocols) > 0 {
+		if err := p.sink.Write(validLineProtocols); err != nil {
+			log.Println("Error sending batch to sink:", err)
+			log.Println("Failed trade data:", validLineProtocols)
+			for _, raw := range written {
+				p.forget(raw)
+			}
+			return
+		}
+		if p.checkpoint != nil {
+			for _, raw := range written {
+				p.checkpoint.Record(raw.Symbol, checkpoint.Entry{Time: tradeTime(raw), ID: raw.I, Exchange: raw.X, Tape: raw.Z})
+			}
+		}
+	}
+}
+
+// forget releases a trade that won't be written from the dedup cache, so
+// a later copy, such as one from a backfill, isn't dropped as a repeat.
+func (p *Pipeline) forget(raw utils.RawTrade) {
+	if p.dedup != nil {
+		p.dedup.Forget(raw)
+	}
+}
+
+// decodedTrade is a raw trade with its timestamp and conditions decoded,
+// as the in-process stages need them.
+type decodedTrade struct {
+	utils.RawTrade
+	At         time.Time
+	Conditions conditions.Result
+}
+
+func decodeTrade(raw utils.RawTrade) decodedTrade {
+	return decodedTrade{RawTrade: raw, At: tradeTime(raw), Conditions: conditions.Decode(raw.Z, raw.C)}
+}
+
+// tradeTime parses a trade's timestamp, returning the zero time if it is
+// missing or invalid.
+func tradeTime(raw utils.RawTrade) time.Time {
+	if ns := utils.ParseStrConvertToEpochNs(raw.Time); ns != 0 {
+		return time.Unix(0, ns).UTC()
+	}
+	return time.Time{}
+}
+
+// observe feeds a trade to the bar and stats stages, if any.
+func (p *Pipeline) observe(raw utils.RawTrade) {
+	if p.aggregator == nil && p.stats == nil {
+		return
+	}
+	d := decodeTrade(raw)
+
+	if p.aggregator != nil {
+		p.aggregator.Add(bars.Trade{
+			ID:             d.I,
+			Symbol:         d.Symbol,
+			Exchange:       d.X,
+			Tape:           d.Z,
+			Price:          d.Price,
+			Size:           d.Size,
+			Time:           d.At,
+			UpdatesLast:    d.Conditions.UpdatesLast,
+			UpdatesHighLow: d.Conditions.UpdatesHighLow,
+			UpdatesVolume:  d.Conditions.UpdatesVolume,
+		})
+	}
+	if p.stats != nil {
+		p.stats.Add(stats.Trade{
+			Symbol:         d.Symbol,
+			Price:          d.Price,
+			Size:           d.Size,
+			Time:           d.At,
+			UpdatesHighLow: d.Conditions.UpdatesHighLow,
+			UpdatesVolume:  d.Conditions.UpdatesVolume,
+		})
+	}
+}
+
+// writeHealth sends health events to the sink.
+func (p *Pipeline) writeHealth(events []health.Event) {
+	lines := make([]string, 0, len(events))
+	for _, e := range events {
+		lines = append(lines, e.LineProtocol())
+	}
+	if err := p.sink.Write(lines); err != nil {
+		log.Println("Error sending health events to sink:", err)
+	}
+}
+
+// writeBars sends completed bars to the sink.
+func (p *Pipeline) writeBars(completed []bars.Bar) {
+	lines := make([]string, 0, len(completed))
+	for _, bar := range completed {
+		lines = append(lines, bar.LineProtocol())
+	}
+	if err := p.sink.Write(lines); err != nil {
+		log.Println("Error sending bars to sink:", err)
+	}
+}
+
+// writeStats sends a round of rolling statistics to the sink.
+func (p *Pipeline) writeStats(snapshots []stats.Snapshot) {
+	lines := make([]string, 0, len(snapshots))
+	for _, snap := range snapshots {
+		lines = append(lines, snap.LineProtocol())
+	}
+	if err := p.sink.Write(lines); err != nil {
+		log.Println("Error sending stats to sink:", err)
+	}
+}
@@ -0,0 +1,244 @@
+package websocket_conn
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go-alpaca-streaming/pkg/bars"
+	"go-alpaca-streaming/pkg/batcher"
+	"go-alpaca-streaming/pkg/dedup"
+	"go-alpaca-streaming/pkg/filter"
+	"go-alpaca-streaming/pkg/outlier"
+	"go-alpaca-streaming/pkg/sink"
+	"go-alpaca-streaming/pkg/telegraf"
+	"go-alpaca-streaming/pkg/utils"
+	"go-alpaca-streaming/pkg/workerpool"
+)
+
+func TestHandleWebSocketBatchEnrichesExchanges(t *testing.T) {
+	out := &recordingSink{}
+	p, err := NewPipeline(ClientOptions{
+		Workers:         workerpool.Config{Workers: 1},
+		EnrichExchanges: true,
+	}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.handleWebSocketBatch([]utils.RawTrade{
+		{Type: "t", I: 1, Symbol: "AAPL", X: "D", Price: 170.25, Size: 100, Time: "2024-03-01T14:30:00Z", Z: "C"},
+		{Type: "t", I: 2, Symbol: "AAPL", X: "?", Price: 170.25, Size: 100, Time: "2024-03-01T14:30:00Z", Z: "?"},
+		{Type: "t", I: 3, Symbol: "AAPL", Price: 170.25, Size: 100, Time: "2024-03-01T14:30:00Z", Z: "C"},
+	})
+
+	if len(out.lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %d", len(out.lines))
+	}
+	want := `exchange_name=FINRA\ ADF/TRF,exchange_mic=XOFF,off_exchange=true,tape_name=Nasdaq `
+	if !strings.Contains(out.lines[0], want) {
+		t.Errorf("Expected %q in %s", want, out.lines[0])
+	}
+	if strings.Contains(out.lines[1], "exchange_name") || strings.Contains(out.lines[1], "tape_name") {
+		t.Errorf("Unknown codes should not be tagged: %s", out.lines[1])
+	}
+	if strings.Contains(out.lines[2], "exchange=") {
+		t.Errorf("A trade without an exchange should have no exchange tag: %s", out.lines[2])
+	}
+	for _, line := range out.lines {
+		if err := telegraf.ValidateLineProtocol(line); err != nil {
+			t.Errorf("Invalid line protocol %s: %v", line, err)
+		}
+	}
+}
+
+func TestPipelineWritesBars(t *testing.T) {
+	out := &recordingSink{}
+	p, err := NewPipeline(ClientOptions{
+		Batch:   batcher.Config{MaxSize: 10, MaxLinger: 10 * time.Millisecond},
+		Workers: workerpool.Config{Workers: 1},
+		Bars:    bars.Config{Intervals: []time.Duration{5 * time.Second}},
+	}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start(context.Background())
+
+	p.ProcessFrame(context.Background(), []byte(`[
+		{"T":"t","i":1,"S":"AAPL","x":"V","p":10,"s":100,"t":"2024-03-01T14:30:01Z","c":["@"],"z":"C"},
+		{"T":"t","i":2,"S":"AAPL","x":"V","p":12,"s":50,"t":"2024-03-01T14:30:02Z","c":["@","I"],"z":"C"},
+		{"T":"t","i":3,"S":"AAPL","x":"V","p":30,"s":10,"t":"2024-03-01T14:30:03Z","c":["@"],"z":"C"}
+	]`))
+	p.ProcessFrame(context.Background(), []byte(`[
+		{"T":"c","S":"AAPL","x":"V","oi":1,"op":10,"os":100,"oc":["@"],"ci":4,"cp":8,"cs":100,"cc":["@"],"z":"C","t":"2024-03-01T14:30:04Z"},
+		{"T":"x","S":"AAPL","x":"V","i":3,"p":30,"s":10,"a":"C","z":"C","t":"2024-03-01T14:30:04Z"}
+	]`))
+	p.Close()
+
+	var bar string
+	for _, line := range out.lines {
+		if strings.HasPrefix(line, "alpaca_equities_streaming_bars,") {
+			bar = line
+		}
+	}
+	want := "alpaca_equities_streaming_bars,symbol=AAPL,interval=5s volume=150,trade_count=2,open=8.000000,close=8.000000,high=8.000000,low=8.000000"
+	if !strings.HasPrefix(bar, want) {
+		t.Fatalf("Expected a bar starting with %q, got %q", want, bar)
+	}
+}
+
+func TestPipelineFiltersTrades(t *testing.T) {
+	out := &recordingSink{}
+	p, err := NewPipeline(ClientOptions{
+		Batch:   batcher.Config{MaxSize: 10, MaxLinger: 10 * time.Millisecond},
+		Workers: workerpool.Config{Workers: 1},
+		Filter:  filter.Config{ExcludeConditions: []string{"I"}},
+	}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start(context.Background())
+
+	p.ProcessFrame(context.Background(), []byte(`[
+		{"T":"t","i":1,"S":"AAPL","x":"V","p":10,"s":100,"t":"2024-03-01T14:30:01Z","c":["@"],"z":"C"},
+		{"T":"t","i":2,"S":"AAPL","x":"V","p":12,"s":5,"t":"2024-03-01T14:30:02Z","c":["@","I"],"z":"C"}
+	]`))
+	p.Close()
+
+	if len(out.lines) != 1 || !strings.Contains(out.lines[0], "trade_id=1") {
+		t.Fatalf("Expected only the round lot to be written, got %q", out.lines)
+	}
+}
+
+func TestPipelineDropsRepeatedTrades(t *testing.T) {
+	out := &recordingSink{}
+	p, err := NewPipeline(ClientOptions{
+		Batch:   batcher.Config{MaxSize: 10, MaxLinger: 10 * time.Millisecond},
+		Workers: workerpool.Config{Workers: 1},
+		Dedup:   dedup.New(dedup.Config{}),
+	}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start(context.Background())
+
+	frame := []byte(`[{"T":"t","i":1,"S":"AAPL","x":"V","p":10,"s":100,"t":"2024-03-01T14:30:01Z","c":["@"],"z":"C"}]`)
+	// The repeat arrives before the first copy is written.
+	p.ProcessFrame(context.Background(), frame)
+	p.ProcessFrame(context.Background(), frame)
+	p.Close()
+
+	if len(out.lines) != 1 {
+		t.Fatalf("Expected the repeat to be dropped, got %q", out.lines)
+	}
+}
+
+// failingSink fails every write.
+type failingSink struct{}
+
+func (failingSink) Write(lines []string) error { return errors.New("sink down") }
+
+func TestFailedWriteIsNotSeen(t *testing.T) {
+	cache := dedup.New(dedup.Config{})
+	p, err := NewPipeline(ClientOptions{Workers: workerpool.Config{Workers: 1}, Dedup: cache}, failingSink{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := utils.RawTrade{Type: "t", I: 1, Symbol: "AAPL", X: "V", Price: 10, Size: 100, Time: "2024-03-01T14:30:01Z", Z: "C"}
+	cache.Seen(raw, tradeTime(raw))
+	p.handleWebSocketBatch([]utils.RawTrade{raw})
+	if cache.Contains(raw) {
+		t.Error("Expected a trade that failed to write to be left for a backfill")
+	}
+}
+
+func TestHandleWebSocketBatchRoutesOutliers(t *testing.T) {
+	out := &recordingSink{}
+	p, err := NewPipeline(ClientOptions{
+		Workers:  workerpool.Config{Workers: 1},
+		Outliers: &outlier.Config{Window: 10, MinHistory: 5, Route: outlier.Measurement},
+	}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var batch []utils.RawTrade
+	for i := 0; i < 10; i++ {
+		batch = append(batch, utils.RawTrade{Type: "t", I: i, Symbol: "AAPL", X: "V", Price: 170, Size: 100, Time: "2024-03-01T14:30:00Z", C: []string{"@"}, Z: "C"})
+	}
+	// A fat finger, and a far-off print that is out of sequence anyway.
+	batch = append(batch,
+		utils.RawTrade{Type: "t", I: 10, Symbol: "AAPL", X: "V", Price: 1700, Size: 100, Time: "2024-03-01T14:30:01Z", C: []string{"@"}, Z: "C"},
+		utils.RawTrade{Type: "t", I: 11, Symbol: "AAPL", X: "V", Price: 1700, Size: 100, Time: "2024-03-01T14:30:01Z", C: []string{"Z"}, Z: "C"},
+	)
+	p.handleWebSocketBatch(batch)
+
+	var outliers []string
+	for _, line := range out.lines {
+		if strings.HasPrefix(line, OutliersMeasurement+",") {
+			outliers = append(outliers, line)
+		}
+	}
+	if len(outliers) != 1 || !strings.Contains(outliers[0], "outlier=true") || !strings.Contains(outliers[0], "trade_id=10") {
+		t.Fatalf("Expected trade 10 alone in the outliers measurement, got %q", outliers)
+	}
+}
+
+func BenchmarkHandleWebSocketBatch(b *testing.B) {
+	p, err := NewPipeline(ClientOptions{
+		Batch:   batcher.DefaultConfig(),
+		Workers: workerpool.Config{Workers: 1},
+	}, sink.Discard{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	batch := make([]utils.RawTrade, 100)
+	for i := range batch {
+		batch[i] = utils.RawTrade{
+			Type:   "t",
+			I:      52983525029461 + i,
+			Symbol: "AAPL",
+			X:      "V",
+			Price:  170.25,
+			Size:   100,
+			Time:   "2024-03-01T14:30:00.123456789Z",
+			C:      []string{"@", "I"},
+			Z:      "C",
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.handleWebSocketBatch(batch)
+	}
+}
+
+func TestHandleWebSocketBatchTagsSessions(t *testing.T) {
+	out := &recordingSink{}
+	p, err := NewPipeline(ClientOptions{Workers: workerpool.Config{Workers: 1}}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.handleWebSocketBatch([]utils.RawTrade{
+		{Type: "t", I: 1, Symbol: "AAPL", X: "Q", Price: 170, Size: 100, Time: "2024-03-01T13:00:00Z", Z: "C"},
+		{Type: "t", I: 2, Symbol: "AAPL", X: "Q", Price: 170, Size: 100, Time: "2024-03-01T15:00:00Z", Z: "C"},
+		{Type: "t", I: 3, Symbol: "AAPL", X: "Q", Price: 170, Size: 100, Time: "2024-03-01T22:00:00Z", Z: "C"},
+		{Type: "t", I: 4, Symbol: "AAPL", X: "Q", Price: 170, Size: 100, Time: "2024-03-02T15:00:00Z", Z: "C"},
+	})
+
+	want := []string{"session=pre", "session=regular", "session=post", "session=overnight"}
+	if len(out.lines) != len(want) {
+		t.Fatalf("Expected %d lines, got %d", len(want), len(out.lines))
+	}
+	for i, line := range out.lines {
+		if !strings.Contains(line, ","+want[i]+" ") {
+			t.Errorf("Expected %s in %s", want[i], line)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package websocket_conn
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Probe connects, authenticates and subscribes to trades for symbols, then
+// writes the first n frames to out, one per line, and disconnects. Nothing is
+// sent to a sink. It is a quick end-to-end check of credentials and feed.
+func Probe(ctx context.Context, opts ClientOptions, symbols []string, n int, out io.Writer) error {
+	opts = opts.withDefaults()
+
+	dialer := websocket.Dialer{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		EnableCompression: true,
+		HandshakeTimeout:  30 * time.Second,
+	}
+
+	conn, resp, err := establishConnection(dialer, opts)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("Failed to connect: %v (HTTP %s)", err, resp.Status)
+		}
+		return fmt.Errorf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	printed := 0
+	show := func(ctx context.Context, frame []byte) bool {
+		fmt.Fprintf(out, "%s %s\n", time.Now().UTC().Format(time.RFC3339Nano), frame)
+		printed++
+		return printed < n
+	}
+
+	if err := authenticate(conn, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "# authenticated with %s\n", opts.URL)
+
+	if err := subscribe(ctx, conn, nil, show, symbols); err != nil {
+		if printed >= n {
+			return nil
+		}
+		return err
+	}
+
+	for printed < n {
+		message, err := readFrame(conn, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("Error reading raw message: %v", err)
+		}
+		show(ctx, message)
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return nil
+}
@@ -2,25 +2,40 @@ package websocket_conn
 
 import (
 	"context"
-	"os"
+	"errors"
 
 	// "regexp"
+	"sort"
 	"strings"
 	"sync"
 
 	"encoding/json"
 	"log"
 	"net/http"
-	"net/url"
 
-	// "time"
 	"crypto/tls"
+	"time"
 
 	// "strings"
 	"fmt"
+	"go-alpaca-streaming/pkg/assets"
+	"go-alpaca-streaming/pkg/bars"
+	"go-alpaca-streaming/pkg/batcher"
+	"go-alpaca-streaming/pkg/calendar"
+	"go-alpaca-streaming/pkg/capture"
+	"go-alpaca-streaming/pkg/checkpoint"
+	"go-alpaca-streaming/pkg/conditions"
+	"go-alpaca-streaming/pkg/dedup"
+	"go-alpaca-streaming/pkg/exchanges"
+	"go-alpaca-streaming/pkg/filter"
+	"go-alpaca-streaming/pkg/health"
+	"go-alpaca-streaming/pkg/outlier"
+	"go-alpaca-streaming/pkg/sink"
+	"go-alpaca-streaming/pkg/stats"
 	author_symbols "go-alpaca-streaming/pkg/symbols"
 	"go-alpaca-streaming/pkg/telegraf"
 	"go-alpaca-streaming/pkg/utils"
+	"go-alpaca-streaming/pkg/workerpool"
 
 	"github.com/gorilla/websocket"
 )
@@ -34,22 +49,81 @@ type TradeData struct {
 	Time   int64
 	I      int
 	Z      string
+	// Conditions is C decoded for the trade's tape.
+	Conditions conditions.Result
+	// Enriched adds the exchange and tape lookups as tags.
+	Enriched bool
+	// Outlier marks a suspicious price; OutlierScore is its robust z-score.
+	Outlier      bool
+	OutlierScore float64
+	// Measurement overrides the trades measurement when set.
+	Measurement string
+	// Session is the market session the trade was made in, written as the
+	// session tag when set.
+	Session calendar.Session
+	// Sequence tells apart trades of one series at one timestamp; written
+	// as the seq tag when above zero. See PointIdentity.
+	Sequence int
 	// ... other fields
 }
 
+// Measurements trades are written to.
+const (
+	TradesMeasurement   = "alpaca_equities_streaming_trades"
+	OutliersMeasurement = "alpaca_equities_streaming_outliers"
+)
+
 type GenericMessage struct {
-	T   string `json:"T"`
-	Msg string `json:"msg"`
+	T    string `json:"T"`
+	Msg  string `json:"msg"`
+	Code int    `json:"code"`
+}
+
+// StreamError is an error message sent by the stream server.
+type StreamError struct {
+	Code int
+	Msg  string
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("stream error %d: %s", e.Code, e.Msg)
+}
+
+// Retryable reports whether reconnecting could help. Bad credentials, a
+// missing data subscription or too many symbols will fail the same way again.
+func (e *StreamError) Retryable() bool {
+	switch e.Code {
+	case 402, 405, 409:
+		return false
+	default:
+		return true
+	}
 }
 
 type WebSocketAuthenticator struct {
-	conn *websocket.Conn
+	conn    *websocket.Conn
+	capture *capture.Writer
+}
+
+// readFrame reads the next message and, when capture is enabled, records it
+// with its receive time.
+func readFrame(conn *websocket.Conn, cw *capture.Writer) ([]byte, error) {
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return message, err
+	}
+	if cw != nil {
+		if err := cw.Write(time.Now(), message); err != nil {
+			log.Printf("Error writing frame to capture file: %v", err)
+		}
+	}
+	return message, nil
 }
 
 func (auth *WebSocketAuthenticator) WaitForAuthentication() (bool, error) {
 	var authResponse []GenericMessage
 
-	_, authMessage, err := auth.conn.ReadMessage()
+	authMessage, err := readFrame(auth.conn, auth.capture)
 	if err != nil {
 		return false, fmt.Errorf("Failed to read auth acknowledgment: %v %v", authMessage, err)
 	}
@@ -63,219 +137,532 @@ func (auth *WebSocketAuthenticator) WaitForAuthentication() (bool, error) {
 		if msg.T == "success" {
 			return true, nil
 		}
+		if msg.T == "error" {
+			return false, &StreamError{Code: msg.Code, Msg: msg.Msg}
+		}
 	}
 
 	return false, fmt.Errorf("Authentication failed")
 }
 
-func authenticate(conn *websocket.Conn) bool {
-	authenticator := WebSocketAuthenticator{conn: conn}
-	authSuccess, err := authenticator.WaitForAuthentication()
-	if err != nil || !authSuccess {
-		log.Fatalf("Authentication failed: %v", err)
-		return false
+// authenticate waits for the "connected" and "authenticated" acknowledgments
+// that follow a dial with credentials in the headers.
+func authenticate(conn *websocket.Conn, cw *capture.Writer) error {
+	authenticator := WebSocketAuthenticator{conn: conn, capture: cw}
+	for _, stage := range []string{"connected", "authenticated"} {
+		authSuccess, err := authenticator.WaitForAuthentication()
+		if err != nil {
+			return err
+		}
+		if !authSuccess {
+			return fmt.Errorf("Authentication failed waiting for %s", stage)
+		}
 	}
-	return true
+	return nil
 }
 
-func establishConnection(dialer websocket.Dialer, u url.URL) (*websocket.Conn, *http.Response, error) {
+// subscribe sends the subscription and waits for the server to confirm it.
+// Frames read while waiting are still passed to handle.
+func subscribe(ctx context.Context, conn *websocket.Conn, cw *capture.Writer, handle func(context.Context, []byte) bool, symbols []string) error {
+	// Fixed type mismatch
+	subscriptionMessage := map[string]interface{}{
+		"action": "subscribe",
+		"trades": symbols, // Assuming the key is 'trades' and the value is an array of strings
+	}
+
+	// Send subscription message
+	if err := conn.WriteJSON(subscriptionMessage); err != nil {
+		return fmt.Errorf("Failed to subscribe: %v", err)
+	}
+
+	for {
+		message, err := readFrame(conn, cw)
+		if err != nil {
+			return fmt.Errorf("Failed to read subscription acknowledgment: %v", err)
+		}
+
+		var messages []GenericMessage
+		if err := json.Unmarshal(message, &messages); err == nil {
+			for _, msg := range messages {
+				if msg.T == "error" {
+					return &StreamError{Code: msg.Code, Msg: msg.Msg}
+				}
+			}
+		}
+
+		if !handle(ctx, message) {
+			return ctx.Err()
+		}
+		for _, msg := range messages {
+			if msg.T == "subscription" {
+				return nil
+			}
+		}
+	}
+}
+
+func establishConnection(dialer websocket.Dialer, opts ClientOptions) (*websocket.Conn, *http.Response, error) {
 	headers := http.Header{}
 
-	headers.Add("APCA-API-KEY-ID", os.Getenv("APCA_API_KEY_ID"))
-	headers.Add("APCA-API-SECRET-KEY", os.Getenv("APCA_API_SECRET_KEY"))
-	return dialer.Dial(u.String(), headers)
+	headers.Add("APCA-API-KEY-ID", opts.KeyID)
+	headers.Add("APCA-API-SECRET-KEY", opts.SecretKey)
+	return dialer.Dial(opts.URL, headers)
+}
+
+// DefaultStreamURL is Alpaca's SIP trade stream.
+const DefaultStreamURL = "wss://stream.data.alpaca.markets/v2/sip"
+
+// ReconnectConfig controls how the client recovers from a dropped connection.
+type ReconnectConfig struct {
+	// MaxAttempts is the number of consecutive failed attempts before giving
+	// up. Zero retries forever.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// ScheduleConfig keeps the client connected only around trading days.
+type ScheduleConfig struct {
+	// Lead is how long before the pre-market session the client connects.
+	Lead time.Duration
+	// Linger is how long after the post-market session it stays connected.
+	Linger time.Duration
 }
 
-func RunWebSocketClient(wg *sync.WaitGroup) {
+// Backfiller fills gaps in the stream from another source, such as the
+// historical trades API (see pkg/backfill).
+type Backfiller interface {
+	// Fill writes the trades for symbols made in [start, end) to out.
+	// Calls may overlap.
+	Fill(ctx context.Context, start, end time.Time, symbols []string, out sink.Sink) error
+	// FillSince writes, for each symbol, the trades made from its start
+	// in since until end to out.
+	FillSince(ctx context.Context, since map[string]time.Time, end time.Time, out sink.Sink) error
+	// Resume finishes fills interrupted by an earlier run.
+	Resume(ctx context.Context, out sink.Sink) error
+}
+
+// ClientOptions holds the startup settings for RunWebSocketClient and the
+// pipeline behind it.
+type ClientOptions struct {
+	Batch   batcher.Config
+	Workers workerpool.Config
+	// CaptureDir, when set, records every raw frame to hourly capture files.
+	CaptureDir string
+
+	// URL is the stream endpoint; DefaultStreamURL when empty.
+	URL       string
+	KeyID     string
+	SecretKey string
+	// Symbols to subscribe to. When empty they come from SymbolSources.
+	Symbols []string
+	// SymbolSources are tried in order for the symbols; the author symbols
+	// endpoint, then the local parquet file, when empty.
+	SymbolSources author_symbols.Chain
+	// Assets, when set, leaves out symbols that aren't active, tradable
+	// assets before subscribing.
+	Assets *assets.Checker
+	// Sink receives line protocol; the shared Telegraf connection when nil.
+	Sink      sink.Sink
+	Reconnect ReconnectConfig
+	// EnrichExchanges adds exchange name, MIC, off-exchange and tape name tags.
+	EnrichExchanges bool
+	// Bars lists the bar intervals to aggregate, none when empty, and how
+	// long bars stay open to late trades and corrections.
+	Bars bars.Config
+	// Stats lists the rolling statistics windows; none when empty.
+	Stats stats.Config
+	// Filter holds the rules for trades kept out of the trades measurement.
+	Filter filter.Config
+	// Outliers enables price outlier detection; nil disables it.
+	Outliers *outlier.Config
+	// Health enables stale-symbol and feed-silence detection; nil disables it.
+	Health *health.Config
+	// Calendar decides each trade's session and, with Schedule, when to
+	// connect. The NYSE calendar when nil.
+	Calendar *calendar.Calendar
+	// Schedule connects only around trading days; nil stays connected
+	// around the clock.
+	Schedule *ScheduleConfig
+	// Backfill fills the gap left by each reconnect; nil leaves it.
+	Backfill Backfiller
+	// Dedup drops trades already seen, such as a backfilled trade that also
+	// arrived live; nil disables it. Share it with the backfiller.
+	Dedup *dedup.Cache
+	// Identity keeps trades sharing a series and timestamp apart; nil
+	// writes them as they are. Share it with the backfiller.
+	Identity *PointIdentifier
+	// Checkpoint records the last trade written per symbol. On startup
+	// the time since each checkpoint is backfilled and the checkpointed
+	// trades seed Dedup. nil disables it.
+	Checkpoint *checkpoint.Store
+}
+
+func (opts ClientOptions) withDefaults() ClientOptions {
+	if opts.URL == "" {
+		opts.URL = DefaultStreamURL
+	}
+	if opts.Reconnect.InitialBackoff <= 0 {
+		opts.Reconnect.InitialBackoff = time.Second
+	}
+	if opts.Reconnect.MaxBackoff <= 0 {
+		opts.Reconnect.MaxBackoff = time.Minute
+	}
+	if opts.Calendar == nil {
+		opts.Calendar = calendar.NYSE()
+	}
+	return opts
+}
+
+// RunWebSocketClient runs the client until ctx ends or it fails for good,
+// then exits the process.
+func RunWebSocketClient(ctx context.Context, wg *sync.WaitGroup, opts ClientOptions) {
 	// Decrease the counter when the goroutine completes
-	wg.Add(1) // Increment the counter
 	defer wg.Done()
 
-	// Instantiate.
-	telegraf.SetupTelegrafConnection()
-	defer telegraf.CloseTelegrafConnection()
+	if err := Run(ctx, opts); err != nil {
+		log.Fatalf("WebSocket client failed: %v", err)
+	}
+}
+
+// Run streams trades into the sink until ctx is cancelled, reconnecting with
+// exponential backoff whenever the connection drops. It returns nil when ctx
+// ends and an error for failures that reconnecting cannot fix.
+// With a Schedule, it connects only around trading days.
+func Run(ctx context.Context, opts ClientOptions) error {
+	opts = opts.withDefaults()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel() // Will be called last in deferred functions.
 	// Deferred functions are LIFO (Last in First Out).
 
-	// Prepare WebSocket URL
-	u := url.URL{Scheme: "wss", Host: "stream.data.alpaca.markets", Path: "/v2/sip"}
+	out := opts.Sink
+	if out == nil {
+		// Instantiate.
+		telegraf.SetupTelegrafConnection()
+		defer telegraf.CloseTelegrafConnection()
+		out = sink.Telegraf{}
+	}
 
-	// Custom Gorilla Dialer with TLS verification disabled
-	dialer := websocket.Dialer{
-		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
-		EnableCompression: true,
+	var cw *capture.Writer
+	if opts.CaptureDir != "" {
+		var err error
+		cw, err = capture.NewWriter(opts.CaptureDir)
+		if err != nil {
+			return fmt.Errorf("Failed to set up frame capture: %v", err)
+		}
+		defer cw.Close()
+		go flushCapture(ctx, cw)
+		log.Println("Capturing raw frames to", opts.CaptureDir)
 	}
 
-	conn, resp, err := establishConnection(dialer, u)
+	symbols, source, err := ResolveSymbols(ctx, opts)
 	if err != nil {
-		log.Fatalf("Failed to connect: %v", err)
-		return
+		return err
 	}
-	defer func() { // Defer the close till after the function returns
-		conn.Close()
-		cancel() // Cancel the context when you're done
-	}()
-
-	if !authenticate(conn) {
-		log.Fatalf("Authentication failed. Exiting. %v", resp)
-		return
+	log.Printf("Using %d symbols from %s.", len(symbols), source)
+
+	// The checkpoint is closed, and so flushed, after the pipeline has
+	// written its last trades.
+	var since map[string]time.Time
+	if opts.Checkpoint != nil {
+		since = checkpointed(opts, symbols)
+		opts.Checkpoint.Start(ctx)
+		defer opts.Checkpoint.Close()
 	}
 
-	authenticator := WebSocketAuthenticator{conn: conn}
-	authSuccess, err := authenticator.WaitForAuthentication()
+	// Each symbol is owned by one worker, which batches and writes its
+	// trades in order. The bounded queues in front of the workers apply
+	// the configured backpressure policy when the sink falls behind.
+	pipeline, err := NewPipeline(opts, out)
 	if err != nil {
-		log.Fatalf("%v. Exiting.", err)
-		return
+		return fmt.Errorf("Failed to start pipeline: %v", err)
 	}
-
-	if !authSuccess {
-		log.Fatalf("Authentication failed. Exiting.")
-		return
+	pipeline.checkpoint = opts.Checkpoint
+	pipeline.Start(ctx)
+	defer pipeline.Close()
+
+	if opts.Health != nil {
+		cfg := *opts.Health
+		if cfg.Calendar == nil {
+			cfg.Calendar = opts.Calendar
+		}
+		pipeline.monitor = health.New(cfg, pipeline.writeHealth)
+		pipeline.monitor.Start(ctx)
+		defer pipeline.monitor.Close()
 	}
 
-	// Retrieve the symbols
-	SymbolsToUse, err := author_symbols.GetAuthorSymbols()
-	if err != nil {
-		log.Println("Error retrieving symbols:", err)
-
-		// Fallback mechanism
-		SymbolsToUse = author_symbols.GetLocalSymbols()
-		if len(SymbolsToUse) == 0 {
-			log.Println("No local symbols available for fallback. Exiting.")
-			return
+	// Backfills run alongside the stream and are waited for before the
+	// sink is closed.
+	var fills sync.WaitGroup
+	defer fills.Wait()
+	fill := func(start, end time.Time) {
+		if start.IsZero() {
+			// The first subscription: fill from the checkpoints, once.
+			if len(since) > 0 {
+				log.Printf("Trades since the checkpoints of %d symbols were missed.", len(since))
+			}
+			since = nil
+		}
+	}
+	if opts.Backfill != nil {
+		fill = func(start, end time.Time) {
+			if start.IsZero() && len(since) == 0 {
+				return
+			}
+			startup := since
+			since = nil
+			fills.Add(1)
+			go func() {
+				defer fills.Done()
+				var err error
+				if start.IsZero() {
+					err = opts.Backfill.FillSince(ctx, startup, end, out)
+				} else {
+					err = opts.Backfill.Fill(ctx, start, end, symbols, out)
+				}
+				if err != nil {
+					log.Printf("Backfill failed: %v", err)
+				}
+			}()
 		}
-		log.Println("Using local symbols for fallback:", SymbolsToUse)
+		fills.Add(1)
+		go func() {
+			defer fills.Done()
+			if err := opts.Backfill.Resume(ctx, out); err != nil {
+				log.Printf("Resuming backfill failed: %v", err)
+			}
+		}()
 	}
 
-	// Fixed type mismatch
-	subscriptionMessage := map[string]interface{}{
-		"action": "subscribe",
-		"trades": SymbolsToUse, // Assuming the key is 'trades' and the value is an array of strings
+	if opts.Schedule != nil {
+		return streamOnSchedule(ctx, opts, cw, pipeline, symbols, fill)
 	}
+	return stream(ctx, opts, cw, pipeline, symbols, fill)
+}
 
-	// Send subscription message
-	err = conn.WriteJSON(subscriptionMessage)
-	if err != nil {
-		log.Fatalf("Failed to subscribe: %v", err)
-		return
+// gapMargin is how far before the last received trade a backfill starts,
+// to cover trades still in flight when the connection dropped. Overlapping
+// trades are dropped by Dedup. Without it, the nudge point identity writes
+// them as identical points, which overwrite rather than duplicate; the
+// sequence identity may not.
+const gapMargin = 5 * time.Second
+
+// checkpointed returns the checkpoint time of each subscribed symbol that
+// has one, and adds the checkpointed trades to Dedup so they aren't
+// written again.
+func checkpointed(opts ClientOptions, symbols []string) map[string]time.Time {
+	entries := opts.Checkpoint.Entries()
+	since := make(map[string]time.Time)
+	for _, symbol := range symbols {
+		e, ok := entries[symbol]
+		if !ok || e.Time.IsZero() {
+			continue
+		}
+		since[symbol] = e.Time
+		if opts.Dedup != nil {
+			opts.Dedup.Add(e.Raw(symbol), e.Time)
+		}
 	}
+	return since
+}
 
-	go func(ctx context.Context, conn *websocket.Conn) {
-		defer wg.Done() // Decrement counter when goroutine completes
-		// Initialize a flag to check if "success" message is received
-		successReceived := false
+// stream runs sessions until ctx ends, reconnecting with backoff. Once a
+// session is subscribed, fill is called with the window missed before it:
+// from the zero time for the first session, which has no previous one.
+func stream(ctx context.Context, opts ClientOptions, cw *capture.Writer, pipeline *Pipeline, symbols []string, fill func(start, end time.Time)) error {
+	backoff := opts.Reconnect.InitialBackoff
+	attempts := 0
+	// lost is when the stream was last known to be complete.
+	var subscribedAt, lost time.Time
+	for {
+		subscribed, err := runSession(ctx, opts, cw, pipeline, symbols, func() {
+			subscribedAt = time.Now()
+			fill(lost, subscribedAt)
+			lost = time.Time{}
+		})
+		if subscribed {
+			lost = pipeline.lastReceived()
+			if lost.Before(subscribedAt) {
+				lost = subscribedAt
+			}
+			lost = lost.Add(-gapMargin)
+		}
+		if ctx.Err() != nil {
+			log.Println("Context done, stopping.")
+			return nil
+		}
 
-		// Set up the semaphore to have at most 10 concurrent goroutines
-		sem := make(chan struct{}, 10) // max 10 concurrent goroutines
-		// Initiate the batch.
-		var batch []utils.RawTrade
+		var streamErr *StreamError
+		if errors.As(err, &streamErr) && !streamErr.Retryable() {
+			return err
+		}
 
-		// Set up the batch size
-		batchSize := 100
+		// A session that got as far as subscribing resets the backoff.
+		if subscribed {
+			attempts = 0
+			backoff = opts.Reconnect.InitialBackoff
+		}
+		attempts++
+		if opts.Reconnect.MaxAttempts > 0 && attempts > opts.Reconnect.MaxAttempts {
+			return fmt.Errorf("giving up after %d reconnect attempts: %w", opts.Reconnect.MaxAttempts, err)
+		}
 
-		for {
+		log.Printf("Stream connection lost: %v. Reconnecting in %v (attempt %d).", err, backoff, attempts)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+
+		backoff *= 2
+		if backoff > opts.Reconnect.MaxBackoff {
+			backoff = opts.Reconnect.MaxBackoff
+		}
+	}
+}
+
+// streamOnSchedule streams from Lead before each trading day's pre-market
+// session until Linger after its post-market session, and stays
+// disconnected in between.
+func streamOnSchedule(ctx context.Context, opts ClientOptions, cw *capture.Writer, pipeline *Pipeline, symbols []string, fill func(start, end time.Time)) error {
+	for {
+		start, end, ok := scheduleWindow(opts.Calendar, *opts.Schedule, time.Now())
+		if !ok {
+			return errors.New("the calendar has no trading day within a year")
+		}
+
+		if wait := time.Until(start); wait > 0 {
+			log.Printf("Market closed. Connecting at %s (in %v).",
+				start.In(calendar.NewYork).Format("Mon Jan 2 15:04 MST"), wait.Round(time.Minute))
 			select {
+			case <-time.After(wait):
 			case <-ctx.Done():
-				log.Println("Context done, stopping.")
-				return
-			default:
-				// log.Println("Reading message.")
-				_, message, err := conn.ReadMessage()
-				if err != nil {
-					log.Printf("Error reading raw message: %v %s", err, message)
-					cancel() // Cancel the context on an error
-					return   // Exit the goroutine
-				}
-
-				// receivedBytes := []byte(message)
-				//receivedString := string(receivedBytes)
-				// log.Println("Received message:", receivedString)
-
-				// If "success" message is already received, process as RawTrade
-				if successReceived {
-					// log.Println("Processing as RawTrade.")
-					var trades []utils.RawTrade
-					if err := json.Unmarshal(message, &trades); err != nil {
-						log.Printf("Error unmarshalling array of trades: %v", err)
-						continue
-					}
-
-					/// This is where we send the trade data to the rest
-					// of the application for processing.
-					for _, trade := range trades {
-						batch = append(batch, trade)
-
-						if len(batch) >= batchSize {
-							sem <- struct{}{}
-							localBatch := batch // Create a local copy of the batch
-							go func(batch []utils.RawTrade) {
-								handleWebSocketBatch(batch)
-								<-sem // Release semaphore
-							}(localBatch)
-							batch = nil // Reset the batch
-						}
-					}
-
-					continue
-				} else {
-					// log.Println("Processing as GenericMessage. %v", message)
-					// Try to unmarshal into a GenericMessage to look for "success"
-					var messages []GenericMessage
-					if err := json.Unmarshal(message, &messages); err != nil {
-						log.Printf("Error unmarshalling initial message: %v", err)
-						log.Printf("Message: %s", message)
-						continue
-					}
-
-					for _, msg := range messages {
-
-						if msg.T == "success" || msg.T == "subscription" {
-							log.Println("Received success message.")
-							// Update the flag
-							successReceived = true
-						} else {
-							log.Printf("Received unknown or unhandled message type: %v", msg.T)
-						}
-					}
-				}
+				return nil
 			}
+		}
 
-			// Process the remaining trades, if there are any, after exiting the loop
-			if len(batch) > 0 {
-				handleWebSocketBatch(batch)
-				batch = nil // Reset the batch for clarity, though not strictly necessary here
-			}
+		log.Printf("Streaming until %s.", end.In(calendar.NewYork).Format("Mon Jan 2 15:04 MST"))
+		dayCtx, cancel := context.WithDeadline(ctx, end)
+		err := stream(dayCtx, opts, cw, pipeline, symbols, fill)
+		cancel()
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+		log.Println("Trading day over, disconnected.")
+	}
+}
+
+// scheduleWindow returns when to connect for, and disconnect after, the
+// trading day that is current or next at now.
+func scheduleWindow(cal *calendar.Calendar, sched ScheduleConfig, now time.Time) (start, end time.Time, ok bool) {
+	day, ok := cal.NextDay(now.Add(-sched.Linger))
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	return day.PreOpen.Add(-sched.Lead), day.PostClose.Add(sched.Linger), true
+}
+
+// runSession connects, authenticates, subscribes and then feeds frames to
+// the pipeline until the connection fails or ctx ends, calling onSubscribed
+// once the subscription is confirmed. subscribed reports whether the
+// session got that far.
+func runSession(ctx context.Context, opts ClientOptions, cw *capture.Writer, pipeline *Pipeline, symbols []string, onSubscribed func()) (subscribed bool, err error) {
+	// Custom Gorilla Dialer with TLS verification disabled
+	dialer := websocket.Dialer{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		EnableCompression: true,
+		HandshakeTimeout:  30 * time.Second,
+	}
 
+	conn, resp, err := establishConnection(dialer, opts)
+	if err != nil {
+		if resp != nil {
+			return false, fmt.Errorf("Failed to connect: %v (HTTP %s)", err, resp.Status)
 		}
+		return false, fmt.Errorf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
 
-	}(ctx, conn)
+	// Closing the connection is the only way to interrupt a blocked read.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
-	wg.Wait() // Wait for all goroutines to finish
-}
+	if err := authenticate(conn, cw); err != nil {
+		return false, err
+	}
 
-// handleWebSocketBatch processes a slice of RawTrade objects.
-func handleWebSocketBatch(rawTrades []utils.RawTrade) {
-	var validLineProtocols []string
+	if err := subscribe(ctx, conn, cw, pipeline.ProcessFrame, symbols); err != nil {
+		return false, err
+	}
+	log.Printf("Subscribed to trades for %d symbols.", len(symbols))
+	onSubscribed()
 
-	// Iterate over each RawTrade to convert and validate
-	for _, raw := range rawTrades {
-		convertedData := ConvertToTradeData(raw)
-		lineProtocol := convertedData.FormatTradeLineProtocol()
+	for {
+		message, err := readFrame(conn, cw)
+		if err != nil {
+			return true, fmt.Errorf("Error reading raw message: %v", err)
+		}
 
-		if telegraf.IsValidLineProtocol(lineProtocol) {
-			validLineProtocols = append(validLineProtocols, lineProtocol)
-		} else {
-			log.Println("Invalid line protocol:", lineProtocol)
+		if !pipeline.ProcessFrame(ctx, message) {
+			return true, ctx.Err()
 		}
 	}
+}
+
+// ResolveSymbols returns the symbols the client would subscribe to and a
+// description of where they came from. The symbols are normalized and,
+// with opts.Assets, symbols that aren't active, tradable assets are left
+// out, since one bad symbol fails the whole subscription.
+func ResolveSymbols(ctx context.Context, opts ClientOptions) ([]string, string, error) {
+	symbols, source := opts.Symbols, "configuration"
+	if len(symbols) == 0 {
+		sources := opts.SymbolSources
+		if len(sources) == 0 {
+			sources = author_symbols.Default()
+		}
+		var err error
+		if symbols, source, err = sources.Resolve(ctx); err != nil {
+			return nil, "", err
+		}
+	}
+
+	symbols = author_symbols.Normalize(symbols)
+	if opts.Assets != nil {
+		valid, rejected, err := opts.Assets.Check(ctx, symbols)
+		if err != nil {
+			log.Printf("Not checking symbols against the assets list: %v", err)
+		}
+		if len(rejected) > 0 {
+			reasons := make([]string, 0, len(rejected))
+			for symbol, reason := range rejected {
+				reasons = append(reasons, symbol+" ("+reason+")")
+			}
+			sort.Strings(reasons)
+			log.Printf("Leaving out %d symbols: %s", len(rejected), strings.Join(reasons, ", "))
+		}
+		symbols = valid
+	}
+	if len(symbols) == 0 {
+		return nil, "", fmt.Errorf("no valid symbols from %s", source)
+	}
+	return symbols, source, nil
+}
+
+// flushCapture periodically flushes the capture writer so a crash loses at
+// most a second of frames.
+func flushCapture(ctx context.Context, cw *capture.Writer) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-	// Send all valid line protocols to Telegraf
-	if len(validLineProtocols) > 0 {
-		if err := telegraf.SendToTelegraf(validLineProtocols); err != nil {
-			log.Println("Error sending batch to Telegraf:", err)
-			log.Println("Failed trade data:", validLineProtocols)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cw.Flush(); err != nil {
+				log.Printf("Error flushing capture file: %v", err)
+			}
 		}
 	}
 }
@@ -292,6 +679,8 @@ func ConvertToTradeData(raw utils.RawTrade) *TradeData {
 		Time:   utils.ParseStrConvertToEpochNs(raw.Time),
 		I:      raw.I,
 		Z:      raw.Z,
+
+		Conditions: conditions.Decode(raw.Z, raw.C),
 	}
 }
 
@@ -301,24 +690,72 @@ func removeSpaces(input string) string {
 }
 
 func (data *TradeData) FormatTradeLineProtocol() string {
-	// Measurement
-	measurement := "alpaca_equities_streaming_trades"
-
-	// Prepare trade condition
-	condition := removeSpaces(data.C)
-
-	// Tags
-	tags := fmt.Sprintf("symbol=%s,conditions_str=\"%s\",exchange=%s", data.Symbol, condition, data.X)
-	tags = removeSpaces(tags)
+	tags := data.seriesKey()
+	if data.Sequence > 0 {
+		tags += fmt.Sprintf(",seq=%d", data.Sequence)
+	}
 
 	// Fields
 	fields := fmt.Sprintf("price=%f,size=%d,trade_id=%d,tape=\"%s\"", data.Price, data.Size, data.I, data.Z)
 	fields = removeSpaces(fields)
+	fields += "," + data.Conditions.Fields()
+	if data.Outlier {
+		fields += fmt.Sprintf(",outlier_score=%f", data.OutlierScore)
+	}
 
 	// Time
 	time := data.Time // Assuming it's already in epoch nanoseconds
 
-	return fmt.Sprintf("%s,%s %s %d", measurement, tags, fields, time)
+	return fmt.Sprintf("%s %s %d", tags, fields, time)
+}
+
+// seriesKey returns the measurement and tags, which identify the series
+// the trade is written to.
+func (data *TradeData) seriesKey() string {
+	// Measurement
+	measurement := TradesMeasurement
+	if data.Measurement != "" {
+		measurement = data.Measurement
+	}
+
+	// Prepare trade condition
+	condition := removeSpaces(data.C)
+
+	// Tags
+	tags := fmt.Sprintf("symbol=%s,conditions_str=\"%s\"", data.Symbol, condition)
+	// Line protocol has no empty tag values, so a trade without an
+	// exchange is written without the tag rather than rejected.
+	if data.X != "" {
+		tags += ",exchange=" + data.X
+	}
+	tags = removeSpaces(tags)
+	if data.Session != "" {
+		tags += ",session=" + string(data.Session)
+	}
+	if data.Enriched {
+		tags += data.enrichmentTags()
+	}
+	if data.Outlier {
+		tags += ",outlier=true"
+	}
+	return measurement + "," + tags
+}
+
+// enrichmentTags looks up the exchange and tape codes. Unknown codes are
+// left out rather than written as empty tags.
+func (data *TradeData) enrichmentTags() string {
+	var tags string
+	if venue, ok := exchanges.Lookup(data.X); ok {
+		tags += ",exchange_name=" + telegraf.EscapeTag(venue.Name)
+		if venue.MIC != "" {
+			tags += ",exchange_mic=" + venue.MIC
+		}
+		tags += fmt.Sprintf(",off_exchange=%t", venue.OffExchange)
+	}
+	if name := exchanges.TapeName(data.Z); name != "" {
+		tags += ",tape_name=" + telegraf.EscapeTag(name)
+	}
+	return tags
 }
 
 // Unused
@@ -0,0 +1,342 @@
+package websocket_conn
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-alpaca-streaming/pkg/alpacatest"
+	"go-alpaca-streaming/pkg/batcher"
+	"go-alpaca-streaming/pkg/calendar"
+	"go-alpaca-streaming/pkg/checkpoint"
+	"go-alpaca-streaming/pkg/dedup"
+	"go-alpaca-streaming/pkg/sink"
+	"go-alpaca-streaming/pkg/workerpool"
+)
+
+// recordingSink keeps every line written to it.
+type recordingSink struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (s *recordingSink) Write(lines []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, lines...)
+	return nil
+}
+
+// waitForLines polls until at least n lines arrived or the timeout passes.
+func (s *recordingSink) waitForLines(t *testing.T, n int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		got := append([]string(nil), s.lines...)
+		s.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d lines", n)
+	return nil
+}
+
+func testOptions(server *alpacatest.Server, out *recordingSink) ClientOptions {
+	return ClientOptions{
+		Batch:     batcher.Config{MaxSize: 10, MaxLinger: 10 * time.Millisecond},
+		Workers:   workerpool.Config{Workers: 2, QueueSize: 10},
+		URL:       server.URL,
+		KeyID:     "key",
+		SecretKey: "secret",
+		Symbols:   []string{"AAPL", "MSFT"},
+		Sink:      out,
+		Reconnect: ReconnectConfig{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond},
+	}
+}
+
+func trade(symbol string, id int64) alpacatest.Trade {
+	return alpacatest.Trade{
+		ID:         id,
+		Symbol:     symbol,
+		Exchange:   "V",
+		Price:      100.5,
+		Size:       10,
+		Timestamp:  "2024-03-01T14:30:00.123456789Z",
+		Conditions: []string{"@"},
+		Tape:       "C",
+	}
+}
+
+// gapRecorder is a Backfiller that records the gaps it is asked to fill.
+type gapRecorder struct {
+	mu      sync.Mutex
+	gaps    [][2]time.Time
+	symbols []string
+	since   map[string]time.Time
+	resumed int
+}
+
+func (g *gapRecorder) Fill(ctx context.Context, start, end time.Time, symbols []string, out sink.Sink) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.gaps = append(g.gaps, [2]time.Time{start, end})
+	g.symbols = symbols
+	return nil
+}
+
+func (g *gapRecorder) FillSince(ctx context.Context, since map[string]time.Time, end time.Time, out sink.Sink) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.since = since
+	return nil
+}
+
+func (g *gapRecorder) Resume(ctx context.Context, out sink.Sink) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.resumed++
+	return nil
+}
+
+func TestRunStreamsTradesAndReconnects(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	defer server.Close()
+
+	out := &recordingSink{}
+	gaps := &gapRecorder{}
+	opts := testOptions(server, out)
+	opts.Backfill = gaps
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, opts) }()
+
+	sub, err := server.WaitForSubscription(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(sub["trades"], ","); got != "AAPL,MSFT" {
+		t.Fatalf("Expected a trades subscription for AAPL,MSFT, got %q", got)
+	}
+
+	// TSLA is not subscribed, so the server does not send it.
+	server.SendTrades(trade("AAPL", 1), trade("MSFT", 2), trade("TSLA", 3))
+	lines := out.waitForLines(t, 2)
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "alpaca_equities_streaming_trades,symbol=") {
+			t.Errorf("Unexpected line: %s", line)
+		}
+	}
+
+	disconnected := time.Now()
+	server.Disconnect()
+	if _, err := server.WaitForSubscription(5 * time.Second); err != nil {
+		t.Fatalf("Expected the client to reconnect and resubscribe: %v", err)
+	}
+	if server.Connections() != 2 {
+		t.Fatalf("Expected 2 connections, got %d", server.Connections())
+	}
+
+	server.SendTrades(trade("AAPL", 4))
+	lines = out.waitForLines(t, 3)
+	if !strings.Contains(lines[2], "trade_id=4") {
+		t.Fatalf("Expected the trade sent after reconnecting, got %s", lines[2])
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected Run to return nil on cancel, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+
+	// Run waits for backfills before returning.
+	if gaps.resumed != 1 || len(gaps.gaps) != 1 {
+		t.Fatalf("Expected one resume and one gap, got %d and %v", gaps.resumed, gaps.gaps)
+	}
+	gap := gaps.gaps[0]
+	if !gap[0].Before(disconnected) || !gap[1].After(disconnected) {
+		t.Errorf("Gap %v - %v does not cover the disconnect at %v", gap[0], gap[1], disconnected)
+	}
+	if strings.Join(gaps.symbols, ",") != "AAPL,MSFT" {
+		t.Errorf("Expected the gap to be filled for AAPL,MSFT, got %v", gaps.symbols)
+	}
+}
+
+func TestRunFillsFromCheckpoints(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	at := time.Date(2024, 3, 1, 14, 30, 0, 123456789, time.UTC)
+	store, err := checkpoint.Open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Record("AAPL", checkpoint.Entry{Time: at, ID: 1, Exchange: "V", Tape: "C"})
+
+	out := &recordingSink{}
+	gaps := &gapRecorder{}
+	opts := testOptions(server, out)
+	opts.Backfill = gaps
+	opts.Dedup = dedup.New(dedup.Config{})
+	opts.Checkpoint = store
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, opts) }()
+
+	if _, err := server.WaitForSubscription(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// The checkpointed AAPL trade was already written.
+	server.SendTrades(trade("AAPL", 1), trade("MSFT", 2))
+	lines := out.waitForLines(t, 1)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lines) != 1 || !strings.Contains(lines[0], "symbol=MSFT") {
+		t.Errorf("Expected only the MSFT trade, got %v", lines)
+	}
+	if len(gaps.since) != 1 || !gaps.since["AAPL"].Equal(at) {
+		t.Errorf("Expected a fill since the AAPL checkpoint, got %v", gaps.since)
+	}
+
+	// Closing flushed the MSFT checkpoint.
+	reopened, err := checkpoint.Open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := reopened.Entries()["MSFT"]; !ok || e.ID != 2 || !e.Time.Equal(at) {
+		t.Errorf("Unexpected MSFT checkpoint %+v", e)
+	}
+}
+
+func TestResolveSymbolsNormalizes(t *testing.T) {
+	symbols, source, err := ResolveSymbols(context.Background(), ClientOptions{Symbols: []string{" aapl", "BRK/B", "AAPL"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(symbols, ",") != "AAPL,BRK.B" || source != "configuration" {
+		t.Errorf("Got %v from %s", symbols, source)
+	}
+}
+
+func TestRunStopsOnAuthFailure(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	defer server.Close()
+
+	opts := testOptions(server, &recordingSink{})
+	opts.SecretKey = "wrong"
+
+	err := Run(context.Background(), opts)
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Code != alpacatest.CodeAuthFailed {
+		t.Fatalf("Expected auth failed error, got %v", err)
+	}
+	if server.Connections() != 1 {
+		t.Fatalf("Expected no reconnect after auth failure, got %d connections", server.Connections())
+	}
+}
+
+func TestRunStopsOnSymbolLimit(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	defer server.Close()
+	server.SetSymbolLimit(1)
+
+	err := Run(context.Background(), testOptions(server, &recordingSink{}))
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Code != alpacatest.CodeSymbolLimitExceeded {
+		t.Fatalf("Expected symbol limit error, got %v", err)
+	}
+}
+
+func TestRunGivesUpAfterMaxAttempts(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	url := server.URL
+	server.Close()
+
+	opts := testOptions(server, &recordingSink{})
+	opts.URL = url
+	opts.Reconnect.MaxAttempts = 2
+
+	if err := Run(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "giving up") {
+		t.Fatalf("Expected Run to give up, got %v", err)
+	}
+}
+
+func TestProbePrintsFramesAndExits(t *testing.T) {
+	server := alpacatest.NewServer("key", "secret")
+	defer server.Close()
+
+	out := &recordingSink{}
+	var buf strings.Builder
+	done := make(chan error, 1)
+	go func() {
+		done <- Probe(context.Background(), testOptions(server, out), []string{"SPY"}, 2, &buf)
+	}()
+
+	if _, err := server.WaitForSubscription(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	server.SendTrades(trade("SPY", 7))
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Probe failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Probe did not return after printing its frames")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected a header and 2 frames, got %q", lines)
+	}
+	if !strings.Contains(lines[1], `"T":"subscription"`) || !strings.Contains(lines[2], `"i":7`) {
+		t.Fatalf("Unexpected frames: %q", lines[1:])
+	}
+	if len(out.lines) != 0 {
+		t.Fatalf("Probe must not write to the sink, got %d lines", len(out.lines))
+	}
+}
+
+func TestScheduleWindow(t *testing.T) {
+	cal := calendar.NYSE()
+	sched := ScheduleConfig{Lead: 5 * time.Minute, Linger: 5 * time.Minute}
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, calendar.NewYork)
+	}
+
+	cases := []struct {
+		now        time.Time
+		start, end time.Time
+	}{
+		// Friday during the day.
+		{at(time.March, 1, 12, 0), at(time.March, 1, 3, 55), at(time.March, 1, 20, 5)},
+		// Friday, still lingering after post-market.
+		{at(time.March, 1, 20, 2), at(time.March, 1, 3, 55), at(time.March, 1, 20, 5)},
+		// Friday night: wait for Monday.
+		{at(time.March, 1, 21, 0), at(time.March, 4, 3, 55), at(time.March, 4, 20, 5)},
+		// Wednesday before Thanksgiving, night: skip to Friday's early close.
+		{at(time.November, 27, 22, 0), at(time.November, 29, 3, 55), at(time.November, 29, 17, 5)},
+	}
+	for _, c := range cases {
+		start, end, ok := scheduleWindow(cal, sched, c.now)
+		if !ok || !start.Equal(c.start) || !end.Equal(c.end) {
+			t.Errorf("scheduleWindow(%v) = %v - %v, want %v - %v", c.now, start, end, c.start, c.end)
+		}
+	}
+}
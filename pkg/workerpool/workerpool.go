@@ -0,0 +1,125 @@
+package workerpool
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"go-alpaca-streaming/pkg/backpressure"
+	"go-alpaca-streaming/pkg/batcher"
+	"go-alpaca-streaming/pkg/utils"
+)
+
+// Config sizes the pool.
+type Config struct {
+	// Workers is the number of goroutines writing to the sink.
+	Workers int
+	// QueueSize is the number of trades buffered between the reader and each worker.
+	QueueSize int
+	// Backpressure decides what happens when a worker's queue is full.
+	Backpressure backpressure.Config
+}
+
+// DefaultConfig returns the pool size used when nothing is configured.
+func DefaultConfig() Config {
+	return Config{
+		Workers:      10,
+		QueueSize:    1000,
+		Backpressure: backpressure.DefaultConfig(),
+	}
+}
+
+// Pool is a fixed set of workers. Every symbol is hashed to exactly one
+// worker, and each worker batches and flushes its trades in arrival order,
+// so per-symbol ordering is preserved from the reader through to the sink.
+type Pool struct {
+	queues   []*backpressure.Queue
+	batchers []*batcher.Batcher
+	wg       sync.WaitGroup
+}
+
+// New creates a pool whose workers batch trades with batchCfg and hand each
+// batch to flush. flush is called from the owning worker's goroutine only.
+func New(cfg Config, batchCfg batcher.Config, flush batcher.FlushFunc) (*Pool, error) {
+	def := DefaultConfig()
+	if cfg.Workers <= 0 {
+		cfg.Workers = def.Workers
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = def.QueueSize
+	}
+
+	p := &Pool{
+		queues:   make([]*backpressure.Queue, cfg.Workers),
+		batchers: make([]*batcher.Batcher, cfg.Workers),
+	}
+
+	// The worker count may have changed since trades were spilled.
+	if cfg.Backpressure.Policy == backpressure.SpillToDisk {
+		if err := backpressure.Repartition(cfg.Backpressure.SpillDir, "worker-", cfg.Workers, p.partition); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range p.queues {
+		queue, err := backpressure.NewQueue(fmt.Sprintf("worker-%d", i), cfg.QueueSize, cfg.Backpressure)
+		if err != nil {
+			return nil, err
+		}
+		p.queues[i] = queue
+
+		var b *batcher.Batcher
+		b = batcher.New(batchCfg, func(batch []utils.RawTrade) {
+			start := time.Now()
+			flush(batch)
+			b.ObserveLatency(time.Since(start))
+		})
+		p.batchers[i] = b
+	}
+
+	return p, nil
+}
+
+// Start launches the workers. They run until Close is called and their
+// queues are drained; ctx ending does not stop them, so trades queued at
+// shutdown are still written.
+func (p *Pool) Start(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	for i := range p.queues {
+		p.wg.Add(1)
+		go func(b *batcher.Batcher, queue *backpressure.Queue) {
+			defer p.wg.Done()
+			b.Run(ctx, queue.Start(ctx))
+		}(p.batchers[i], p.queues[i])
+	}
+}
+
+// Submit routes a trade to the worker that owns its symbol. When that
+// worker's queue is full the configured backpressure policy applies. It
+// returns false if ctx ends while blocked.
+func (p *Pool) Submit(ctx context.Context, trade utils.RawTrade) bool {
+	return p.queues[p.partition(trade.Symbol)].Push(ctx, trade)
+}
+
+// Close stops accepting trades and waits for the workers to flush what they
+// have. Submit returns false after Close.
+func (p *Pool) Close() {
+	for _, queue := range p.queues {
+		queue.Close()
+	}
+	p.wg.Wait()
+}
+
+// Size returns the number of workers.
+func (p *Pool) Size() int {
+	return len(p.queues)
+}
+
+// partition maps a symbol to a worker index.
+func (p *Pool) partition(symbol string) int {
+	h := fnv.New32a()
+	h.Write([]byte(symbol))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
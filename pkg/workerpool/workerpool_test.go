@@ -0,0 +1,119 @@
+package workerpool
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go-alpaca-streaming/pkg/batcher"
+	"go-alpaca-streaming/pkg/utils"
+)
+
+func TestPerSymbolOrderIsPreserved(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string][]int{}
+
+	flush := func(batch []utils.RawTrade) {
+		// Make workers finish at different speeds.
+		time.Sleep(time.Duration(len(batch)%3) * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, trade := range batch {
+			seen[trade.Symbol] = append(seen[trade.Symbol], trade.I)
+		}
+	}
+
+	pool, err := New(Config{Workers: 4, QueueSize: 8}, batcher.Config{MaxSize: 5, MaxLinger: time.Millisecond}, flush)
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	ctx := context.Background()
+	pool.Start(ctx)
+
+	symbols := []string{"AAPL", "MSFT", "SPY", "QQQ", "TSLA", "NVDA"}
+	const perSymbol = 200
+	for i := 0; i < perSymbol; i++ {
+		for _, symbol := range symbols {
+			if !pool.Submit(ctx, utils.RawTrade{Symbol: symbol, I: i}) {
+				t.Fatal("Submit returned false with a live context")
+			}
+		}
+	}
+	pool.Close()
+
+	for _, symbol := range symbols {
+		ids := seen[symbol]
+		if len(ids) != perSymbol {
+			t.Fatalf("Expected %d trades for %s, got %d", perSymbol, symbol, len(ids))
+		}
+		for i, id := range ids {
+			if id != i {
+				t.Fatalf("Trades for %s out of order at position %d: got id %d", symbol, i, id)
+			}
+		}
+	}
+}
+
+func TestPartitionIsStable(t *testing.T) {
+	pool, err := New(Config{Workers: 7}, batcher.DefaultConfig(), func([]utils.RawTrade) {})
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+
+	for _, symbol := range []string{"AAPL", "BRK.B", "SPY"} {
+		first := pool.partition(symbol)
+		for i := 0; i < 10; i++ {
+			if got := pool.partition(symbol); got != first {
+				t.Fatalf("Partition for %s changed from %d to %d", symbol, first, got)
+			}
+		}
+		if first < 0 || first >= pool.Size() {
+			t.Fatalf("Partition %d for %s out of range", first, symbol)
+		}
+	}
+}
+
+func TestSubmitReturnsWhenContextDone(t *testing.T) {
+	pool, err := New(Config{Workers: 1, QueueSize: 1}, batcher.DefaultConfig(), func([]utils.RawTrade) {})
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	// Workers are not started, so the queue fills up.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if !pool.Submit(ctx, utils.RawTrade{Symbol: "AAPL"}) {
+		t.Fatal("Expected the first trade to fit in the queue")
+	}
+	cancel()
+	if pool.Submit(ctx, utils.RawTrade{Symbol: "AAPL"}) {
+		t.Fatal("Expected Submit to give up once the context is cancelled")
+	}
+}
+
+func TestCloseDrainsAfterCancel(t *testing.T) {
+	var mu sync.Mutex
+	var written int
+	pool, err := New(Config{Workers: 2, QueueSize: 100}, batcher.Config{MaxSize: 10, MaxLinger: time.Hour}, func(batch []utils.RawTrade) {
+		mu.Lock()
+		written += len(batch)
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pool.Start(ctx)
+	for i := 0; i < 95; i++ {
+		pool.Submit(ctx, utils.RawTrade{Symbol: fmt.Sprintf("S%d", i%7), I: i})
+	}
+
+	// Shutting down on a signal cancels ctx before the pool is closed.
+	cancel()
+	pool.Close()
+	if written != 95 {
+		t.Errorf("Expected every queued trade written, got %d", written)
+	}
+}